@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// marketSnapshot is one polling cycle worth of market data. Snapshot files
+// hold one JSON encoded snapshot per line and may be gzip compressed.
+type marketSnapshot struct {
+	Time       time.Time                    `json:"time"`
+	Exchange   string                       `json:"exchange"`
+	Summaries  []bittrex.MarketSummary      `json:"summaries"`
+	OrderBooks map[string]bittrex.OrderBook `json:"orderBooks,omitempty"`
+}
+
+// replaySource feeds recorded snapshots to the pipeline one at a time.
+type replaySource struct {
+	snapshots []marketSnapshot
+	current   int
+}
+
+func loadSnapshots(paths []string) ([]marketSnapshot, error) {
+	snapshots := make([]marketSnapshot, 0)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		var reader io.Reader = file
+		if strings.HasSuffix(path, ".gz") {
+			gzipReader, err := gzip.NewReader(file)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%v: %v", path, err)
+			}
+			reader = gzipReader
+		}
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			var snapshot marketSnapshot
+			if err := json.Unmarshal(scanner.Bytes(), &snapshot); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%v:%v: %v", path, line, err)
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+		err = scanner.Err()
+		file.Close()
+		// The file being recorded to has no gzip trailer yet, keep what was read.
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	sort.SliceStable(snapshots, func(aIndex, bIndex int) bool {
+		return snapshots[aIndex].Time.Before(snapshots[bIndex].Time)
+	})
+	return snapshots, nil
+}
+
+func (r *replaySource) next() bool {
+	if r.current >= len(r.snapshots) {
+		return false
+	}
+	r.current++
+	return true
+}
+
+func (r *replaySource) snapshot() marketSnapshot {
+	return r.snapshots[r.current-1]
+}
+
+func (r *replaySource) GetMarketSummaries() ([]bittrex.MarketSummary, error) {
+	if r.current == 0 {
+		return nil, errors.New("replay has not started")
+	}
+	return r.snapshot().Summaries, nil
+}
+
+func (r *replaySource) GetOrderBook(market string) (bittrex.OrderBook, error) {
+	if r.current == 0 {
+		return bittrex.OrderBook{}, errors.New("replay has not started")
+	}
+	orderBook, exists := r.snapshot().OrderBooks[market]
+	if !exists {
+		return bittrex.OrderBook{}, fmt.Errorf("no recorded order book for %v", market)
+	}
+	return orderBook, nil
+}
+
+/* ******************************************************************
+ * Backtest
+ * *****************************************************************/
+type pairStats struct {
+	Trades      int
+	Wins        int
+	Cumulative  decimal.Decimal
+	Peak        decimal.Decimal
+	MaxDrawdown decimal.Decimal
+}
+
+func (s *pairStats) add(gain decimal.Decimal) {
+	s.Trades++
+	if gain.GreaterThan(decimal.Zero) {
+		s.Wins++
+	}
+	s.Cumulative = s.Cumulative.Add(gain)
+	if s.Cumulative.GreaterThan(s.Peak) {
+		s.Peak = s.Cumulative
+	}
+	drawdown := s.Peak.Sub(s.Cumulative)
+	if drawdown.GreaterThan(s.MaxDrawdown) {
+		s.MaxDrawdown = drawdown
+	}
+}
+
+func runBacktest(args []string) int {
+	flags := newFlagSet("backtest", "[flags] snapshot-file...")
+	configPath := flags.String("config", os.Getenv("CHAINGANG_CONFIG"), "config file with origins, stakes, markets and fees")
+	exchangeFlag := flags.String("exchange", "", "exchange whose origins and markets are used, defaults to the configured one")
+	minGain := flags.Float64("min-gain", 0, "only trade routes whose expected gain is above this, in the origin coin")
+	stakeScale := flags.Float64("stake-scale", 1, "multiply every origin's maximum stake by this")
+	useDepth := flags.Bool("depth", false, "fill against recorded order books instead of top of book")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return exitOK
+	} else if err != nil {
+		return exitUsage
+	}
+	if err := configureLogging(flags); err != nil {
+		fmt.Fprintln(flags.Output(), err)
+		return exitUsage
+	}
+
+	paths := make([]string, 0)
+	for _, pattern := range flags.Args() {
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			paths = append(paths, pattern)
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	snapshots, err := loadSnapshots(paths)
+	if err != nil {
+		return fail(err)
+	}
+	if len(snapshots) == 0 {
+		return fail(errors.New("no snapshots found"))
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return fail(err)
+	}
+	cfg.apply()
+	if *exchangeFlag != "" {
+		exchangeName = *exchangeFlag
+		fees = newFeeModel(cfg.Exchanges[exchangeName].feeSchedule())
+	}
+	if _, isSupported := validOrigins[exchangeName]; !isSupported {
+		return fail(fmt.Errorf("%v is not a supported exchange", exchangeName))
+	}
+	stakes := scaleStakes(validOrigins[exchangeName], decimal.NewFromFloat(*stakeScale))
+	minimumGain = decimal.NewFromFloat(*minGain)
+
+	replay := &replaySource{snapshots: snapshots}
+	paper := newPaperExchange(replay, paperBalances(stakes), *useDepth)
+	// Routes are sized from the scaled stakes, the configured ones are left
+	// as they were.
+	scaled := make(map[string]map[string]decimal.Decimal, len(validOrigins))
+	for name, origins := range validOrigins {
+		scaled[name] = origins
+	}
+	scaled[exchangeName] = stakes
+	validOrigins = scaled
+	live = true
+	orderPollInterval = 0
+	orderDeadline = 0
+
+	replayBacktest(replay, paper, *useDepth)
+	printBacktestReport(paper.results(), snapshots[0].Time, snapshots[len(snapshots)-1].Time)
+	return exitOK
+}
+
+// replayBacktest makes the best trade of every snapshot left in replay on
+// paper, each as of when the snapshot was recorded.
+func replayBacktest(replay *replaySource, paper *paperExchange, useDepth bool) {
+	for replay.next() {
+		marketSummaries, err := paper.GetMarketSummaries()
+		if err != nil {
+			logger.error("could not read snapshot", field("err", err))
+			continue
+		}
+		view := newMarketView(marketSummaries, replay.snapshot().Time)
+		view.replayed = true
+		view.createSummaries(paper)
+		view.sortSummaries()
+		if useDepth {
+			view.evaluateDepth(paper)
+		}
+		view.makeBestTrade(0, paper)
+	}
+}
+
+// scaleStakes returns a copy of stakes, each multiplied by scale.
+func scaleStakes(stakes map[string]decimal.Decimal, scale decimal.Decimal) map[string]decimal.Decimal {
+	scaled := make(map[string]decimal.Decimal, len(stakes))
+	for originName, originStake := range stakes {
+		scaled[originName] = originStake.Mul(scale)
+	}
+	return scaled
+}
+
+func printBacktestReport(results []routeResult, from time.Time, to time.Time) {
+	stats := make(map[string]*pairStats)
+	for _, result := range results {
+		pair := result.Origin + "-" + result.OutputOrigin
+		pairStat, exists := stats[pair]
+		if !exists {
+			pairStat = &pairStats{}
+			stats[pair] = pairStat
+		}
+		pairStat.add(result.Result.Sub(result.Stake))
+	}
+
+	pairs := make([]string, 0, len(stats))
+	for pair := range stats {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+
+	logger.info("backtest", field("from", from.Format(time.RFC3339)), field("to", to.Format(time.RFC3339)), field("routes", len(results)))
+	for _, pair := range pairs {
+		pairStat := stats[pair]
+		hitRate := decimal.NewFromFloat(float64(pairStat.Wins) / float64(pairStat.Trades))
+		logger.info("backtest pair", field("pair", pair), field("trades", pairStat.Trades), field("hitRate", hitRate.StringFixed(4)), field("cumulativeGain", pairStat.Cumulative), field("maxDrawdown", pairStat.MaxDrawdown))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestScaleStakesLeavesConfigAlone(t *testing.T) {
+	stakes := map[string]decimal.Decimal{"BTC": dec("0.005"), "USDT": dec("5")}
+	scaled := scaleStakes(stakes, dec("2"))
+	assertDecimal(t, "scaled BTC", scaled["BTC"], "0.01")
+	assertDecimal(t, "scaled USDT", scaled["USDT"], "10")
+	assertDecimal(t, "configured BTC", stakes["BTC"], "0.005")
+}
+
+func TestPairStats(t *testing.T) {
+	stats := &pairStats{}
+	for _, gain := range []string{"1", "-2", "0.5", "-1", "3"} {
+		stats.add(dec(gain))
+	}
+	if stats.Trades != 5 || stats.Wins != 3 {
+		t.Errorf("%v wins of %v trades, want 3 of 5", stats.Wins, stats.Trades)
+	}
+	assertDecimal(t, "cumulative", stats.Cumulative, "1.5")
+	assertDecimal(t, "peak", stats.Peak, "1.5")
+	// From the peak of 1 down to -1.5.
+	assertDecimal(t, "max drawdown", stats.MaxDrawdown, "2.5")
+
+	losing := &pairStats{}
+	losing.add(dec("-1"))
+	assertDecimal(t, "drawdown from nothing", losing.MaxDrawdown, "1")
+}
+
+func TestReplayBacktest(t *testing.T) {
+	tests := []struct {
+		name   string
+		apart  time.Duration
+		routes int
+	}{
+		// The second route would take the hour's notional past the limit.
+		{"within the hour", time.Minute, 1},
+		{"hours apart", 2 * time.Hour, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			fees = newFeeModel(feeConfig{})
+			risk = newRiskManager(riskConfig{MaxHourlyNotional: dec("80")})
+			live = true
+			// Recorded a day ago, so windows kept on the local clock would
+			// count both routes in the same hour.
+			recorded := time.Now().Add(-24 * time.Hour)
+			replay := &replaySource{snapshots: []marketSnapshot{
+				{Time: recorded, Summaries: testSummaries()},
+				{Time: recorded.Add(test.apart), Summaries: testSummaries()},
+			}}
+			paper := newPaperExchange(replay, paperBalances(validOrigins[exchangeName]), false)
+			replayBacktest(replay, paper, false)
+
+			results := paper.results()
+			if len(results) != test.routes {
+				t.Fatalf("traded %v routes, want %v", len(results), test.routes)
+			}
+			for _, result := range results {
+				assertDecimal(t, result.Origin+" "+result.Vessel+" "+result.OutputOrigin+" gain", result.Result.Sub(result.Stake), "0.00011")
+			}
+		})
+	}
+}
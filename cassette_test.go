@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestCassetteRecordsWithoutCredentials(t *testing.T) {
+	setupTest(t)
+	dir, err := ioutil.TempDir("", "chaingang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.cassette")
+
+	key, secret := "key-3f9c1a", "secret-b72e40"
+	fake, err := newFakeBittrex(fakeScript{
+		Summaries: testSummaries(),
+		Balances:  map[string]decimal.Decimal{"BTC": dec("1")},
+	}, key, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An answer that echoes the key has it redacted too.
+	fake.fail(fakeError{Endpoint: "getbalances", Message: "APIKEY_THROTTLED " + key})
+	server, err := startFakeServer(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	recorder, err := newCassetteRecorder(path, server.transport(), key, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording := newRestOnlyExchange(key, secret, recorder)
+
+	if _, err := recording.GetBalances(); err == nil {
+		t.Fatal("scripted error not returned")
+	}
+	balances, err := recording.GetBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orderId, err := recording.BuyLimit("BTC-ETH", dec("0.1"), dec("0.05"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := recording.GetOrder(orderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.file.Close()
+
+	cassette, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leaked := range []string{key, secret, "apisign", "apikey", "nonce"} {
+		if strings.Contains(string(cassette), leaked) {
+			t.Errorf("cassette contains %q", leaked)
+		}
+	}
+
+	replaying, err := replayCassette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replaying.GetBalances(); err == nil || !strings.Contains(err.Error(), redacted) {
+		t.Errorf("replayed error %v, want it redacted", err)
+	}
+	replayedBalances, err := replaying.GetBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayedBalances) != len(balances) {
+		t.Fatalf("replayed %v balances, want %v", len(replayedBalances), len(balances))
+	}
+	for index, balance := range balances {
+		if replayedBalances[index].Currency != balance.Currency {
+			t.Errorf("replayed balance %v is %v, want %v", index, replayedBalances[index].Currency, balance.Currency)
+		}
+		assertDecimal(t, balance.Currency+" balance", replayedBalances[index].Available, balance.Available.String())
+	}
+	replayedId, err := replaying.BuyLimit("BTC-ETH", dec("0.1"), dec("0.05"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayedId != orderId {
+		t.Errorf("replayed order id %v, want %v", replayedId, orderId)
+	}
+	replayedOrder, err := replaying.GetOrder(orderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayedOrder.IsOpen != order.IsOpen {
+		t.Errorf("replayed order open %v, want %v", replayedOrder.IsOpen, order.IsOpen)
+	}
+	assertDecimal(t, "replayed remaining", replayedOrder.QuantityRemaining, order.QuantityRemaining.String())
+}
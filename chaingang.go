@@ -24,10 +24,13 @@ type Coin struct {
 }
 
 type Relationship struct {
-	Ask       decimal.Decimal
-	Bid       decimal.Decimal
-	Last      decimal.Decimal
-	Timestamp string
+	Ask  decimal.Decimal
+	Bid  decimal.Decimal
+	Last decimal.Decimal
+	// Timestamp is when the exchange stamped the quote, zero when it did not,
+	// and Received when the quote got here by our clock, which ages it
+	Timestamp time.Time
+	Received  time.Time
 }
 
 type summary struct {
@@ -38,6 +41,10 @@ type summary struct {
 	OutputCoin string
 	Quantity   decimal.Decimal
 	Vessel     string
+	// Depth* are filled in by evaluateDepth from the order books
+	DepthEvaluated bool
+	DepthGain      decimal.Decimal
+	DepthIndirect  decimal.Decimal
 }
 
 type parentCoin struct {
@@ -73,49 +80,139 @@ type summary struct {
 	DiffEthPerUsdt decimal.Decimal
 }
 */
+
+// marketView is one cycle's snapshot of the market: the coins priced from
+// its market summaries and the routes scored against them. A view is never
+// modified once published, stream quotes make a new one with withQuote, so
+// the dashboard, the trader and the next cycle can all read it unlocked.
+type marketView struct {
+	coins       map[string]*Coin
+	marketNames map[string]bool
+	summaries   map[string]map[string][]summary
+	// rejections maps each route left out by evaluateRoute to the reason
+	rejections map[string]string
+	// received is when the market summaries arrived. A replayed view was
+	// recorded then and ages its quotes as of that time, see now.
+	received time.Time
+	replayed bool
+}
+
+func newMarketView(marketSummaries []bittrex.MarketSummary, received time.Time) *marketView {
+	v := &marketView{
+		coins:       make(map[string]*Coin),
+		marketNames: make(map[string]bool),
+		summaries:   make(map[string]map[string][]summary),
+		rejections:  make(map[string]string),
+		received:    received,
+	}
+	v.createCoins(marketSummaries)
+	v.populateCoins()
+	return v
+}
+
 // Global Variables
 var (
 	acctBalance = &balances{
 		lock:     sync.RWMutex{},
 		balances: make(map[string]decimal.Decimal),
 	}
-	bittrexClient *bittrex.Bittrex
+	activeExchange Exchange
 	//live           = *flag.Bool("l", false, "Live")
-	live           = false
-	transactionFee = decimal.NewFromFloat(.0025)
-	parentCoins    = map[string]*parentCoin{}
-	childCoins     = map[string]*childCoin{}
-	coins          = map[string]*Coin{}
-	validOrigins   = map[string]map[string]decimal.Decimal{
-		"Bittrex": {
-			"BTC":  decimal.NewFromFloat(0.0050),
-			"ETH":  decimal.NewFromFloat(0.005),
-			"USDT": decimal.NewFromFloat(5),
-		},
-	}
-	validMarkets = map[string]map[string]bool{
-		"Bittrex": {
-			"BTC-ETH":  true,
-			"USDT-BTC": true,
-			"USDT-ETH": true,
-		},
-	}
-	exchangeName = "Bittrex"
-	summaries    map[string]map[string][]summary
+	live         = false
+	paperTrading = false
+	// fees, validOrigins, validMarkets, exchangeName and pollInterval
+	// are set from the config, see defaultConfig
+	fees         = newFeeModel(feeConfig{})
+	validOrigins map[string]map[string]decimal.Decimal
+	validMarkets map[string]map[string]bool
+	exchangeName = ""
+	pollInterval time.Duration
 	details      = false
 	//details      = *flag.Bool("details", false, "Details")
+
+	// gains are shown valued in valuationCurrency, which routes never start
+	// from when it is an origin
+	valuationCurrency = "USDT"
+
+	// paper accounts start with this many maximum stakes of each origin
+	paperStakeMultiple = decimal.NewFromFloat(10)
+	// what executeRoute does with coins left over when a leg fails
+	unwindPolicy   = unwindMarket
+	unwindRetries  = 2
+	unwindSlippage = decimal.NewFromFloat(0.01)
+	// routes are only traded when they are expected to gain more than this
+	minimumGain       = decimal.NewFromFloat(0)
+	orderPollInterval = time.Duration(5) * time.Second
+	// orders still open this long after being placed are canceled
+	orderDeadline     = time.Duration(15) * time.Second
+	orderTracker      = newOrderManager()
+	recordRotateEvery = time.Duration(1) * time.Hour
+	recordMaxFiles    = 24 * 7
+	// how many of the best routes per origin pair are re-priced against order books
+	depthCandidates   = 5
+	streamBufferSize  = 1024
+	streamResyncDelay = time.Duration(2) * time.Second
+	// longest cycle searched for by findCycles, 0 disables the search
+	maxCycleLength = 0
+	cyclesShown    = 20
+	spatialShown   = 20
+	marketLimits   = newMarketCatalog()
+	// Bittrex accepts up to 8 decimal places on quantities and rates, its v3
+	// market list gives each market's rate precision
+	quantityPrecision int32 = 8
+	ratePrecision     int32 = 8
+	bittrexMarketsURL       = "https://api.bittrex.com/v3/markets"
+	// how long calls the vendored client doesn't make wait for Bittrex
+	bittrexTimeout = time.Duration(30) * time.Second
+	// risk is set from the config, see riskConfig
+	risk                 = newRiskManager(riskConfig{})
+	killFilePollInterval = time.Second
+	logger               = newLogger(os.Stdout, levelInfo, logFormatLogfmt)
+	// journal records every route traded, nil when no journal is configured
+	journal *tradeJournal
+	// journalBucket holds a bucket of entries per route, and readers and
+	// writers wait journalLockTimeout for each other to let go of the journal
+	journalBucket      = []byte("routes")
+	journalLockTimeout = time.Duration(5) * time.Second
+	// routeGate closes on SIGINT or SIGTERM, routes in flight get
+	// shutdownGrace to finish before their orders are canceled
+	routeGate     = &tradingGate{}
+	shutdownGrace = time.Duration(60) * time.Second
+	// dashboard is what --listen serves besides /metrics
+	dashboard            = newDashboardState()
+	dashboardRefresh     = time.Duration(5) * time.Second
+	dashboardRoutesShown = 10
+	dashboardRouteLimit  = 100
+	dashboardOrderLimit  = 50
+	// finished orders kept for the dashboard and to tell ours apart
+	closedOrderLimit = 200
+	// every level of the order books a fake Bittrex makes up from summaries
+	fakeBookQuantity = decimal.NewFromFloat(1000000)
+	demoKey          = "demo"
+	demoSecret       = "demo"
+	// how long clients of a fake Bittrex or a cassette wait for an answer
+	restOnlyTimeout = time.Duration(10) * time.Second
+	// apiPolicy limits and retries calls to exchanges, see apiConfig
+	apiPolicy = defaultAPIConfig().policy()
+	// orders found after placing them failed may have been opened this
+	// long before the request was sent, by the exchange's clock
+	orderLookupSkew = time.Minute
+	// routes are not scored or traded on quotes older than maxQuoteAge or
+	// received further apart than maxQuoteSkew, zero is no limit
+	maxQuoteAge  time.Duration
+	maxQuoteSkew time.Duration
 )
 
 /* ******************************************************************
  * API Calls
  * *****************************************************************/
-func updateMarketSummaries(bittrexClient *bittrex.Bittrex) ([]bittrex.MarketSummary, error) {
-	marketSummaries, err := bittrexClient.GetMarketSummaries()
+func updateMarketSummaries(exchange Exchange) ([]bittrex.MarketSummary, error) {
+	marketSummaries, err := exchange.GetMarketSummaries()
 	return marketSummaries, err
 }
 
-func (b *balances) updateAccountBalances(bittrexClient *bittrex.Bittrex) error {
-	balances, err := bittrexClient.GetBalances()
+func (b *balances) updateAccountBalances(exchange Exchange) error {
+	balances, err := exchange.GetBalances()
 	if err != nil {
 
 		return err
@@ -134,32 +231,35 @@ func (b *balances) updateAccountBalances(bittrexClient *bittrex.Bittrex) error {
 /* ******************************************************************
  * Populate Metrics for Child and Parent Coins
  * *****************************************************************/
-func createCoins(marketSummaries []bittrex.MarketSummary) {
+func (v *marketView) createCoins(marketSummaries []bittrex.MarketSummary) {
 	for _, marketSummary := range marketSummaries {
 		relationshipName := strings.Split(marketSummary.MarketName, "-")[0]
 		coinName := strings.Split(marketSummary.MarketName, "-")[1]
 
-		_, coinExists := coins[coinName]
+		_, coinExists := v.coins[coinName]
 		zero := decimal.NewFromFloat(0.0)
 		if !marketSummary.Ask.Equal(zero) && !marketSummary.Bid.Equal(zero) && !marketSummary.Last.Equal(zero) {
+			v.marketNames[marketSummary.MarketName] = true
 			if !coinExists {
-				coins[coinName] = &Coin{
+				v.coins[coinName] = &Coin{
 					Name:          coinName,
 					Relationships: make(map[string]Relationship),
 				}
 			}
-			coins[coinName].Relationships[relationshipName] = Relationship{
-				Ask:  marketSummary.Ask,
-				Bid:  marketSummary.Bid,
-				Last: marketSummary.Last,
+			v.coins[coinName].Relationships[relationshipName] = Relationship{
+				Ask:       marketSummary.Ask,
+				Bid:       marketSummary.Bid,
+				Last:      marketSummary.Last,
+				Timestamp: parseQuoteTime(marketSummary.TimeStamp),
+				Received:  v.received,
 			}
 		}
 	}
 
 	for originName := range validOrigins[exchangeName] {
-		_, marketHasCoin := coins[originName]
+		_, marketHasCoin := v.coins[originName]
 		if !marketHasCoin {
-			coins[originName] = &Coin{
+			v.coins[originName] = &Coin{
 				Name:          originName,
 				Relationships: make(map[string]Relationship),
 			}
@@ -167,30 +267,32 @@ func createCoins(marketSummaries []bittrex.MarketSummary) {
 	}
 }
 
-func populateCoins() {
-	for coinName, coinValue := range coins {
+func (v *marketView) populateCoins() {
+	for coinName, coinValue := range v.coins {
 		for originName := range validOrigins[exchangeName] {
 			if originName != coinName {
 				_, hasRelationship := coinValue.Relationships[originName]
 				if !hasRelationship && isValidRelationship(exchangeName, coinName) {
-					fmt.Printf("%v : %v\n", coinName, originName)
+					logger.debug("inverted relationship", field("coin", coinName), field("origin", originName))
 					ask := decimal.NewFromFloat(0)
 					bid := decimal.NewFromFloat(0)
 					last := decimal.NewFromFloat(0)
-					if coins[originName].Relationships[coinName].Ask != decimal.NewFromFloat(0) {
-						ask = decimal.NewFromFloat(1).Div(coins[originName].Relationships[coinName].Ask)
+					if v.coins[originName].Relationships[coinName].Ask != decimal.NewFromFloat(0) {
+						ask = decimal.NewFromFloat(1).Div(v.coins[originName].Relationships[coinName].Ask)
 					}
-					if coins[originName].Relationships[coinName].Bid != decimal.NewFromFloat(0) {
-						bid = decimal.NewFromFloat(1).Div(coins[originName].Relationships[coinName].Bid)
+					if v.coins[originName].Relationships[coinName].Bid != decimal.NewFromFloat(0) {
+						bid = decimal.NewFromFloat(1).Div(v.coins[originName].Relationships[coinName].Bid)
 					}
-					if coins[originName].Relationships[coinName].Last != decimal.NewFromFloat(0) {
-						last = decimal.NewFromFloat(1).Div(coins[originName].Relationships[coinName].Last)
+					if v.coins[originName].Relationships[coinName].Last != decimal.NewFromFloat(0) {
+						last = decimal.NewFromFloat(1).Div(v.coins[originName].Relationships[coinName].Last)
 					}
 					coinValue.Relationships[originName] = Relationship{
 
-						Ask:  ask,
-						Bid:  bid,
-						Last: last,
+						Ask:       ask,
+						Bid:       bid,
+						Last:      last,
+						Timestamp: v.coins[originName].Relationships[coinName].Timestamp,
+						Received:  v.coins[originName].Relationships[coinName].Received,
 					}
 				}
 			}
@@ -198,11 +300,10 @@ func populateCoins() {
 	}
 }
 
-func createSummaries(bittrexClient *bittrex.Bittrex) {
-
-	err := acctBalance.updateAccountBalances(bittrexClient)
+func (v *marketView) createSummaries(exchange Exchange) {
+	err := acctBalance.updateAccountBalances(exchange)
 	if err != nil {
-		fmt.Println(err)
+		logger.error("could not update balances", field("err", err))
 		return
 	} else {
 		for originName := range validOrigins[exchangeName] {
@@ -213,37 +314,17 @@ func createSummaries(bittrexClient *bittrex.Bittrex) {
 				originStake = availableOrigin
 			}
 			if accHasOrigin {
-				summaries[originName] = make(map[string][]summary)
+				v.summaries[originName] = make(map[string][]summary)
 				for otherOriginName := range validOrigins[exchangeName] {
-					if originName != otherOriginName && originName != "USDT" {
-						summaries[originName][otherOriginName] = make([]summary, 0)
-						directAsk, _, _, _ := convert(originName, otherOriginName, originStake)
+					if originName != otherOriginName && originName != valuationCurrency {
+						v.summaries[originName][otherOriginName] = make([]summary, 0)
+						directAsk, _, _, _ := v.convert(originName, otherOriginName, originStake)
 						//	fmt.Printf("Direct Ask %v -> %v : %v\n", marketName, otherMarketName, directAsk)
-						for coinName := range coins {
-							marketToCoinAsk, _, _, marketToCoinConvertable := convert(originName, coinName, originStake)
-							_, coinToOtherBid, _, coinToOtherConvertable := convert(coinName, otherOriginName, marketToCoinAsk)
-
-							_, finalMarketIsValid := validMarkets[exchangeName][otherOriginName+"-"+originName]
-							finalVal := decimal.NewFromFloat(0)
-							otherToMarketConvertable := false
-							if finalMarketIsValid {
-								finalVal, _, _, otherToMarketConvertable = convert(otherOriginName, originName, coinToOtherBid)
-							} else {
-								_, finalVal, _, otherToMarketConvertable = convert(otherOriginName, originName, coinToOtherBid)
+						for coinName := range v.coins {
+							routeValue, isRoute := v.evaluateRoute(originName, coinName, otherOriginName, originStake, directAsk)
+							if isRoute {
+								v.summaries[originName][otherOriginName] = append(v.summaries[originName][otherOriginName], routeValue)
 							}
-
-							if marketToCoinConvertable && coinToOtherConvertable && otherToMarketConvertable && finalVal.GreaterThan(decimal.NewFromFloat(0)) {
-								summaries[originName][otherOriginName] = append(summaries[originName][otherOriginName], summary{
-									Quantity:   originStake,
-									InputCoin:  originName,
-									OutputCoin: otherOriginName,
-									Vessel:     coinName,
-									Direct:     directAsk,
-									Indirect:   finalVal,
-									Gain:       finalVal.Add(originStake.Neg()),
-								})
-							}
-
 						}
 					}
 				}
@@ -252,24 +333,70 @@ func createSummaries(bittrexClient *bittrex.Bittrex) {
 	}
 }
 
-func sortSummaries() {
+// evaluateRoute prices origin -> vessel -> otherOrigin -> origin for stake,
+// trading each leg the way transfer would. Routes with a leg the market's
+// limits reject or a stale quote are left out and the reason kept in the
+// view's rejections.
+func (v *marketView) evaluateRoute(originName string, coinName string, otherOriginName string, originStake decimal.Decimal, directAsk decimal.Decimal) (summary, bool) {
+	route := []string{originName, coinName, otherOriginName, originName}
+	routeName := strings.Join(route, " -> ")
+	delete(v.rejections, routeName)
+	finalVal := originStake
+	var rejection error
+	for index := 0; index < len(route)-1; index++ {
+		output, convertible, err := v.quoteTrade(route[index], route[index+1], finalVal)
+		if !convertible {
+			return summary{}, false
+		}
+		if err != nil && rejection == nil {
+			rejection = err
+		}
+		finalVal = output
+	}
+	if rejection == nil {
+		rejection = v.routeFreshness(route)
+	}
+	if rejection != nil {
+		v.rejections[routeName] = rejection.Error()
+		return summary{}, false
+	}
+
+	if finalVal.GreaterThan(decimal.NewFromFloat(0)) {
+		return summary{
+			Quantity:   originStake,
+			InputCoin:  originName,
+			OutputCoin: otherOriginName,
+			Vessel:     coinName,
+			Direct:     directAsk,
+			Indirect:   finalVal,
+			Gain:       finalVal.Add(originStake.Neg()),
+		}, true
+	}
+	return summary{}, false
+}
+
+func summaryRouteName(summaryValue summary) string {
+	return strings.Join([]string{summaryValue.InputCoin, summaryValue.Vessel, summaryValue.OutputCoin, summaryValue.InputCoin}, " -> ")
+}
+
+func (v *marketView) sortSummaries() {
 	for originName := range validOrigins[exchangeName] {
 		for otherOriginName := range validOrigins[exchangeName] {
-			sort.Slice(summaries[originName][otherOriginName], func(aIndex, bIndex int) bool {
-				a := summaries[originName][otherOriginName][aIndex]
-				b := summaries[originName][otherOriginName][bIndex]
+			sort.Slice(v.summaries[originName][otherOriginName], func(aIndex, bIndex int) bool {
+				a := v.summaries[originName][otherOriginName][aIndex]
+				b := v.summaries[originName][otherOriginName][bIndex]
 				return (b.Gain).GreaterThan(a.Gain)
 			})
 		}
 	}
 }
 
-func orderedByGains() []string {
+func (v *marketView) orderedByGains() []string {
 	output := make([]string, 0)
 
 	for originName := range validOrigins[exchangeName] {
 		for otherOriginName := range validOrigins[exchangeName] {
-			if originName != otherOriginName && originName != "USDT" {
+			if originName != otherOriginName && originName != valuationCurrency {
 				output = append(output, originName+"-"+otherOriginName)
 			}
 		}
@@ -278,165 +405,301 @@ func orderedByGains() []string {
 	sort.Slice(output, func(aIndex, bIndex int) bool {
 		aSplit := strings.Split(output[aIndex], "-")
 		bSplit := strings.Split(output[bIndex], "-")
-		a := summaries[aSplit[0]][aSplit[1]]
-		b := summaries[bSplit[0]][bSplit[1]]
-		_, _, aLast, _ := convert(aSplit[0], "USDT", a[len(a)-1].Gain)
-		_, _, bLast, _ := convert(bSplit[0], "USDT", b[len(b)-1].Gain)
+		a := v.summaries[aSplit[0]][aSplit[1]]
+		b := v.summaries[bSplit[0]][bSplit[1]]
+		if len(a) == 0 || len(b) == 0 {
+			return len(a) < len(b)
+		}
+		aLast, _ := v.valueIn(aSplit[0], valuationCurrency, a[len(a)-1].Gain)
+		bLast, _ := v.valueIn(bSplit[0], valuationCurrency, b[len(b)-1].Gain)
 		return (bLast).GreaterThan(aLast)
 	})
 	return output
 }
 
-func printSummaries() {
-	for _, marketRelationship := range orderedByGains() {
+func (v *marketView) printSummaries() {
+	for _, marketRelationship := range v.orderedByGains() {
 		marketRelationSplit := strings.Split(marketRelationship, "-")
 		originName := marketRelationSplit[0]
 		otherOriginName := marketRelationSplit[1]
-		if originName != otherOriginName && originName != "USDT" {
+		if originName != otherOriginName && originName != valuationCurrency {
 			//				directAsk, _, _, _ := convert(marketName, otherMarketName, decimal.NewFromFloat(1))
-			fmt.Printf("Origin : %v at %v \n", originName, validOrigins[exchangeName][originName])
-			for _, summaryValue := range summaries[originName][otherOriginName] {
-				_, _, last, _ := convert(originName, "USDT", summaryValue.Gain)
-				fmt.Printf("\tIndirect %v -> %v -> %v -> %v : %v\n\t\tGain : %v\n\t\tIn USDT : %v\n", originName, summaryValue.Vessel, otherOriginName, originName, summaryValue.Indirect, summaryValue.Gain, last)
+			originLogger := logger.with(field("origin", originName), field("stake", validOrigins[exchangeName][originName]), field("output", otherOriginName))
+			for _, summaryValue := range v.summaries[originName][otherOriginName] {
+				fields := []logField{
+					field("route", summaryRouteName(summaryValue)),
+					field("vessel", summaryValue.Vessel),
+					field("indirect", summaryValue.Indirect),
+					field("gain", summaryValue.Gain),
+				}
+				if last, valued := v.valueIn(originName, valuationCurrency, summaryValue.Gain); valued {
+					fields = append(fields, field("gainUsdt", last))
+				}
+				if summaryValue.DepthEvaluated {
+					fields = append(fields, field("depthIndirect", summaryValue.DepthIndirect), field("depthGain", summaryValue.DepthGain))
+				}
+				originLogger.info("route", fields...)
 			}
 		}
 
 	}
+	v.printRejections()
 }
 
-func makeBestTrade(offset int, bittrexClient *bittrex.Bittrex) {
-	ordered := orderedByGains()
+// printRejections lists why routes were left out, one line each with --details.
+func (v *marketView) printRejections() {
+	logger.info("rejected routes", field("count", len(v.rejections)))
+	if !details {
+		return
+	}
+	routeNames := make([]string, 0, len(v.rejections))
+	for routeName := range v.rejections {
+		routeNames = append(routeNames, routeName)
+	}
+	sort.Strings(routeNames)
+	for _, routeName := range routeNames {
+		logger.info("rejected route", field("route", routeName), field("reason", v.rejections[routeName]))
+	}
+}
+
+func (v *marketView) makeBestTrade(offset int, exchange Exchange) {
+	ordered := v.orderedByGains()
+	if len(ordered) <= offset {
+		return
+	}
 	bestMarketRelationship := ordered[len(ordered)-(1+offset)]
 	marketRelationSplit := strings.Split(bestMarketRelationship, "-")
 	originName := marketRelationSplit[0]
 	otherOriginName := marketRelationSplit[1]
-	if originName != otherOriginName {
-		summaryValue := summaries[originName][otherOriginName][len(summaries[originName][otherOriginName])-1]
-		fmt.Printf("%v\n", summaryValue)
-		if live {
+	if originName != otherOriginName && len(v.summaries[originName][otherOriginName]) > 0 {
+		summaryValue := v.summaries[originName][otherOriginName][len(v.summaries[originName][otherOriginName])-1]
+		logger.info("best route", field("route", summaryRouteName(summaryValue)), field("indirect", summaryValue.Indirect), field("gain", summaryValue.Gain))
+		expectedGain := summaryValue.Gain
+		if summaryValue.DepthEvaluated {
+			expectedGain = summaryValue.DepthGain
+		}
+		if live && expectedGain.GreaterThan(minimumGain) {
 
-			//executeIndirectRoute(originName, summaryValue.Vessel, otherOriginName, bittrexClient)
-			executeIndirectRoute("BTC", "ADA", "ETH", bittrexClient) //TODO put me back
+			v.executeIndirectRoute(originName, summaryValue.Vessel, otherOriginName, expectedGain, exchange)
 
 		}
 	}
 }
 
-func executeIndirectRoute(origin string, vessel string, outputOrigin string, bittrexClient *bittrex.Bittrex) {
+func (v *marketView) executeIndirectRoute(origin string, vessel string, outputOrigin string, expectedGain decimal.Decimal, exchange Exchange) {
+	if !routeGate.enter() {
+		return
+	}
+	defer routeGate.leave()
 	if live {
-		var rate decimal.Decimal
-		relationship, relationshipExists := coins[vessel].Relationships[origin]
+		coin, coinExists := v.coins[vessel]
+		if !coinExists {
+			logger.warn("vessel not in market view", field("vessel", vessel))
+			return
+		}
+		_, relationshipExists := coin.Relationships[origin]
 		if relationshipExists {
-			_, inputValidOrigin := validOrigins[exchangeName][origin]
-			_, outputValidOrigin := validOrigins[exchangeName][vessel]
-			_, isValidBuyMarket := validMarkets[exchangeName][origin+"-"+vessel]
-			if !relationshipExists || (inputValidOrigin && outputValidOrigin && !isValidBuyMarket) {
-				rate = decimal.NewFromFloat(1).Div(relationship.Bid)
-			} else {
-				rate = relationship.Ask
-			}
 			originLimit, isValid := validOrigins[exchangeName][origin]
 			if isValid {
-				quantity := originLimit.Div(rate)
-				fmt.Printf("Do live trade\n")
-				round1 := transfer(origin, vessel, quantity, bittrexClient)
-				fmt.Printf("end : %v\n", round1)
-				round2 := transfer(vessel, outputOrigin, round1, bittrexClient)
-				fmt.Printf("end : %v\n", round2)
-				round3 := transfer(outputOrigin, origin, round2, bittrexClient)
-				fmt.Printf("end : %v\n", round3)
+				stake := originLimit
+				availableOrigin, _ := acctBalance.get(origin)
+				if stake.GreaterThan(availableOrigin) {
+					stake = availableOrigin
+				}
+				routeId := newRouteId()
+				path := []string{origin, vessel, outputOrigin}
+				err := exchangeHealthy(exchange)
+				if err == nil {
+					// Quotes keep aging while the route waits for the trader.
+					err = v.routeFreshness([]string{origin, vessel, outputOrigin, origin})
+				}
+				var reservation *riskTrade
+				if err == nil {
+					reservation, err = risk.allowRoute(v, origin, stake)
+				}
+				if err != nil {
+					journal.decision(routeId, path, stake, expectedGain, err)
+					logger.warn("trade blocked", field("route", strings.Join([]string{origin, vessel, outputOrigin, origin}, " -> ")), field("err", err))
+					return
+				}
+				logger.info("executing route", field("route", strings.Join([]string{origin, vessel, outputOrigin, origin}, " -> ")), field("stake", stake))
+				journal.decision(routeId, path, stake, expectedGain, nil)
+				outcome := v.executeRoute(routeId, path, stake, exchange)
+				if !outcome.placedOrder() {
+					risk.release(reservation)
+				}
+				journal.outcome(v, routeId, stake, outcome)
+				// Interrupted routes are booked once reconcile settles them.
+				if !outcome.Interrupted {
+					risk.recordOutcome(v, origin, stake, outcome)
+					dashboard.recordRoute(path, stake, outcome)
+				}
+				if recorder, isRecorder := exchange.(routeRecorder); isRecorder {
+					recorder.recordRoute(origin, vessel, outputOrigin, stake, outcome.Result)
+				}
 			}
 		}
 	}
 }
 
-func printOrder2(order2 bittrex.Order2) {
-	fmt.Printf("AccountId: %v\nOrderUuid: %v\nExchange: %v\nType: %v\nQuantity: %v\nQuantityRemaining: %v\nLimit: %v\nReserved: %v\nReserveRemaining: %v\nCommissionReserve: %v\nCommissionReserveRemaining: %v\nCommissionPaid: %v\nPrice: %v\nPricePerUnit: %v \nOpened: %v\nClosed: %v\nIsOpen: %v\nSentinel: %v\nCancelInitiated: %v\nImmideateOrCancel: %v\nIsConditional: %v\nCondition: %v\nConditionTarget: %v\n", order2.AccountId, order2.OrderUuid, order2.Exchange, order2.Type, order2.Quantity, order2.QuantityRemaining, order2.Limit, order2.Reserved, order2.ReserveRemaining, order2.CommissionReserved, order2.CommissionReserveRemaining, order2.CommissionPaid, order2.Price, order2.PricePerUnit, order2.Opened, order2.Closed, order2.IsOpen, order2.Sentinel, order2.CancelInitiated, order2.ImmediateOrCancel, order2.IsConditional, order2.Condition, order2.ConditionTarget)
+// orderProceeds is how much of the output coin an order actually delivered.
+func orderProceeds(order bittrex.Order2, limitType string) decimal.Decimal {
+	if limitType == "buy" {
+		return order.Quantity.Sub(order.QuantityRemaining)
+	}
+	return order.Price.Sub(order.CommissionPaid)
+}
+
+// orderCost is how much of the input coin an order actually consumed.
+func orderCost(order bittrex.Order2, limitType string) decimal.Decimal {
+	if limitType == "buy" {
+		return order.Price.Add(order.CommissionPaid)
+	}
+	return order.Quantity.Sub(order.QuantityRemaining)
+}
+
+func orderFields(order2 bittrex.Order2) []logField {
+	return []logField{
+		field("orderId", order2.OrderUuid),
+		field("market", order2.Exchange),
+		field("type", order2.Type),
+		field("quantity", order2.Quantity),
+		field("quantityRemaining", order2.QuantityRemaining),
+		field("limit", order2.Limit),
+		field("price", order2.Price),
+		field("pricePerUnit", order2.PricePerUnit),
+		field("commissionPaid", order2.CommissionPaid),
+		field("opened", order2.Opened),
+		field("closed", order2.Closed),
+		field("isOpen", order2.IsOpen),
+		field("cancelInitiated", order2.CancelInitiated),
+	}
 }
 
 /* ************************************************************************************************
  * Trading
  * ***********************************************************************************************/
 
-func transfer(inputCoinName string, outputCoinName string, quantity decimal.Decimal, bittrexClient *bittrex.Bittrex) decimal.Decimal {
-	var limitType string
-	var market string
-	var rate decimal.Decimal
-	var output decimal.Decimal
-	relationship, relationshipExists := coins[outputCoinName].Relationships[inputCoinName]
-
-	_, inputValidOrigin := validOrigins[exchangeName][inputCoinName]
-	_, outputValidOrigin := validOrigins[exchangeName][outputCoinName]
-	_, isValidBuyMarket := validMarkets[exchangeName][inputCoinName+"-"+outputCoinName]
-
-	if !relationshipExists || (inputValidOrigin && outputValidOrigin && !isValidBuyMarket) {
-		market = outputCoinName + "-" + inputCoinName
-		limitType = "sell"
-		relationship := coins[inputCoinName].Relationships[outputCoinName]
-		rate = decimal.NewFromFloat(1).Div(relationship.Bid)
-	} else {
+// legFill is what a single transfer actually did to the account.
+type legFill struct {
+	Market   string
+	OrderId  string
+	Spent    decimal.Decimal
+	Received decimal.Decimal
+	Complete bool
+}
 
-		market = inputCoinName + "-" + outputCoinName
-		limitType = "buy"
-		rate = relationship.Ask
+// transfer trades quantity of the input coin for the output coin. slippage
+// moves the limit rate against us so the order crosses the book, 0 trades at
+// the quoted Ask/Bid. Orders are journaled under routeId.
+func (v *marketView) transfer(routeId string, inputCoinName string, outputCoinName string, quantity decimal.Decimal, slippage decimal.Decimal, exchange Exchange) (legFill, error) {
+	plan, err := v.planOrder(inputCoinName, outputCoinName, quantity, slippage)
+	fill := legFill{Market: plan.Market}
+	if err != nil {
+		return fill, err
 	}
+	market, limitType, orderQuantity, rate := plan.Market, plan.LimitType, plan.Quantity, plan.Rate
 
 	//but limit
 	if live {
-		fmt.Printf("Putting in Order\n")
-		var orderId string = ""
-		var err error = nil
-
-		fmt.Printf("market : %v\nquantity : %v\nrate : %v\n", market, quantity, rate)
-		if limitType == "buy" {
-			//orderId, err = bittrexClient.BuyLimit(market, quantity, rate)
-		} else {
-			//orderId, err = bittrexClient.SellLimit(market, quantity, rate)
+		if err := risk.allowOrder(); err != nil {
+			return fill, err
+		}
+		logger.info("placing order", field("market", market), field("type", limitType), field("quantity", orderQuantity), field("rate", rate))
+		tracked := orderTracker.place(exchange, routeId, market, limitType, orderQuantity, rate)
+		fill.OrderId = tracked.OrderId
+		if tracked.State == orderFailed {
+			return fill, tracked.Err
 		}
+		fill.Spent = orderCost(tracked.Order, limitType)
+		fill.Received = orderProceeds(tracked.Order, limitType)
+		fill.Complete = tracked.State == orderFilled
+		if tracked.isOpen() {
+			return fill, fmt.Errorf("order %v is still open : %v", tracked.OrderId, tracked.Err)
+		}
+	} else {
+		fill.Spent = plan.Spent
+		fill.Received = plan.Received
+		fill.Complete = true
+	}
+	logger.info("leg", field("leg", inputCoinName+" -> "+outputCoinName), field("market", market), field("type", limitType), field("orderId", fill.OrderId), field("spent", fill.Spent), field("received", fill.Received), field("rate", rate), field("complete", fill.Complete))
+	return fill, nil
+}
 
-		fmt.Printf("orderId : " + orderId)
-		if err == nil && orderId != "" {
-			var order bittrex.Order2
-			var err2 error = nil
-			count := 0
-			isOpen := true
-			for count < 3 && isOpen {
-				order, err2 = bittrexClient.GetOrder(orderId)
-				if err2 == nil {
-					printOrder2(order)
-				} else {
-					fmt.Println(err2)
-				}
-				count = count + 1
-				if !isOpen {
-					output = order.Quantity
-				}
-				if count != 2 {
-					time.Sleep(time.Duration(5) * time.Second)
-				}
+// plannedOrder is the limit order transfer places for a leg, rounded to the
+// market's precision.
+type plannedOrder struct {
+	Market    string
+	LimitType string
+	// Quantity is in the market currency
+	Quantity decimal.Decimal
+	Rate     decimal.Decimal
+	// Spent is in the input coin and includes the commission on buys
+	Spent    decimal.Decimal
+	Received decimal.Decimal
+}
 
-			}
-			if isOpen {
-				fmt.Println("Could not make trade. Canceling order")
-				output = order.Quantity.Add(order.QuantityRemaining.Neg())
-				err3 := bittrexClient.CancelOrder(orderId)
-				if err3 == nil {
-					fmt.Printf("Order %v Canceled Successfully\n", orderId)
-				} else {
-					fmt.Printf("Could not cancel order %v\n", orderId)
-				}
-			} else {
-				output = order.Quantity
-			}
+// planOrder sizes the order that trades quantity of the input coin for the
+// output coin. slippage moves the limit rate against us so the order crosses
+// the book. The plan is filled in even when the market's limits reject it.
+func (v *marketView) planOrder(inputCoinName string, outputCoinName string, quantity decimal.Decimal, slippage decimal.Decimal) (plannedOrder, error) {
+	market, limitType, quote := v.tradeSide(inputCoinName, outputCoinName)
+	rate := quote.Mul(decimal.NewFromFloat(1).Add(slippage))
+	if limitType == "sell" {
+		rate = quote.Mul(decimal.NewFromFloat(1).Sub(slippage))
+	}
+	plan := plannedOrder{Market: market, LimitType: limitType}
+	if !rate.GreaterThan(decimal.Zero) {
+		return plan, fmt.Errorf("no %v rate for %v", limitType, market)
+	}
 
-		} else {
-			fmt.Println(err)
-			//panic("Error") //TODO put me back in
-		}
+	limit := marketLimits.get(market)
+	plan.Rate = limit.roundRate(rate, limitType)
+	// quantity is always in the input coin, buy orders are sized in the output
+	// coin. Funds are held at the limit rate but the order fills at the quote.
+	if limitType == "buy" {
+		plan.Quantity = limit.roundQuantity(afterBuyFee(market, quantity).Div(plan.Rate))
+		price := plan.Quantity.Mul(quote)
+		plan.Spent = price.Add(price.Mul(fees.taker(market)))
+		plan.Received = plan.Quantity
+	} else {
+		plan.Quantity = limit.roundQuantity(quantity)
+		plan.Spent = plan.Quantity
+		plan.Received = afterSellFee(market, plan.Quantity.Mul(quote))
 	}
-	output = quantity //TODO take me out
-	fmt.Printf("%v : \n\tin: %v \n\tout: %v \n\ttype: %v \n\tquantity: %v \n\trate: %v\n", market, inputCoinName, outputCoinName, limitType, output, rate)
-	return output
+	return plan, limit.check(market, plan.Quantity)
+}
+
+// tradeSide picks the market transfer trades the input coin for the output
+// coin on, and whether that is a buy at its Ask or a sell at its Bid.
+func (v *marketView) tradeSide(inputCoinName string, outputCoinName string) (string, string, decimal.Decimal) {
+	relationship, relationshipExists := v.coins[outputCoinName].Relationships[inputCoinName]
+
+	_, inputValidOrigin := validOrigins[exchangeName][inputCoinName]
+	_, outputValidOrigin := validOrigins[exchangeName][outputCoinName]
+	_, isValidBuyMarket := validMarkets[exchangeName][inputCoinName+"-"+outputCoinName]
+
+	if !relationshipExists || (inputValidOrigin && outputValidOrigin && !isValidBuyMarket) {
+		return outputCoinName + "-" + inputCoinName, "sell", v.coins[inputCoinName].Relationships[outputCoinName].Bid
+	}
+	return inputCoinName + "-" + outputCoinName, "buy", relationship.Ask
+}
+
+// quoteTrade is how much of the output coin transfer expects quantity of the
+// input coin to deliver at the quoted price after the market's fee. It
+// reports false when the coins cannot be traded at all and an error when the
+// order would break the market's limits.
+func (v *marketView) quoteTrade(inputCoinName string, outputCoinName string, quantity decimal.Decimal) (decimal.Decimal, bool, error) {
+	_, inputExists := v.coins[inputCoinName]
+	_, outputExists := v.coins[outputCoinName]
+	if !inputExists || !outputExists {
+		return decimal.Zero, false, nil
+	}
+	if _, _, rate := v.tradeSide(inputCoinName, outputCoinName); !rate.GreaterThan(decimal.Zero) {
+		return decimal.Zero, false, nil
+	}
+	plan, err := v.planOrder(inputCoinName, outputCoinName, quantity, decimal.Zero)
+	return plan.Received, true, err
 }
 
 /* ****************************************************************************************
@@ -479,8 +742,13 @@ func printCoinSummary(childCoinName string) {
 
 func (b *balances) printBalances() {
 	b.lock.RLock()
+	currencies := make([]string, 0, len(b.balances))
 	for bal := range b.balances {
-		fmt.Println(bal + " - " + b.balances[bal].String())
+		currencies = append(currencies, bal)
+	}
+	sort.Strings(currencies)
+	for _, bal := range currencies {
+		logger.info("balance", field("currency", bal), field("available", b.balances[bal]))
 	}
 	b.lock.RUnlock()
 }
@@ -502,36 +770,36 @@ func contains(slice []string, value string) bool {
 }
 
 func isValidRelationship(exchangeName, relationshipName string) bool {
-	output := false
-
-	switch exchangeName {
-	case "Bittrex":
-		_, isValid := validOrigins[exchangeName][relationshipName]
-		output = isValid
-	default:
-		fmt.Printf("%v is not a supported exchange. Cannot validate relationship: %v\n", exchangeName, relationshipName)
+	origins, isSupported := validOrigins[exchangeName]
+	if !isSupported {
+		logger.warn("unsupported exchange, cannot validate relationship", field("exchange", exchangeName), field("relationship", relationshipName))
+		return false
 	}
-
-	return output
+	_, isValid := origins[relationshipName]
+	return isValid
 }
 
-func convert(inputName string, outputName string, inputQuantity decimal.Decimal) (decimal.Decimal, decimal.Decimal, decimal.Decimal, bool) {
+func (v *marketView) convert(inputName string, outputName string, inputQuantity decimal.Decimal) (decimal.Decimal, decimal.Decimal, decimal.Decimal, bool) {
 	outputAsk := decimal.NewFromFloat(0)
 	outputBid := decimal.NewFromFloat(0)
 	outputLast := decimal.NewFromFloat(0)
 	outputConvertible := true
-	_, coinHasRelationship := coins[inputName].Relationships[outputName]
-	_, coinHasRelationshipReverse := coins[outputName].Relationships[inputName]
+	inputCoin, outputCoin := v.coins[inputName], v.coins[outputName]
+	if inputCoin == nil || outputCoin == nil {
+		return outputAsk, outputBid, outputLast, false
+	}
+	_, coinHasRelationship := inputCoin.Relationships[outputName]
+	_, coinHasRelationshipReverse := outputCoin.Relationships[inputName]
 	if coinHasRelationship {
-		withTransaction := applyTransactionFee(inputQuantity)
-		outputAsk = withTransaction.Mul(coins[inputName].Relationships[outputName].Ask)
-		outputBid = withTransaction.Mul(coins[inputName].Relationships[outputName].Bid)
-		outputLast = withTransaction.Mul(coins[inputName].Relationships[outputName].Last)
+		withTransaction := v.afterTradeFee(inputName, outputName, inputQuantity)
+		outputAsk = withTransaction.Mul(v.coins[inputName].Relationships[outputName].Ask)
+		outputBid = withTransaction.Mul(v.coins[inputName].Relationships[outputName].Bid)
+		outputLast = withTransaction.Mul(v.coins[inputName].Relationships[outputName].Last)
 	} else if coinHasRelationshipReverse {
-		withTransaction := applyTransactionFee(inputQuantity)
-		outputAsk = withTransaction.Mul(decimal.NewFromFloat(1).Div(coins[outputName].Relationships[inputName].Ask))
-		outputBid = withTransaction.Mul(decimal.NewFromFloat(1).Div(coins[outputName].Relationships[inputName].Bid))
-		outputLast = withTransaction.Mul(decimal.NewFromFloat(1).Div(coins[outputName].Relationships[inputName].Last))
+		withTransaction := v.afterTradeFee(inputName, outputName, inputQuantity)
+		outputAsk = withTransaction.Mul(decimal.NewFromFloat(1).Div(v.coins[outputName].Relationships[inputName].Ask))
+		outputBid = withTransaction.Mul(decimal.NewFromFloat(1).Div(v.coins[outputName].Relationships[inputName].Bid))
+		outputLast = withTransaction.Mul(decimal.NewFromFloat(1).Div(v.coins[outputName].Relationships[inputName].Last))
 	} else {
 		outputConvertible = false
 	}
@@ -541,66 +809,3 @@ func convert(inputName string, outputName string, inputQuantity decimal.Decimal)
 func getMarketName(pre, post string) string {
 	return pre + "-" + post
 }
-
-func applyTransactionFee(input decimal.Decimal) decimal.Decimal {
-	return input.Add(input.Mul(transactionFee).Neg())
-}
-
-func main() {
-	summaries = make(map[string]map[string][]summary)
-	bittrexThreshold := time.Duration(440) * time.Second
-	fmt.Printf("chaingang running\n")
-
-	bittrexKey := os.Getenv("BITTREXKEY")
-	bittrexSecret := os.Getenv("BITTREXSECRET")
-
-	//flag.Parse()
-
-	for i := 1; i < len(os.Args); i += 2 {
-		switch os.Args[i] {
-		case "-b":
-			if bittrexKey == "" {
-				bittrexKey = os.Args[i+1]
-			}
-		case "-s":
-			if bittrexSecret == "" {
-				bittrexSecret = os.Args[i+1]
-			}
-		case "-l":
-			live = true
-		case "--details":
-			details = true
-		default:
-			panic("unrecognized argument")
-		}
-	}
-
-	fmt.Printf("\tbittrexKey: %v\n", bittrexKey)
-	fmt.Printf("\tbittrexSecret: %v\n", bittrexSecret)
-
-	if bittrexKey != "" && bittrexSecret != "" {
-		bittrexClient = bittrex.New(bittrexKey, bittrexSecret)
-
-		for {
-			marketSummaries, err := updateMarketSummaries(bittrexClient)
-			go func() {
-				createCoins(marketSummaries)
-				populateCoins()
-				createSummaries(bittrexClient)
-				sortSummaries()
-				printSummaries()
-				makeBestTrade(0, bittrexClient)
-
-				acctBalance.printBalances()
-			}()
-			if err == nil {
-
-			} else {
-				fmt.Println(err)
-			}
-			time.Sleep(bittrexThreshold)
-		}
-	} else {
-		fmt.Println("please provide bittrex key and secret")
-	}
-}
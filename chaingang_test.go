@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// dec reads a decimal the tests write out as a string.
+func dec(value string) decimal.Decimal {
+	parsed, err := decimal.NewFromString(value)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func assertDecimal(t *testing.T, label string, got decimal.Decimal, want string) {
+	t.Helper()
+	if !got.Equal(dec(want)) {
+		t.Errorf("%v = %v, want %v", label, got, want)
+	}
+}
+
+// metricValue reads a metric's series for labels.
+func metricValue(family *metricFamily, labels ...string) float64 {
+	family.lock.Lock()
+	defer family.lock.Unlock()
+	return family.get(labels).value
+}
+
+// setupTest applies the default config and resets everything trading leaves
+// behind in the globals, with the logger quietened.
+func setupTest(t *testing.T) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.apply()
+	logger = newLogger(ioutil.Discard, levelError, logFormatLogfmt)
+	live = false
+	paperTrading = false
+	minimumGain = decimal.Zero
+	acctBalance = &balances{balances: make(map[string]decimal.Decimal)}
+	activeExchange = nil
+	marketLimits = newMarketCatalog()
+	orderTracker = newOrderManager()
+	journal = nil
+	dashboard = newDashboardState()
+	routeGate = &tradingGate{}
+	unwindPolicy = unwindMarket
+	orderPollInterval = 0
+	orderDeadline = 0
+}
+
+// testSummaries prices the default markets so that buying ETH with BTC,
+// selling it for USDT and buying BTC back gains about 1%.
+func testSummaries() []bittrex.MarketSummary {
+	return []bittrex.MarketSummary{
+		{MarketName: "BTC-ETH", Ask: dec("0.05"), Bid: dec("0.0499"), Last: dec("0.05")},
+		{MarketName: "USDT-ETH", Ask: dec("512"), Bid: dec("511"), Last: dec("511.5")},
+		{MarketName: "USDT-BTC", Ask: dec("10000"), Bid: dec("9990"), Last: dec("9995")},
+	}
+}
+
+// testSource replays summaries and order books as a single snapshot.
+func testSource(summaries []bittrex.MarketSummary, orderBooks map[string]bittrex.OrderBook) *replaySource {
+	source := &replaySource{snapshots: []marketSnapshot{{Summaries: summaries, OrderBooks: orderBooks}}}
+	source.next()
+	return source
+}
+
+func TestExecuteIndirectRouteMissingVessel(t *testing.T) {
+	setupTest(t)
+	live = true
+	view := newMarketView(testSummaries(), time.Now())
+	// Panics on a nil Coin if the vessel isn't checked first.
+	view.executeIndirectRoute("BTC", "XRP", "USDT", dec("0.001"), nil)
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Exit codes: usage errors are told apart from failures at runtime.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"scan", "print arbitrage opportunities every cycle without trading", runScan},
+	{"trade", "trade the best route every cycle, live or on paper", runTrade},
+	{"balances", "print the account balances and exit", runBalances},
+	{"record", "record market snapshots to disk for backtesting", runRecord},
+	{"backtest", "replay recorded snapshots through a paper exchange", runBacktest},
+	{"journal", "report realized P&L from the trade journal", runJournal},
+	{"spatial", "trade markets priced differently across exchanges", runSpatial},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage(os.Stderr)
+		os.Exit(exitUsage)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		printUsage(os.Stdout)
+		os.Exit(exitOK)
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	printUsage(os.Stderr)
+	os.Exit(exitUsage)
+}
+
+func printUsage(output io.Writer) {
+	fmt.Fprintf(output, "usage: chaingang <command> [flags]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(output, "  %-10v %v\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(output, "\nrun chaingang <command> --help for the flags of a command\n")
+}
+
+// newFlagSet creates the flags of a command, starting with the logging flags
+// every command shares.
+func newFlagSet(name string, usageLine string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.String("log-level", "info", "lowest level logged: debug, info, warn or error")
+	flags.String("log-format", logFormatLogfmt, "log as logfmt or json")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: chaingang %v %v\n\nflags:\n", name, usageLine)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseFlags returns false when the command should stop, along with the
+// exit code to stop with. --help is not an error.
+func parseFlags(flags *flag.FlagSet, args []string) (int, bool) {
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return exitOK, false
+	}
+	if err != nil {
+		return exitUsage, false
+	}
+	if err := configureLogging(flags); err != nil {
+		fmt.Fprintln(flags.Output(), err)
+		return exitUsage, false
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(flags.Output(), "unexpected arguments %v\n", flags.Args())
+		flags.Usage()
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+func configureLogging(flags *flag.FlagSet) error {
+	return logger.configure(flags.Lookup("log-level").Value.String(), flags.Lookup("log-format").Value.String())
+}
+
+/* ******************************************************************
+ * Shared Flags
+ * *****************************************************************/
+type connectionFlags struct {
+	configPath *string
+	key        *string
+	secret     *string
+	demo       *string
+	recordHTTP *string
+	replayHTTP *string
+}
+
+func addConnectionFlags(flags *flag.FlagSet) *connectionFlags {
+	return &connectionFlags{
+		configPath: flags.String("config", os.Getenv("CHAINGANG_CONFIG"), "config file with origins, stakes, markets and fees (env CHAINGANG_CONFIG)"),
+		key:        flags.String("key", os.Getenv("BITTREXKEY"), "exchange API key (env BITTREXKEY)"),
+		secret:     flags.String("secret", os.Getenv("BITTREXSECRET"), "exchange API secret (env BITTREXSECRET)"),
+		demo:       flags.String("demo", "", "trade against a local fake Bittrex set up by this script instead of the exchange"),
+		recordHTTP: flags.String("record-http", "", "append every exchange API call to this cassette, key and signatures scrubbed"),
+		replayHTTP: flags.String("replay-http", "", "answer exchange API calls from this cassette instead of the exchange"),
+	}
+}
+
+// connect loads the config and builds activeExchange from it.
+func (c *connectionFlags) connect() (config, error) {
+	cfg, err := loadConfig(*c.configPath)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.apply()
+
+	switch {
+	case *c.replayHTTP != "":
+		activeExchange, err = replayCassette(*c.replayHTTP)
+	case *c.demo != "":
+		// The fake serves until the process exits.
+		var server *fakeServer
+		if server, err = startDemo(*c.demo); err != nil {
+			return cfg, err
+		}
+		var transport http.RoundTripper
+		// The demo credentials are no secret, and scrubbing them would mangle
+		// any response that happens to contain the word.
+		if transport, err = c.transport(server.transport()); err != nil {
+			return cfg, err
+		}
+		activeExchange = newRestOnlyExchange(demoKey, demoSecret, transport)
+	default:
+		logger.redact(*c.key)
+		logger.redact(*c.secret)
+		logger.info("connecting", field("exchange", exchangeName), field("key", *c.key), field("mode", cfg.Mode))
+		if !c.authenticated() {
+			logger.info("no key and secret, only public market data is available")
+		}
+		var httpClient *http.Client
+		if *c.recordHTTP != "" {
+			transport, err := c.transport(http.DefaultTransport, *c.key, *c.secret)
+			if err != nil {
+				return cfg, err
+			}
+			httpClient = &http.Client{Transport: transport}
+		}
+		activeExchange, err = newExchange(cfg.backend(exchangeName), *c.key, *c.secret, httpClient)
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := loadMarketLimits(activeExchange, marketLimits); err != nil {
+		logger.warn("could not load market limits", field("err", err))
+	}
+	return cfg, nil
+}
+
+// authenticated says whether the exchange connect builds can reach the
+// account: balances and orders need a key and secret, market data doesn't.
+func (c *connectionFlags) authenticated() bool {
+	return *c.replayHTTP != "" || *c.demo != "" || (*c.key != "" && *c.secret != "")
+}
+
+// requireAuthenticated fails commands that read the account or place real
+// orders when connect had no key and secret.
+func (c *connectionFlags) requireAuthenticated() error {
+	if !c.authenticated() {
+		return errors.New("please provide bittrex key and secret")
+	}
+	return nil
+}
+
+// publicBalances sizes routes from the configured stakes when the account
+// can't be read, by trading on paper without placing anything.
+func (c *connectionFlags) publicBalances() {
+	if !c.authenticated() {
+		activeExchange = newPaperExchange(activeExchange, paperBalances(validOrigins[exchangeName]), true)
+	}
+}
+
+// transport records what passes through next when --record-http is set.
+// secrets are scrubbed from what is recorded.
+func (c *connectionFlags) transport(next http.RoundTripper, secrets ...string) (http.RoundTripper, error) {
+	if *c.recordHTTP == "" {
+		return next, nil
+	}
+	recorder, err := newCassetteRecorder(*c.recordHTTP, next, secrets...)
+	if err != nil {
+		return nil, err
+	}
+	logger.info("recording exchange traffic", field("cassette", *c.recordHTTP))
+	return recorder, nil
+}
+
+type pipelineFlags struct {
+	details *bool
+	depth   *int
+	stream  *int
+	cycles  *int
+	once    *bool
+}
+
+func addPipelineFlags(flags *flag.FlagSet) *pipelineFlags {
+	return &pipelineFlags{
+		details: flags.Bool("details", false, "print extra detail"),
+		depth:   flags.Int("depth", depthCandidates, "re-price this many of the best routes per origin pair against order books, 0 disables"),
+		stream:  flags.Int("stream", 0, "stream order books over the websocket for this many vessels per origin pair"),
+		cycles:  flags.Int("cycles", 0, "also search for profitable cycles of up to this many legs"),
+		once:    flags.Bool("once", false, "run a single cycle and exit"),
+	}
+}
+
+func addPaperDepthFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("paper-depth", true, "fill paper orders by walking the order book, false fills them whole at the Ask or Bid")
+}
+
+func addListenFlag(flags *flag.FlagSet) *string {
+	return flags.String("listen", "", "serve the dashboard and /metrics over HTTP on this address, such as :9100")
+}
+
+func listen(addr string) {
+	if addr != "" {
+		serveHTTP(addr)
+	}
+}
+
+func (p *pipelineFlags) apply() loopOptions {
+	details = *p.details
+	depthCandidates = *p.depth
+	maxCycleLength = *p.cycles
+	return loopOptions{
+		print:         true,
+		once:          *p.once,
+		streamVessels: *p.stream,
+	}
+}
+
+// tradingMode is the configured mode unless --paper or --live overrides it.
+func tradingMode(cfg config, paper bool, liveFlag bool) string {
+	if paper {
+		return modePaper
+	} else if liveFlag {
+		return modeLive
+	}
+	return cfg.Mode
+}
+
+func fail(err error) int {
+	logger.error(err.Error())
+	return exitError
+}
+
+/* ******************************************************************
+ * Commands
+ * *****************************************************************/
+func runScan(args []string) int {
+	flags := newFlagSet("scan", "[flags]")
+	connection := addConnectionFlags(flags)
+	pipeline := addPipelineFlags(flags)
+	addr := addListenFlag(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+
+	if _, err := connection.connect(); err != nil {
+		return fail(err)
+	}
+	connection.publicBalances()
+	live = false
+	paperTrading = false
+	listen(*addr)
+	runLoop(pipeline.apply())
+	return exitOK
+}
+
+func runTrade(args []string) int {
+	flags := newFlagSet("trade", "[flags]")
+	connection := addConnectionFlags(flags)
+	pipeline := addPipelineFlags(flags)
+	addr := addListenFlag(flags)
+	paper := flags.Bool("paper", false, "trade on a paper exchange with virtual balances")
+	liveFlag := flags.Bool("live", false, "place real orders")
+	paperDepth := addPaperDepthFlag(flags)
+	minGain := flags.Float64("min-gain", 0, "only trade routes whose expected gain is above this, in the origin coin")
+	unwind := flags.String("unwind", unwindPolicy, "what to do with leftovers when a leg fails: market, hold or retry")
+	orderTimeout := flags.Duration("order-timeout", orderDeadline, "cancel orders still open this long after being placed")
+	journalPath := flags.String("journal", "", "append every route traded to this journal file, defaults to the configured one")
+	grace := flags.Duration("shutdown-grace", shutdownGrace, "on SIGINT or SIGTERM, wait this long for routes in flight before canceling their orders")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if *paper && *liveFlag {
+		fmt.Fprintln(os.Stderr, "--paper and --live cannot be used together")
+		return exitUsage
+	}
+	if *unwind != unwindMarket && *unwind != unwindHold && *unwind != unwindRetry {
+		fmt.Fprintf(os.Stderr, "--unwind must be %v, %v or %v\n", unwindMarket, unwindHold, unwindRetry)
+		return exitUsage
+	}
+
+	cfg, err := connection.connect()
+	if err != nil {
+		return fail(err)
+	}
+	mode := tradingMode(cfg, *paper, *liveFlag)
+	if mode == modeDryRun {
+		return fail(errors.New("trade needs mode live or paper: pass --live or --paper, or set mode in the config"))
+	}
+	if mode == modeLive {
+		if err := connection.requireAuthenticated(); err != nil {
+			return fail(err)
+		}
+	}
+
+	minimumGain = decimal.NewFromFloat(*minGain)
+	unwindPolicy = *unwind
+	orderDeadline = *orderTimeout
+	shutdownGrace = *grace
+	live = true
+	paperTrading = mode == modePaper
+	if paperTrading {
+		activeExchange = newPaperExchange(activeExchange, paperBalances(validOrigins[exchangeName]), *paperDepth)
+	}
+	if *journalPath == "" {
+		*journalPath = cfg.Journal
+	}
+	if *journalPath != "" {
+		if journal, err = openJournal(*journalPath); err != nil {
+			return fail(err)
+		}
+		defer journal.Close()
+		if !paperTrading {
+			if err := reconcile(activeExchange, journal); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	risk.watch(activeExchange)
+	listen(*addr)
+	runLoop(pipeline.apply())
+	return exitOK
+}
+
+func runBalances(args []string) int {
+	flags := newFlagSet("balances", "[flags]")
+	connection := addConnectionFlags(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+
+	if _, err := connection.connect(); err != nil {
+		return fail(err)
+	}
+	if err := connection.requireAuthenticated(); err != nil {
+		return fail(err)
+	}
+	if err := acctBalance.updateAccountBalances(activeExchange); err != nil {
+		return fail(err)
+	}
+	acctBalance.printBalances()
+	return exitOK
+}
+
+func runRecord(args []string) int {
+	flags := newFlagSet("record", "--dir DIR [flags]")
+	connection := addConnectionFlags(flags)
+	dir := flags.String("dir", "", "directory to write snapshot files to")
+	books := flags.Int("books", 0, "also record order books for this many vessels per origin pair")
+	rotate := flags.Duration("rotate", recordRotateEvery, "start a new snapshot file this often")
+	keep := flags.Int("keep", recordMaxFiles, "keep at most this many snapshot files, 0 keeps all")
+	once := flags.Bool("once", false, "record a single snapshot and exit")
+	addr := addListenFlag(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "--dir is required")
+		flags.Usage()
+		return exitUsage
+	}
+
+	if _, err := connection.connect(); err != nil {
+		return fail(err)
+	}
+	connection.publicBalances()
+	live = false
+	paperTrading = false
+	recorder, err := newSnapshotRecorder(*dir, *rotate, *keep)
+	if err != nil {
+		return fail(err)
+	}
+	defer recorder.Close()
+	listen(*addr)
+	runLoop(loopOptions{
+		once:        *once,
+		recorder:    recorder,
+		recordBooks: *books,
+	})
+	return exitOK
+}
+
+/* ******************************************************************
+ * Polling Loop
+ * *****************************************************************/
+type loopOptions struct {
+	print         bool
+	once          bool
+	streamVessels int
+	recorder      *snapshotRecorder
+	recordBooks   int
+	// stop ends the loop like a signal, nil to stop on SIGINT or SIGTERM
+	stop chan os.Signal
+}
+
+// runLoop runs a cycle every pollInterval, or a single one with once, until
+// SIGINT or SIGTERM. The loop goroutine owns the current view: cycles are
+// built on their own goroutine, one at a time, and stream quotes replace the
+// view instead of changing it. Every trade is made by a single trader
+// goroutine from the view it was handed, so no market data is ever written
+// while it is read. The loop returns once the trader and any cycle still
+// being built have finished.
+func runLoop(options loopOptions) {
+	logger.info("chaingang running", field("pollInterval", pollInterval), field("live", live), field("paper", paperTrading))
+	var stream *orderBookStream
+	var quotes chan streamQuote
+	if options.streamVessels > 0 {
+		if streamer, isStreamer := streamerFor(activeExchange); isStreamer {
+			quotes = make(chan streamQuote, streamBufferSize)
+			stream = newOrderBookStream(streamer, func(market string, bid decimal.Decimal, ask decimal.Decimal) {
+				queueQuote(quotes, streamQuote{market: market, bid: bid, ask: ask})
+			})
+		} else {
+			logger.warn("exchange does not support streaming", field("exchange", exchangeName))
+		}
+	}
+	if stream != nil {
+		defer stream.close()
+	}
+
+	if options.once {
+		if view := runCycle(options, stream); view != nil && options.print {
+			tradeRequest{view: view}.trade()
+		}
+		return
+	}
+	stop := options.stop
+	if stop == nil {
+		stop = make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(stop)
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	requests := make(chan tradeRequest)
+	traded := make(chan struct{})
+	go func() {
+		trader(requests)
+		close(traded)
+	}()
+	defer func() {
+		close(requests)
+		<-traded
+	}()
+
+	var current *marketView
+	cycles := make(chan *marketView, 1)
+	building := false
+	startCycle := func() {
+		building = true
+		go func() {
+			cycles <- runCycle(options, stream)
+		}()
+	}
+	startCycle()
+	for {
+		select {
+		case <-ticker.C:
+			if building {
+				logger.warn("previous cycle still running, skipping this one")
+				continue
+			}
+			startCycle()
+		case view := <-cycles:
+			building = false
+			if view == nil {
+				continue
+			}
+			current = view
+			if options.print {
+				offerTrade(requests, tradeRequest{view: view})
+			}
+		case quote := <-quotes:
+			if current == nil {
+				continue
+			}
+			var opportunities []summary
+			current, opportunities = current.withQuote(quote.market, quote.bid, quote.ask)
+			for index := range opportunities {
+				best := opportunities[index]
+				logger.info("stream opportunity", field("market", quote.market), field("route", summaryRouteName(best)), field("gain", best.Gain))
+				if live {
+					offerTrade(requests, tradeRequest{view: current, route: &best})
+				}
+			}
+		case received := <-stop:
+			shutdown(received, activeExchange)
+			if building {
+				<-cycles
+			}
+			return
+		}
+	}
+}
+
+// runCycle fetches the market summaries and builds a view from them, nil
+// when they could not be fetched. Nothing else sees the view until it is
+// returned, apart from the copies published to the dashboard and recorder.
+func runCycle(options loopOptions, stream *orderBookStream) *marketView {
+	marketSummaries, err := updateMarketSummaries(activeExchange)
+	if err != nil {
+		logger.error("could not get market summaries", field("err", err))
+		return nil
+	}
+	received := time.Now().UTC()
+
+	v := newMarketView(marketSummaries, received)
+	v.createSummaries(activeExchange)
+	v.sortSummaries()
+	v.evaluateDepth(activeExchange)
+	v.recordCycleMetrics()
+	dashboard.publishSummaries(v)
+	if stream != nil {
+		stream.track(v.candidateMarkets(options.streamVessels))
+	}
+	if options.recorder != nil && len(marketSummaries) > 0 {
+		snapshot := marketSnapshot{
+			Time:      received,
+			Exchange:  exchangeName,
+			Summaries: marketSummaries,
+		}
+		if options.recordBooks > 0 {
+			snapshot.OrderBooks = v.candidateOrderBooks(activeExchange, options.recordBooks)
+		}
+		if err := options.recorder.record(snapshot); err != nil {
+			logger.error("could not record snapshot", field("err", err))
+		}
+	}
+	if options.print {
+		v.printSummaries()
+		if maxCycleLength >= 3 {
+			printCycles(v.findCycles(maxCycleLength), cyclesShown)
+		}
+	}
+	return v
+}
+
+/* ******************************************************************
+ * Trader
+ * *****************************************************************/
+
+// tradeRequest asks the trader for the best route of a cycle's view, or for
+// route when a stream quote found it.
+type tradeRequest struct {
+	view  *marketView
+	route *summary
+}
+
+func (r tradeRequest) trade() {
+	if r.route != nil {
+		r.view.executeIndirectRoute(r.route.InputCoin, r.route.Vessel, r.route.OutputCoin, r.route.Gain, activeExchange)
+		return
+	}
+	r.view.makeBestTrade(0, activeExchange)
+	acctBalance.printBalances()
+	if paper, isPaper := activeExchange.(*paperExchange); isPaper {
+		paper.printRoutes()
+	}
+}
+
+// trader makes every trade, one at a time, until requests is closed.
+func trader(requests <-chan tradeRequest) {
+	for request := range requests {
+		request.trade()
+	}
+}
+
+// offerTrade hands request to the trader, or drops it when a trade is
+// already being made: the next cycle or quote brings a fresher view.
+func offerTrade(requests chan<- tradeRequest, request tradeRequest) {
+	select {
+	case requests <- request:
+	default:
+		logger.debug("trader busy, dropping trade")
+	}
+}
+
+// queueQuote hands quote to the loop, or drops it when the loop is that far
+// behind: the stream calls back from its own goroutine and must not stall,
+// and the market's next quote replaces this one anyway.
+func queueQuote(quotes chan<- streamQuote, quote streamQuote) {
+	select {
+	case quotes <- quote:
+	default:
+		streamDroppedMetric.inc()
+	}
+}
+
+// streamerFor finds the streaming backend, looking through a paper exchange.
+func streamerFor(exchange Exchange) (exchangeStreamer, bool) {
+	if paper, isPaper := exchange.(*paperExchange); isPaper {
+		if source, isExchange := paper.source.(Exchange); isExchange {
+			exchange = source
+		}
+	}
+	streamer, isStreamer := exchange.(exchangeStreamer)
+	return streamer, isStreamer
+}
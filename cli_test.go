@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/toorop/go-bittrex"
+)
+
+func TestConnectionAuthenticated(t *testing.T) {
+	tests := []struct {
+		args          []string
+		authenticated bool
+	}{
+		{args: nil, authenticated: false},
+		{args: []string{"--key", "key"}, authenticated: false},
+		{args: []string{"--key", "key", "--secret", "secret"}, authenticated: true},
+		{args: []string{"--demo", "demo.example.json"}, authenticated: true},
+		{args: []string{"--replay-http", "run.cassette"}, authenticated: true},
+	}
+	for _, test := range tests {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		connection := addConnectionFlags(flags)
+		*connection.key, *connection.secret = "", ""
+		if err := flags.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		if authenticated := connection.authenticated(); authenticated != test.authenticated {
+			t.Errorf("%v: authenticated = %v, want %v", test.args, authenticated, test.authenticated)
+		}
+		if err := connection.requireAuthenticated(); (err == nil) != test.authenticated {
+			t.Errorf("%v: requireAuthenticated = %v", test.args, err)
+		}
+	}
+}
+
+// streamingExchange streams every market of testSummaries as its initial
+// state followed by deltas deep in the book, so each delta is a quote at the
+// same top of book. Once it has sent them all the subscription stays idle.
+type streamingExchange struct {
+	*stubExchange
+	deltas int
+	sent   int64
+}
+
+func (s *streamingExchange) SubscribeExchangeUpdate(market string, dataCh chan<- bittrex.ExchangeState, stop <-chan bool) error {
+	for _, marketSummary := range testSummaries() {
+		if marketSummary.MarketName != market {
+			continue
+		}
+		states := []bittrex.ExchangeState{{
+			Initial: true,
+			Buys:    []bittrex.OrderUpdate{{Orderb: bittrex.Orderb{Quantity: dec("10"), Rate: marketSummary.Bid}}},
+			Sells:   []bittrex.OrderUpdate{{Orderb: bittrex.Orderb{Quantity: dec("10"), Rate: marketSummary.Ask}}},
+		}}
+		deep := marketSummary.Bid.Mul(dec("0.5"))
+		for nounce := 1; nounce <= s.deltas; nounce++ {
+			states = append(states, bittrex.ExchangeState{
+				Nounce: nounce,
+				Buys:   []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "1", deep.String())},
+			})
+		}
+		for _, state := range states {
+			select {
+			case dataCh <- state:
+				atomic.AddInt64(&s.sent, 1)
+			case <-stop:
+				return nil
+			}
+		}
+	}
+	<-stop
+	return nil
+}
+
+// TestRunLoopTradesStreamQuotes runs the loop on a paper account while every
+// market streams quotes, each one a trade offered to the trader, and cycles
+// keep replacing the view. Run with -race.
+func TestRunLoopTradesStreamQuotes(t *testing.T) {
+	setupTest(t)
+	live = true
+	paperTrading = true
+	pollInterval = 5 * time.Millisecond
+	streaming := &streamingExchange{stubExchange: &stubExchange{}, deltas: 200}
+	paper := newPaperExchange(streaming, paperBalances(validOrigins[exchangeName]), false)
+	activeExchange = paper
+	if err := acctBalance.updateAccountBalances(paper); err != nil {
+		t.Fatal(err)
+	}
+
+	placed := metricValue(ordersMetric, "placed")
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	go func() {
+		runLoop(loopOptions{streamVessels: 1, stop: stop})
+		close(stopped)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for metricValue(ordersMetric, "placed") == placed && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stop <- syscall.SIGINT
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop did not stop")
+	}
+	if atomic.LoadInt64(&streaming.sent) == 0 {
+		t.Error("nothing streamed")
+	}
+	if len(paper.routes) == 0 {
+		t.Error("no route traded from the stream")
+	}
+}
+
+func TestQueueQuoteDropsWhenFull(t *testing.T) {
+	quotes := make(chan streamQuote, 1)
+	dropped := metricValue(streamDroppedMetric)
+	done := make(chan struct{})
+	go func() {
+		queueQuote(quotes, streamQuote{market: "BTC-ETH"})
+		queueQuote(quotes, streamQuote{market: "USDT-ETH"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queueQuote blocked on a full channel")
+	}
+	if quote := <-quotes; quote.market != "BTC-ETH" {
+		t.Errorf("queued %v, want BTC-ETH", quote.market)
+	}
+	if got := metricValue(streamDroppedMetric) - dropped; got != 1 {
+		t.Errorf("dropped %v quotes, want 1", got)
+	}
+}
+
+func TestOfferTradeNeverBlocks(t *testing.T) {
+	setupTest(t)
+	requests := make(chan tradeRequest)
+	var offered sync.WaitGroup
+	for index := 0; index < 50; index++ {
+		offered.Add(1)
+		go func() {
+			defer offered.Done()
+			offerTrade(requests, tradeRequest{})
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		offered.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("offerTrade blocked with no trader reading")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Trading modes. dry-run only prints opportunities.
+const (
+	modeDryRun = "dry-run"
+	modePaper  = "paper"
+	modeLive   = "live"
+)
+
+type exchangeConfig struct {
+	// Backend is the client the exchange is traded through, its name when empty.
+	Backend string `json:"backend"`
+	// Origins maps each origin currency to its maximum stake per route.
+	Origins map[string]decimal.Decimal `json:"origins"`
+	// Markets lists the direct markets between origins that can be bought on.
+	Markets []string `json:"markets"`
+	// Fee is a flat rate for every trade, Fees a full schedule that replaces it.
+	Fee  decimal.Decimal `json:"fee"`
+	Fees *feeConfig      `json:"fees"`
+}
+
+func (e exchangeConfig) feeSchedule() feeConfig {
+	if e.Fees != nil {
+		return *e.Fees
+	}
+	return feeConfig{Maker: e.Fee, Taker: e.Fee}
+}
+
+type config struct {
+	Exchange     string                    `json:"exchange"`
+	Exchanges    map[string]exchangeConfig `json:"exchanges"`
+	PollInterval string                    `json:"pollInterval"`
+	Mode         string                    `json:"mode"`
+	Risk         riskConfig                `json:"risk"`
+	// Journal is the file every traded route is appended to, empty disables it.
+	Journal string `json:"journal"`
+	// Spatial lists the exchanges the spatial command trades against each other.
+	Spatial []string `json:"spatial"`
+	// API limits and retries calls to the exchanges.
+	API apiConfig `json:"api"`
+	// Freshness keeps routes off quotes that are too old.
+	Freshness freshnessConfig `json:"freshness"`
+}
+
+// backend is the client the named exchange is traded through.
+func (c config) backend(name string) string {
+	if backend := c.Exchanges[name].Backend; backend != "" {
+		return backend
+	}
+	return name
+}
+
+// defaultConfig describes the settings chaingang ships with.
+func defaultConfig() config {
+	return config{
+		Exchange: "Bittrex",
+		Exchanges: map[string]exchangeConfig{
+			"Bittrex": {
+				Origins: map[string]decimal.Decimal{
+					"BTC":  decimal.NewFromFloat(0.0050),
+					"ETH":  decimal.NewFromFloat(0.005),
+					"USDT": decimal.NewFromFloat(5),
+				},
+				Markets: []string{"BTC-ETH", "USDT-BTC", "USDT-ETH"},
+				Fee:     decimal.NewFromFloat(.0025),
+			},
+		},
+		PollInterval: "440s",
+		Mode:         modeDryRun,
+		API:          defaultAPIConfig(),
+	}
+}
+
+// loadConfig reads path over the defaults when path is set, then applies
+// CHAINGANG_* environment overrides and validates the result.
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return cfg, err
+		}
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		var fromFile config
+		err = decoder.Decode(&fromFile)
+		file.Close()
+		if err != nil {
+			return cfg, fmt.Errorf("%v: %v", path, err)
+		}
+		if fromFile.Exchange != "" {
+			cfg.Exchange = fromFile.Exchange
+		}
+		if fromFile.Exchanges != nil {
+			cfg.Exchanges = fromFile.Exchanges
+		}
+		if fromFile.PollInterval != "" {
+			cfg.PollInterval = fromFile.PollInterval
+		}
+		if fromFile.Mode != "" {
+			cfg.Mode = fromFile.Mode
+		}
+		cfg.Risk = fromFile.Risk
+		cfg.Journal = fromFile.Journal
+		cfg.Spatial = fromFile.Spatial
+		cfg.API = fromFile.API.over(cfg.API)
+		cfg.Freshness = fromFile.Freshness
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+// applyEnv overrides settings from CHAINGANG_EXCHANGE, CHAINGANG_MODE,
+// CHAINGANG_POLL_INTERVAL, CHAINGANG_FEE and CHAINGANG_STAKE_<ORIGIN>.
+// CHAINGANG_FEE replaces any fee schedule with a flat fee.
+func (c *config) applyEnv() error {
+	if value := os.Getenv("CHAINGANG_EXCHANGE"); value != "" {
+		c.Exchange = value
+	}
+	if value := os.Getenv("CHAINGANG_MODE"); value != "" {
+		c.Mode = value
+	}
+	if value := os.Getenv("CHAINGANG_POLL_INTERVAL"); value != "" {
+		c.PollInterval = value
+	}
+	exchange, exists := c.Exchanges[c.Exchange]
+	if !exists {
+		return nil
+	}
+	if value := os.Getenv("CHAINGANG_FEE"); value != "" {
+		fee, err := decimal.NewFromString(value)
+		if err != nil {
+			return fmt.Errorf("CHAINGANG_FEE: %v", err)
+		}
+		exchange.Fee = fee
+		exchange.Fees = nil
+	}
+	origins := make(map[string]decimal.Decimal, len(exchange.Origins))
+	for originName, stake := range exchange.Origins {
+		origins[originName] = stake
+		if value := os.Getenv("CHAINGANG_STAKE_" + originName); value != "" {
+			override, err := decimal.NewFromString(value)
+			if err != nil {
+				return fmt.Errorf("CHAINGANG_STAKE_%v: %v", originName, err)
+			}
+			origins[originName] = override
+		}
+	}
+	exchange.Origins = origins
+	c.Exchanges[c.Exchange] = exchange
+	return nil
+}
+
+// validate reports every problem with the config at once.
+func (c config) validate() error {
+	problems := make([]string, 0)
+	if c.Mode != modeDryRun && c.Mode != modePaper && c.Mode != modeLive {
+		problems = append(problems, fmt.Sprintf("mode %q must be %v, %v or %v", c.Mode, modeDryRun, modePaper, modeLive))
+	}
+	if interval, err := time.ParseDuration(c.PollInterval); err != nil || interval <= 0 {
+		problems = append(problems, fmt.Sprintf("pollInterval %q must be a positive duration such as 440s", c.PollInterval))
+	}
+
+	exchangeNames := make([]string, 0, len(c.Exchanges))
+	for name := range c.Exchanges {
+		exchangeNames = append(exchangeNames, name)
+	}
+	sort.Strings(exchangeNames)
+	if _, exists := c.Exchanges[c.Exchange]; !exists {
+		problems = append(problems, fmt.Sprintf("exchange %q is not configured", c.Exchange))
+	}
+	for _, name := range exchangeNames {
+		exchange := c.Exchanges[name]
+		if len(exchange.Origins) < 2 {
+			problems = append(problems, fmt.Sprintf("%v: at least two origins are needed", name))
+		}
+		for originName, stake := range exchange.Origins {
+			if !stake.GreaterThan(decimal.Zero) {
+				problems = append(problems, fmt.Sprintf("%v: stake for %v must be positive", name, originName))
+			}
+		}
+		for _, market := range exchange.Markets {
+			base, currency := splitMarketName(market)
+			_, baseIsOrigin := exchange.Origins[base]
+			_, currencyIsOrigin := exchange.Origins[currency]
+			if !baseIsOrigin || !currencyIsOrigin {
+				problems = append(problems, fmt.Sprintf("%v: market %q must join two origins as BASE-CURRENCY", name, market))
+			}
+		}
+		problems = append(problems, validateFees(name, exchange.feeSchedule())...)
+	}
+
+	spatialNames := make(map[string]bool, len(c.Spatial))
+	for _, name := range c.Spatial {
+		if _, exists := c.Exchanges[name]; !exists {
+			problems = append(problems, fmt.Sprintf("spatial: exchange %q is not configured", name))
+		}
+		if spatialNames[name] {
+			problems = append(problems, fmt.Sprintf("spatial: exchange %q is listed twice", name))
+		}
+		spatialNames[name] = true
+	}
+	if len(c.Spatial) == 1 {
+		problems = append(problems, "spatial: at least two exchanges are needed")
+	}
+
+	for label, limit := range map[string]decimal.Decimal{
+		"maxTradeNotional":  c.Risk.MaxTradeNotional,
+		"maxHourlyNotional": c.Risk.MaxHourlyNotional,
+		"maxDailyNotional":  c.Risk.MaxDailyNotional,
+		"maxLoss":           c.Risk.MaxLoss,
+	} {
+		if limit.LessThan(decimal.Zero) {
+			problems = append(problems, fmt.Sprintf("risk: %v %v must not be negative", label, limit))
+		}
+	}
+	problems = append(problems, c.API.validate()...)
+	problems = append(problems, c.Freshness.validate()...)
+	if c.Risk.MaxOpenOrders < 0 {
+		problems = append(problems, fmt.Sprintf("risk: maxOpenOrders %v must not be negative", c.Risk.MaxOpenOrders))
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("invalid config:\n\t" + strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+func validateFees(name string, schedule feeConfig) []string {
+	problems := make([]string, 0)
+	checkRate := func(label string, rate decimal.Decimal) {
+		if rate.LessThan(decimal.Zero) || !rate.LessThan(decimal.NewFromFloat(1)) {
+			problems = append(problems, fmt.Sprintf("%v: %v %v must be at least 0 and below 1", name, label, rate))
+		}
+	}
+	checkRate("maker fee", schedule.Maker)
+	checkRate("taker fee", schedule.Taker)
+	for tierName, rates := range schedule.Tiers {
+		checkRate("tier "+tierName+" maker fee", rates.Maker)
+		checkRate("tier "+tierName+" taker fee", rates.Taker)
+	}
+	if _, hasTier := schedule.Tiers[schedule.Tier]; schedule.Tier != "" && !hasTier {
+		problems = append(problems, fmt.Sprintf("%v: fee tier %q is not listed in tiers", name, schedule.Tier))
+	}
+	for market, rates := range schedule.Markets {
+		if base, currency := splitMarketName(market); base == "" || currency == "" {
+			problems = append(problems, fmt.Sprintf("%v: fee market %q must be BASE-CURRENCY", name, market))
+		}
+		checkRate(market+" maker fee", rates.Maker)
+		checkRate(market+" taker fee", rates.Taker)
+	}
+	return problems
+}
+
+// apply copies the config into the globals the pipeline reads.
+func (c config) apply() {
+	validOrigins = make(map[string]map[string]decimal.Decimal)
+	validMarkets = make(map[string]map[string]bool)
+	for name, exchange := range c.Exchanges {
+		validOrigins[name] = make(map[string]decimal.Decimal)
+		for originName, stake := range exchange.Origins {
+			validOrigins[name][originName] = stake
+		}
+		validMarkets[name] = make(map[string]bool)
+		for _, market := range exchange.Markets {
+			validMarkets[name][market] = true
+		}
+	}
+	exchangeName = c.Exchange
+	fees = newFeeModel(c.Exchanges[c.Exchange].feeSchedule())
+	pollInterval, _ = time.ParseDuration(c.PollInterval)
+	risk = newRiskManager(c.Risk)
+	apiPolicy = c.API.policy()
+	maxQuoteAge, maxQuoteSkew = c.Freshness.limits()
+	switch c.Mode {
+	case modeLive:
+		live = true
+	case modePaper:
+		paperTrading = true
+	}
+}
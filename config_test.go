@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// writeConfig writes contents to a config file that is removed with dir.
+func writeConfig(t *testing.T, contents string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "chaingang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfig(t *testing.T) {
+	path, remove := writeConfig(t, `{
+		"exchange": "Bittrex",
+		"exchanges": {"Bittrex": {"origins": {"BTC": "0.01", "USDT": "10"}, "markets": ["USDT-BTC"], "fee": "0.001"}},
+		"pollInterval": "60s",
+		"mode": "paper",
+		"freshness": {"maxAge": "30s"}
+	}`)
+	defer remove()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PollInterval != "60s" || cfg.Mode != modePaper {
+		t.Errorf("pollInterval %v and mode %v, want 60s and paper", cfg.PollInterval, cfg.Mode)
+	}
+	assertDecimal(t, "BTC stake", cfg.Exchanges["Bittrex"].Origins["BTC"], "0.01")
+	if _, hasETH := cfg.Exchanges["Bittrex"].Origins["ETH"]; hasETH {
+		t.Error("default origins kept alongside the configured ones")
+	}
+	if cfg.API.Retries == nil || *cfg.API.Retries != *defaultAPIConfig().Retries {
+		t.Error("api defaults lost when the file leaves them out")
+	}
+}
+
+func TestLoadConfigRejectsUnknownFields(t *testing.T) {
+	path, remove := writeConfig(t, `{"pollIntervall": "60s"}`)
+	defer remove()
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "pollIntervall") {
+		t.Errorf("err = %v, want the unknown field named", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"CHAINGANG_MODE":          "live",
+		"CHAINGANG_POLL_INTERVAL": "30s",
+		"CHAINGANG_FEE":           "0.002",
+		"CHAINGANG_STAKE_BTC":     "0.02",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	cfg := defaultConfig()
+	cfg.Exchanges["Bittrex"] = exchangeConfig{
+		Origins: cfg.Exchanges["Bittrex"].Origins,
+		Markets: cfg.Exchanges["Bittrex"].Markets,
+		Fees:    &feeConfig{Maker: dec("0.001"), Taker: dec("0.003")},
+	}
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Mode != modeLive || cfg.PollInterval != "30s" {
+		t.Errorf("mode %v and pollInterval %v, want live and 30s", cfg.Mode, cfg.PollInterval)
+	}
+	exchange := cfg.Exchanges["Bittrex"]
+	if exchange.Fees != nil {
+		t.Error("CHAINGANG_FEE kept the fee schedule")
+	}
+	assertDecimal(t, "fee", exchange.Fee, "0.002")
+	assertDecimal(t, "BTC stake", exchange.Origins["BTC"], "0.02")
+	assertDecimal(t, "ETH stake", exchange.Origins["ETH"], "0.005")
+	assertDecimal(t, "default BTC stake", defaultConfig().Exchanges["Bittrex"].Origins["BTC"], "0.005")
+
+	os.Setenv("CHAINGANG_STAKE_BTC", "lots")
+	if err := cfg.applyEnv(); err == nil || !strings.Contains(err.Error(), "CHAINGANG_STAKE_BTC") {
+		t.Errorf("err = %v, want the bad stake named", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *config)
+		// problems the error lists, none when empty
+		problems []string
+	}{
+		{name: "defaults", change: func(cfg *config) {}},
+		{name: "unknown mode", change: func(cfg *config) { cfg.Mode = "yolo" }, problems: []string{`mode "yolo"`}},
+		{name: "bad poll interval", change: func(cfg *config) { cfg.PollInterval = "-1s" }, problems: []string{`pollInterval "-1s"`}},
+		{name: "unconfigured exchange", change: func(cfg *config) { cfg.Exchange = "Kraken" }, problems: []string{`exchange "Kraken" is not configured`}},
+		{
+			name: "one origin, a bad stake and a market off the origins",
+			change: func(cfg *config) {
+				cfg.Exchanges["Bittrex"] = exchangeConfig{
+					Origins: map[string]decimal.Decimal{"BTC": dec("0")},
+					Markets: []string{"BTC-LTC"},
+				}
+			},
+			problems: []string{"at least two origins", "stake for BTC must be positive", `market "BTC-LTC"`},
+		},
+		{name: "fee of 1", change: func(cfg *config) {
+			exchange := cfg.Exchanges["Bittrex"]
+			exchange.Fee = dec("1")
+			cfg.Exchanges["Bittrex"] = exchange
+		}, problems: []string{"maker fee 1", "taker fee 1"}},
+		{name: "one spatial exchange", change: func(cfg *config) { cfg.Spatial = []string{"Bittrex"} }, problems: []string{"at least two exchanges"}},
+		{name: "negative risk limit", change: func(cfg *config) { cfg.Risk.MaxLoss = dec("-1") }, problems: []string{"maxLoss -1"}},
+		{name: "bad freshness", change: func(cfg *config) { cfg.Freshness.MaxAge = "soon" }, problems: []string{`maxAge "soon"`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			test.change(&cfg)
+			err := cfg.validate()
+			if len(test.problems) == 0 {
+				if err != nil {
+					t.Errorf("err = %v, want none", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("no error, want %v", test.problems)
+			}
+			for _, problem := range test.problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("err = %v, want it to mention %q", err, problem)
+				}
+			}
+		})
+	}
+}
+
+// A config whose origins leave out the valuation currency still shows and
+// orders its routes.
+func TestConfigWithoutUSDT(t *testing.T) {
+	path, remove := writeConfig(t, `{
+		"exchanges": {"Bittrex": {"origins": {"BTC": "0.005", "ETH": "0.1"}, "markets": ["BTC-ETH"]}}
+	}`)
+	defer remove()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("config without USDT rejected: %v", err)
+	}
+	setupTest(t)
+	cfg.apply()
+	summaries := []bittrex.MarketSummary{
+		{MarketName: "BTC-ETH", Ask: dec("0.05"), Bid: dec("0.0499"), Last: dec("0.05")},
+		{MarketName: "BTC-LTC", Ask: dec("0.004"), Bid: dec("0.0039"), Last: dec("0.004")},
+		{MarketName: "ETH-LTC", Ask: dec("0.09"), Bid: dec("0.089"), Last: dec("0.09")},
+	}
+	paper := newPaperExchange(testSource(summaries, nil), paperBalances(validOrigins[exchangeName]), false)
+	view := newMarketView(summaries, time.Now())
+	view.createSummaries(paper)
+	view.sortSummaries()
+	if len(view.summaries["BTC"]["ETH"]) == 0 || len(view.summaries["ETH"]["BTC"]) == 0 {
+		t.Fatal("no routes between BTC and ETH")
+	}
+	if pairs := view.orderedByGains(); len(pairs) != 2 {
+		t.Errorf("ordered %v pairs, want 2", pairs)
+	}
+	view.printSummaries()
+	view.recordCycleMetrics()
+	dashboard.publishSummaries(view)
+	if _, _, _, convertible := view.convert("BTC", "USDT", dec("1")); convertible {
+		t.Error("converted to a coin the view does not have")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// marketEdge is one direction of a listed market: buying the market currency
+// with the base walks the ask, selling it back hits the bid. Rate is output
+// per unit of input after the market's taker fee.
+type marketEdge struct {
+	To     string
+	Rate   decimal.Decimal
+	Weight float64
+}
+
+type cycleSummary struct {
+	Path     []string
+	Quantity decimal.Decimal
+	Indirect decimal.Decimal
+	Gain     decimal.Decimal
+}
+
+// marketGraph treats every listed market as a pair of directed edges weighted
+// by -log(rate), so a profitable cycle is one whose weights sum below zero.
+func (v *marketView) marketGraph() map[string][]marketEdge {
+	graph := make(map[string][]marketEdge)
+	for market := range v.marketNames {
+		base, currency := splitMarketName(market)
+		coin, coinExists := v.coins[currency]
+		if !coinExists {
+			continue
+		}
+		relationship, hasRelationship := coin.Relationships[base]
+		if !hasRelationship || !relationship.Ask.GreaterThan(decimal.Zero) || !relationship.Bid.GreaterThan(decimal.Zero) {
+			continue
+		}
+		buy := afterBuyFee(market, decimal.NewFromFloat(1)).Div(relationship.Ask)
+		sell := afterSellFee(market, relationship.Bid)
+		buyFloat, _ := buy.Float64()
+		sellFloat, _ := sell.Float64()
+		graph[base] = append(graph[base], marketEdge{To: currency, Rate: buy, Weight: -math.Log(buyFloat)})
+		graph[currency] = append(graph[currency], marketEdge{To: base, Rate: sell, Weight: -math.Log(sellFloat)})
+	}
+	return graph
+}
+
+// findCycles runs a bounded depth first search for profitable cycles of 3 to
+// maxLength legs. Each cycle is only reported from its lowest ranked member,
+// where members are ranked by how many markets they have, so hubs like BTC
+// are searched first and nothing is found twice.
+func (v *marketView) findCycles(maxLength int) []cycleSummary {
+	graph := v.marketGraph()
+	nodes := make([]string, 0, len(graph))
+	for node := range graph {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(aIndex, bIndex int) bool {
+		a, b := nodes[aIndex], nodes[bIndex]
+		if len(graph[a]) != len(graph[b]) {
+			return len(graph[a]) > len(graph[b])
+		}
+		return a < b
+	})
+	rank := make(map[string]int, len(nodes))
+	for index, node := range nodes {
+		rank[node] = index
+	}
+
+	output := make([]cycleSummary, 0)
+	for _, start := range nodes {
+		path := []string{start}
+		onPath := map[string]bool{start: true}
+		var search func(node string, weight float64)
+		search = func(node string, weight float64) {
+			for _, edge := range graph[node] {
+				if edge.To == start {
+					if len(path) >= 3 && weight+edge.Weight < 0 {
+						if cycle, err := v.cycleValue(path); err != nil {
+							logger.debug("stale cycle", field("route", strings.Join(cycle.Path, " -> ")), field("err", err))
+						} else {
+							output = append(output, cycle)
+						}
+					}
+					continue
+				}
+				if len(path) >= maxLength || onPath[edge.To] || rank[edge.To] < rank[start] {
+					continue
+				}
+				path = append(path, edge.To)
+				onPath[edge.To] = true
+				search(edge.To, weight+edge.Weight)
+				onPath[edge.To] = false
+				path = path[:len(path)-1]
+			}
+		}
+		search(start, 0)
+	}
+
+	sort.Slice(output, func(aIndex, bIndex int) bool {
+		return cycleReturn(output[aIndex]).GreaterThan(cycleReturn(output[bIndex]))
+	})
+	return output
+}
+
+// cycleValue prices a cycle with exact decimals. When the cycle passes through
+// an origin it is rotated to start there and sized with that origin's stake,
+// otherwise one unit of the first currency is used. Cycles trading on stale
+// quotes are returned with an error.
+func (v *marketView) cycleValue(path []string) (cycleSummary, error) {
+	rotated := make([]string, len(path))
+	copy(rotated, path)
+	quantity := decimal.NewFromFloat(1)
+	for index, node := range path {
+		if stake, isOrigin := validOrigins[exchangeName][node]; isOrigin {
+			rotated = append(append([]string{}, path[index:]...), path[:index]...)
+			quantity = stake
+			break
+		}
+	}
+
+	value := quantity
+	for index, node := range rotated {
+		next := rotated[(index+1)%len(rotated)]
+		value = v.afterTradeFee(node, next, value)
+		relationship, isSell := v.coins[node].Relationships[next]
+		if isSell && v.marketNames[getMarketName(next, node)] {
+			value = value.Mul(relationship.Bid)
+		} else {
+			value = value.Div(v.coins[next].Relationships[node].Ask)
+		}
+	}
+
+	cycle := cycleSummary{
+		Path:     rotated,
+		Quantity: quantity,
+		Indirect: value,
+		Gain:     value.Sub(quantity),
+	}
+	return cycle, v.routeFreshness(append(append([]string{}, rotated...), rotated[0]))
+}
+
+func cycleReturn(cycle cycleSummary) decimal.Decimal {
+	return cycle.Gain.Div(cycle.Quantity)
+}
+
+func printCycles(cycles []cycleSummary, limit int) {
+	logger.info("cycles", field("profitable", len(cycles)))
+	for index, cycle := range cycles {
+		if index >= limit {
+			break
+		}
+		logger.info("cycle", field("route", strings.Join(append(append([]string{}, cycle.Path...), cycle.Path[0]), " -> ")), field("quantity", cycle.Quantity), field("indirect", cycle.Indirect), field("gain", cycle.Gain), field("return", cycleReturn(cycle).StringFixed(6)))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// newCycleView builds a view from the summaries with trade fees left out, so
+// cycle values come out exact. Origins left nil are the default ones.
+func newCycleView(t *testing.T, summaries []bittrex.MarketSummary, origins map[string]decimal.Decimal) *marketView {
+	t.Helper()
+	setupTest(t)
+	fees = newFeeModel(feeConfig{})
+	if origins != nil {
+		validOrigins = map[string]map[string]decimal.Decimal{exchangeName: origins}
+	}
+	return newMarketView(summaries, time.Now())
+}
+
+// squareSummaries only close a cycle through all four of BTC, ETH, LTC and
+// USDT, and it pays 4% going that way round. With no USDT-ETH market, ETH
+// can't be an origin.
+func squareSummaries() []bittrex.MarketSummary {
+	return []bittrex.MarketSummary{
+		{MarketName: "BTC-ETH", Ask: dec("0.05"), Bid: dec("0.0499"), Last: dec("0.05")},
+		{MarketName: "ETH-LTC", Ask: dec("0.5"), Bid: dec("0.499"), Last: dec("0.5")},
+		{MarketName: "USDT-LTC", Ask: dec("261"), Bid: dec("260"), Last: dec("260")},
+		{MarketName: "USDT-BTC", Ask: dec("10000"), Bid: dec("9990"), Last: dec("9995")},
+	}
+}
+
+func TestFindCyclesPricesAProfitableCycle(t *testing.T) {
+	view := newCycleView(t, testSummaries(), nil)
+	cycles := view.findCycles(3)
+	if len(cycles) != 1 {
+		t.Fatalf("found %v cycles, want 1", len(cycles))
+	}
+	cycle := cycles[0]
+	if route := strings.Join(cycle.Path, " "); route != "BTC ETH USDT" {
+		t.Errorf("route = %v, want BTC ETH USDT", route)
+	}
+	// 0.005 BTC buys 0.1 ETH, sold for 51.1 USDT, which buys 0.00511 BTC.
+	assertDecimal(t, "quantity", cycle.Quantity, "0.005")
+	assertDecimal(t, "indirect", cycle.Indirect, "0.00511")
+	assertDecimal(t, "gain", cycle.Gain, "0.00011")
+}
+
+func TestFindCyclesDepthBound(t *testing.T) {
+	view := newCycleView(t, squareSummaries(), map[string]decimal.Decimal{"BTC": dec("0.005"), "USDT": dec("5")})
+	if cycles := view.findCycles(3); len(cycles) != 0 {
+		t.Errorf("found %v cycles within 3 legs, want none", len(cycles))
+	}
+	cycles := view.findCycles(4)
+	if len(cycles) != 1 {
+		t.Fatalf("found %v cycles within 4 legs, want 1", len(cycles))
+	}
+	if route := strings.Join(cycles[0].Path, " "); route != "BTC ETH LTC USDT" {
+		t.Errorf("route = %v, want BTC ETH LTC USDT", route)
+	}
+	assertDecimal(t, "gain", cycles[0].Gain, "0.0002")
+}
+
+func TestFindCyclesReportsEachCycleOnce(t *testing.T) {
+	summaries := append(testSummaries(), squareSummaries()...)
+	summaries = append(summaries, bittrex.MarketSummary{MarketName: "BTC-LTC", Ask: dec("0.0251"), Bid: dec("0.025"), Last: dec("0.025")})
+	view := newCycleView(t, summaries, nil)
+	cycles := view.findCycles(4)
+	if len(cycles) < 2 {
+		t.Fatalf("found %v cycles, want several", len(cycles))
+	}
+	seen := make(map[string]bool)
+	for _, cycle := range cycles {
+		// A rotation of a cycle starts at its smallest member, whichever
+		// member it was found from.
+		smallest := 0
+		for index, node := range cycle.Path {
+			if node < cycle.Path[smallest] {
+				smallest = index
+			}
+		}
+		key := strings.Join(append(append([]string{}, cycle.Path[smallest:]...), cycle.Path[:smallest]...), " ")
+		if seen[key] {
+			t.Errorf("cycle %v reported twice", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestFindCyclesDropsStaleCycles(t *testing.T) {
+	setupTest(t)
+	fees = newFeeModel(feeConfig{})
+	maxQuoteAge = 30 * time.Second
+	view := newMarketView(testSummaries(), time.Now().Add(-time.Hour))
+	if cycles := view.findCycles(3); len(cycles) != 0 {
+		t.Errorf("found %v cycles on hour old quotes, want none", len(cycles))
+	}
+	view.replayed = true
+	if cycles := view.findCycles(3); len(cycles) != 1 {
+		t.Errorf("found %v cycles replaying hour old quotes, want 1", len(cycles))
+	}
+}
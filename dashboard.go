@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// The dashboard views are what the JSON endpoints return and the HTML page
+// renders. Decimals are written as strings so no precision is lost.
+type dashboardRoute struct {
+	Route          string          `json:"route"`
+	Origin         string          `json:"origin"`
+	Vessel         string          `json:"vessel"`
+	Output         string          `json:"output"`
+	Indirect       decimal.Decimal `json:"indirect"`
+	Gain           decimal.Decimal `json:"gain"`
+	GainUsdt       decimal.Decimal `json:"gainUsdt"`
+	DepthGain      decimal.Decimal `json:"depthGain"`
+	DepthEvaluated bool            `json:"depthEvaluated"`
+}
+
+type dashboardPair struct {
+	Origin string           `json:"origin"`
+	Output string           `json:"output"`
+	Stake  decimal.Decimal  `json:"stake"`
+	Routes []dashboardRoute `json:"routes"`
+}
+
+type dashboardSummaries struct {
+	Updated  time.Time         `json:"updated"`
+	Pairs    []dashboardPair   `json:"pairs"`
+	Rejected map[string]string `json:"rejected"`
+}
+
+type dashboardBalance struct {
+	Currency  string          `json:"currency"`
+	Available decimal.Decimal `json:"available"`
+}
+
+type dashboardOrder struct {
+	OrderId   string          `json:"orderId"`
+	Market    string          `json:"market"`
+	LimitType string          `json:"limitType"`
+	Quantity  decimal.Decimal `json:"quantity"`
+	Rate      decimal.Decimal `json:"rate"`
+	State     orderState      `json:"state"`
+	Executed  decimal.Decimal `json:"executed"`
+	Err       string          `json:"err,omitempty"`
+	Placed    time.Time       `json:"placed"`
+	Updated   time.Time       `json:"updated"`
+}
+
+type executedRoute struct {
+	Time     time.Time                  `json:"time"`
+	Route    string                     `json:"route"`
+	Stake    decimal.Decimal            `json:"stake"`
+	Result   decimal.Decimal            `json:"result"`
+	Gain     decimal.Decimal            `json:"gain"`
+	Complete bool                       `json:"complete"`
+	Stranded map[string]decimal.Decimal `json:"stranded,omitempty"`
+}
+
+// dashboardState holds what the last cycle published and the routes executed
+// since start, so requests never wait on a route being traded.
+type dashboardState struct {
+	lock      sync.RWMutex
+	summaries dashboardSummaries
+	routes    []executedRoute
+}
+
+func newDashboardState() *dashboardState {
+	return &dashboardState{
+		summaries: dashboardSummaries{
+			Pairs:    make([]dashboardPair, 0),
+			Rejected: make(map[string]string),
+		},
+		routes: make([]executedRoute, 0),
+	}
+}
+
+// publishSummaries copies the view's sorted summaries, best pair first.
+func (d *dashboardState) publishSummaries(v *marketView) {
+	ordered := v.orderedByGains()
+	pairs := make([]dashboardPair, 0, len(ordered))
+	for index := len(ordered) - 1; index >= 0; index-- {
+		split := strings.Split(ordered[index], "-")
+		originName, otherOriginName := split[0], split[1]
+		pair := dashboardPair{
+			Origin: originName,
+			Output: otherOriginName,
+			Stake:  validOrigins[exchangeName][originName],
+			Routes: make([]dashboardRoute, 0, len(v.summaries[originName][otherOriginName])),
+		}
+		routes := v.summaries[originName][otherOriginName]
+		for routeIndex := len(routes) - 1; routeIndex >= 0; routeIndex-- {
+			summaryValue := routes[routeIndex]
+			gainUsdt, _ := v.valueIn(originName, valuationCurrency, summaryValue.Gain)
+			pair.Routes = append(pair.Routes, dashboardRoute{
+				Route:          summaryRouteName(summaryValue),
+				Origin:         originName,
+				Vessel:         summaryValue.Vessel,
+				Output:         otherOriginName,
+				Indirect:       summaryValue.Indirect,
+				Gain:           summaryValue.Gain,
+				GainUsdt:       gainUsdt,
+				DepthGain:      summaryValue.DepthGain,
+				DepthEvaluated: summaryValue.DepthEvaluated,
+			})
+		}
+		pairs = append(pairs, pair)
+	}
+	rejected := make(map[string]string, len(v.rejections))
+	for routeName, reason := range v.rejections {
+		rejected[routeName] = reason
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.summaries = dashboardSummaries{
+		Updated:  time.Now().UTC(),
+		Pairs:    pairs,
+		Rejected: rejected,
+	}
+}
+
+// recordRoute keeps the last dashboardRouteLimit executed routes.
+func (d *dashboardState) recordRoute(path []string, stake decimal.Decimal, outcome routeOutcome) {
+	stranded := make(map[string]decimal.Decimal, len(outcome.Stranded))
+	for coinName, amount := range outcome.Stranded {
+		stranded[coinName] = amount
+	}
+	route := executedRoute{
+		Time:     time.Now().UTC(),
+		Route:    strings.Join(append(append([]string{}, path...), path[0]), " -> "),
+		Stake:    stake,
+		Result:   outcome.Result,
+		Gain:     outcome.Result.Sub(stake),
+		Complete: outcome.Complete,
+		Stranded: stranded,
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.routes = append(d.routes, route)
+	if len(d.routes) > dashboardRouteLimit {
+		d.routes = d.routes[len(d.routes)-dashboardRouteLimit:]
+	}
+}
+
+func (d *dashboardState) getSummaries() dashboardSummaries {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.summaries
+}
+
+// getRoutes returns the executed routes, newest first.
+func (d *dashboardState) getRoutes() []executedRoute {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	output := make([]executedRoute, 0, len(d.routes))
+	for index := len(d.routes) - 1; index >= 0; index-- {
+		output = append(output, d.routes[index])
+	}
+	return output
+}
+
+func (b *balances) list() []dashboardBalance {
+	b.lock.RLock()
+	output := make([]dashboardBalance, 0, len(b.balances))
+	for currency, available := range b.balances {
+		output = append(output, dashboardBalance{Currency: currency, Available: available})
+	}
+	b.lock.RUnlock()
+	sort.Slice(output, func(aIndex, bIndex int) bool {
+		return output[aIndex].Currency < output[bIndex].Currency
+	})
+	return output
+}
+
+func dashboardOrders() []dashboardOrder {
+	recent := orderTracker.recent(dashboardOrderLimit)
+	output := make([]dashboardOrder, 0, len(recent))
+	for _, tracked := range recent {
+		order := dashboardOrder{
+			OrderId:   tracked.OrderId,
+			Market:    tracked.Market,
+			LimitType: tracked.LimitType,
+			Quantity:  tracked.Quantity,
+			Rate:      tracked.Rate,
+			State:     tracked.State,
+			Executed:  tracked.Order.Quantity.Sub(tracked.Order.QuantityRemaining),
+			Placed:    tracked.Placed,
+			Updated:   tracked.Updated,
+		}
+		if tracked.Err != nil {
+			order.Err = tracked.Err.Error()
+		}
+		output = append(output, order)
+	}
+	return output
+}
+
+/* ******************************************************************
+ * HTTP
+ * *****************************************************************/
+func writeJSON(writer http.ResponseWriter, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		logger.warn("could not write dashboard response", field("err", err))
+	}
+}
+
+func serveSummaries(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, dashboard.getSummaries())
+}
+
+func serveBalances(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, acctBalance.list())
+}
+
+func serveOrders(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, dashboardOrders())
+}
+
+func serveRoutes(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, dashboard.getRoutes())
+}
+
+type dashboardPage struct {
+	Exchange    string
+	Live        bool
+	Paper       bool
+	Refresh     int
+	RoutesShown int
+	Summaries   dashboardSummaries
+	Balances    []dashboardBalance
+	Orders      []dashboardOrder
+	Routes      []executedRoute
+}
+
+func serveDashboard(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != "/" {
+		http.NotFound(writer, request)
+		return
+	}
+	page := dashboardPage{
+		Exchange:    exchangeName,
+		Live:        live,
+		Paper:       paperTrading,
+		Refresh:     int(dashboardRefresh.Seconds()),
+		RoutesShown: dashboardRoutesShown,
+		Summaries:   dashboard.getSummaries(),
+		Balances:    acctBalance.list(),
+		Orders:      dashboardOrders(),
+		Routes:      dashboard.getRoutes(),
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(writer, page); err != nil {
+		logger.warn("could not render dashboard", field("err", err))
+	}
+}
+
+// newHTTPMux routes the dashboard, its JSON and /metrics. Every endpoint is
+// read-only.
+func newHTTPMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/api/summaries", serveSummaries)
+	mux.HandleFunc("/api/balances", serveBalances)
+	mux.HandleFunc("/api/orders", serveOrders)
+	mux.HandleFunc("/api/routes", serveRoutes)
+	mux.HandleFunc("/", serveDashboard)
+	return mux
+}
+
+// serveHTTP serves newHTTPMux on addr until the process exits.
+func serveHTTP(addr string) {
+	mux := newHTTPMux()
+	go func() {
+		logger.info("serving http", field("addr", addr))
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.error("http server stopped", field("addr", addr), field("err", err))
+		}
+	}()
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"fixed": func(places int32, value decimal.Decimal) string {
+		return value.StringFixed(places)
+	},
+	"gainClass": func(gain decimal.Decimal) string {
+		if gain.GreaterThan(decimal.Zero) {
+			return "gain"
+		}
+		return "loss"
+	},
+	"limit": func(count int, routes []dashboardRoute) []dashboardRoute {
+		if len(routes) > count {
+			return routes[:count]
+		}
+		return routes
+	},
+	"clock": func(value time.Time) string {
+		if value.IsZero() {
+			return "never"
+		}
+		return value.UTC().Format("15:04:05")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>chaingang {{.Exchange}}</title>
+<style>
+body { font-family: monospace; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { padding: 2px 10px; text-align: right; border-bottom: 1px solid #ddd; }
+th:first-child, td:first-child { text-align: left; }
+.gain { color: #080; }
+.loss { color: #b00; }
+</style>
+</head>
+<body>
+<h1>chaingang {{.Exchange}}</h1>
+<p>{{if .Paper}}paper trading{{else if .Live}}live trading{{else}}scanning{{end}}, summaries updated {{clock .Summaries.Updated}} UTC, {{len .Summaries.Rejected}} routes rejected. JSON at <a href="/api/summaries">/api/summaries</a>, <a href="/api/balances">/api/balances</a>, <a href="/api/orders">/api/orders</a> and <a href="/api/routes">/api/routes</a>.</p>
+
+<h2>Opportunities</h2>
+{{range .Summaries.Pairs}}
+<h3>{{.Origin}} to {{.Output}}, stake {{.Stake}}</h3>
+<table>
+<tr><th>route</th><th>indirect</th><th>gain</th><th>gain USDT</th><th>depth gain</th></tr>
+{{range limit $.RoutesShown .Routes}}
+<tr><td>{{.Route}}</td><td>{{fixed 8 .Indirect}}</td><td class="{{gainClass .Gain}}">{{fixed 8 .Gain}}</td><td>{{fixed 4 .GainUsdt}}</td><td>{{if .DepthEvaluated}}{{fixed 8 .DepthGain}}{{end}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No summaries yet.</p>
+{{end}}
+
+<h2>Balances</h2>
+<table>
+<tr><th>currency</th><th>available</th></tr>
+{{range .Balances}}<tr><td>{{.Currency}}</td><td>{{.Available}}</td></tr>
+{{end}}
+</table>
+
+<h2>Executed routes</h2>
+<table>
+<tr><th>time</th><th>route</th><th>stake</th><th>result</th><th>gain</th><th>complete</th></tr>
+{{range .Routes}}<tr><td>{{clock .Time}}</td><td>{{.Route}}</td><td>{{.Stake}}</td><td>{{.Result}}</td><td class="{{gainClass .Gain}}">{{fixed 8 .Gain}}</td><td>{{.Complete}}</td></tr>
+{{end}}
+</table>
+
+<h2>Recent orders</h2>
+<table>
+<tr><th>placed</th><th>market</th><th>side</th><th>quantity</th><th>rate</th><th>executed</th><th>state</th><th>error</th></tr>
+{{range .Orders}}<tr><td>{{clock .Placed}}</td><td>{{.Market}}</td><td>{{.LimitType}}</td><td>{{.Quantity}}</td><td>{{.Rate}}</td><td>{{.Executed}}</td><td>{{.State}}</td><td>{{.Err}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// newDashboardView scores testSummaries without fees for balances holding
+// every default stake.
+func newDashboardView(t *testing.T) *marketView {
+	t.Helper()
+	setupTest(t)
+	fees = newFeeModel(feeConfig{})
+	paper := newPaperExchange(testSource(testSummaries(), nil), paperBalances(validOrigins[exchangeName]), false)
+	if _, err := paper.GetMarketSummaries(); err != nil {
+		t.Fatal(err)
+	}
+	view := newMarketView(testSummaries(), time.Now())
+	view.createSummaries(paper)
+	view.sortSummaries()
+	return view
+}
+
+// getJSON serves path from the dashboard and decodes the response into value.
+func getJSON(t *testing.T, handler http.Handler, path string, value interface{}) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("%v answered %v", path, recorder.Code)
+		return
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("%v served %v", path, contentType)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), value); err != nil {
+		t.Errorf("%v: %v", path, err)
+	}
+}
+
+func TestDashboardServesSummariesAndRoutes(t *testing.T) {
+	view := newDashboardView(t)
+	dashboard.publishSummaries(view)
+	path3 := []string{"BTC", "ETH", "USDT"}
+	dashboard.recordRoute(path3, dec("0.005"), routeOutcome{Path: path3, Result: dec("0.00511"), Complete: true})
+	dashboard.recordRoute(path3, dec("0.005"), routeOutcome{Path: path3, Result: dec("0.003"), Stranded: map[string]decimal.Decimal{"ETH": dec("0.04")}})
+	mux := newHTTPMux()
+
+	var summaries dashboardSummaries
+	getJSON(t, mux, "/api/summaries", &summaries)
+	if len(summaries.Pairs) == 0 {
+		t.Fatal("no pairs published")
+	}
+	// BTC to USDT through ETH is the only route that pays.
+	best := summaries.Pairs[0]
+	if best.Origin != "BTC" || best.Output != "USDT" || len(best.Routes) != 1 {
+		t.Fatalf("best pair %+v, want BTC to USDT with one route", best)
+	}
+	route := best.Routes[0]
+	if route.Route != "BTC -> ETH -> USDT -> BTC" || route.Vessel != "ETH" {
+		t.Errorf("best route %v through %v, want BTC -> ETH -> USDT -> BTC", route.Route, route.Vessel)
+	}
+	assertDecimal(t, "stake", best.Stake, "0.005")
+	assertDecimal(t, "gain", route.Gain, "0.00011")
+	// Valued at the USDT-BTC Last of 9995.
+	assertDecimal(t, "gain in USDT", route.GainUsdt, "1.09945")
+
+	var routes []executedRoute
+	getJSON(t, mux, "/api/routes", &routes)
+	if len(routes) != 2 {
+		t.Fatalf("%v routes served, want 2", len(routes))
+	}
+	if routes[0].Complete || !routes[1].Complete {
+		t.Errorf("routes not newest first: %+v", routes)
+	}
+	assertDecimal(t, "newest gain", routes[0].Gain, "-0.002")
+	assertDecimal(t, "newest stranded ETH", routes[0].Stranded["ETH"], "0.04")
+	assertDecimal(t, "oldest gain", routes[1].Gain, "0.00011")
+}
+
+func TestDashboardConcurrentAccess(t *testing.T) {
+	view := newDashboardView(t)
+	mux := newHTTPMux()
+	path3 := []string{"BTC", "ETH", "USDT"}
+	const writers, readers, rounds = 4, 4, 30
+
+	var wait sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for round := 0; round < rounds; round++ {
+				dashboard.publishSummaries(view)
+				dashboard.recordRoute(path3, dec("0.005"), routeOutcome{Path: path3, Result: dec("0.00511"), Complete: true})
+			}
+		}()
+	}
+	for reader := 0; reader < readers; reader++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for round := 0; round < rounds; round++ {
+				var summaries dashboardSummaries
+				getJSON(t, mux, "/api/summaries", &summaries)
+				var routes []executedRoute
+				getJSON(t, mux, "/api/routes", &routes)
+				if len(routes) > dashboardRouteLimit {
+					t.Errorf("%v routes served, the limit is %v", len(routes), dashboardRouteLimit)
+				}
+				// The page renders every route, so only now and then.
+				if round%10 == 0 {
+					recorder := httptest.NewRecorder()
+					mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+					if recorder.Code != http.StatusOK {
+						t.Errorf("dashboard answered %v", recorder.Code)
+					}
+				}
+			}
+		}()
+	}
+	wait.Wait()
+
+	if routes := dashboard.getRoutes(); len(routes) != dashboardRouteLimit {
+		t.Errorf("%v routes kept, want the last %v", len(routes), dashboardRouteLimit)
+	}
+	if summaries := dashboard.getSummaries(); len(summaries.Pairs) == 0 {
+		t.Error("no pairs published")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// orderBookCache fetches each market's book at most once per cycle.
+type orderBookCache struct {
+	exchange Exchange
+	books    map[string]bittrex.OrderBook
+	failed   map[string]bool
+}
+
+func newOrderBookCache(exchange Exchange) *orderBookCache {
+	return &orderBookCache{
+		exchange: exchange,
+		books:    make(map[string]bittrex.OrderBook),
+		failed:   make(map[string]bool),
+	}
+}
+
+func (c *orderBookCache) get(market string) (bittrex.OrderBook, bool) {
+	if orderBook, exists := c.books[market]; exists {
+		return orderBook, true
+	}
+	if c.failed[market] {
+		return bittrex.OrderBook{}, false
+	}
+	orderBook, err := c.exchange.GetOrderBook(market)
+	if err != nil {
+		logger.warn("could not get order book", field("market", market), field("err", err))
+		c.failed[market] = true
+		return orderBook, false
+	}
+	// Asks cheapest first and bids highest first, whatever the venue returns.
+	sort.Slice(orderBook.Sell, func(aIndex, bIndex int) bool {
+		return orderBook.Sell[aIndex].Rate.LessThan(orderBook.Sell[bIndex].Rate)
+	})
+	sort.Slice(orderBook.Buy, func(aIndex, bIndex int) bool {
+		return orderBook.Buy[aIndex].Rate.GreaterThan(orderBook.Buy[bIndex].Rate)
+	})
+	c.books[market] = orderBook
+	return orderBook, true
+}
+
+// evaluateDepth re-prices the best depthCandidates routes of every origin pair
+// against the order books, walking each leg for the route's actual stake.
+// It expects summaries to already be sorted.
+func (v *marketView) evaluateDepth(exchange Exchange) {
+	if depthCandidates <= 0 {
+		return
+	}
+	books := newOrderBookCache(exchange)
+	for originName := range v.summaries {
+		for otherOriginName, routes := range v.summaries[originName] {
+			for i := len(routes) - 1; i >= 0 && i >= len(routes)-depthCandidates; i-- {
+				route := &routes[i]
+				toVessel, toVesselFilled := v.depthConvert(originName, route.Vessel, route.Quantity, books)
+				toOther, toOtherFilled := v.depthConvert(route.Vessel, otherOriginName, toVessel, books)
+				final, finalFilled := v.depthConvert(otherOriginName, originName, toOther, books)
+				route.DepthEvaluated = toVesselFilled && toOtherFilled && finalFilled
+				if route.DepthEvaluated {
+					route.DepthIndirect = final
+					route.DepthGain = final.Sub(route.Quantity)
+				}
+			}
+		}
+	}
+}
+
+// depthConvert walks the book of whichever market joins the two coins and
+// returns how much of outputName inputQuantity buys after fees. It reports
+// false when the market or its book is missing or too thin for the quantity.
+func (v *marketView) depthConvert(inputName string, outputName string, inputQuantity decimal.Decimal, books *orderBookCache) (decimal.Decimal, bool) {
+	remaining := inputQuantity
+	output := decimal.NewFromFloat(0)
+
+	if market := getMarketName(inputName, outputName); v.marketNames[market] {
+		// Buying outputName, spend the input against the asks.
+		remaining = afterBuyFee(market, remaining)
+		orderBook, found := books.get(market)
+		if !found {
+			return output, false
+		}
+		for _, level := range orderBook.Sell {
+			if !remaining.GreaterThan(decimal.Zero) {
+				break
+			}
+			levelCost := level.Quantity.Mul(level.Rate)
+			if levelCost.GreaterThan(remaining) {
+				output = output.Add(remaining.Div(level.Rate))
+				remaining = decimal.Zero
+			} else {
+				output = output.Add(level.Quantity)
+				remaining = remaining.Sub(levelCost)
+			}
+		}
+	} else if market := getMarketName(outputName, inputName); v.marketNames[market] {
+		// Selling inputName, hit the bids.
+		orderBook, found := books.get(market)
+		if !found {
+			return output, false
+		}
+		for _, level := range orderBook.Buy {
+			if !remaining.GreaterThan(decimal.Zero) {
+				break
+			}
+			sold := level.Quantity
+			if sold.GreaterThan(remaining) {
+				sold = remaining
+			}
+			output = output.Add(sold.Mul(level.Rate))
+			remaining = remaining.Sub(sold)
+		}
+		output = afterSellFee(market, output)
+	} else {
+		return output, false
+	}
+
+	return output, !remaining.GreaterThan(decimal.Zero)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// newDepthPaper serves testSummaries with orderBooks, given out of order as a
+// venue might, to a paper exchange holding the stakes of origins.
+func newDepthPaper(t *testing.T, origins map[string]decimal.Decimal, orderBooks map[string]bittrex.OrderBook) *paperExchange {
+	t.Helper()
+	setupTest(t)
+	validOrigins = map[string]map[string]decimal.Decimal{exchangeName: origins}
+	paper := newPaperExchange(testSource(testSummaries(), orderBooks), paperBalances(origins), true)
+	if _, err := paper.GetMarketSummaries(); err != nil {
+		t.Fatal(err)
+	}
+	return paper
+}
+
+func TestDepthConvert(t *testing.T) {
+	paper := newDepthPaper(t, map[string]decimal.Decimal{"BTC": dec("0.005"), "USDT": dec("5")}, map[string]bittrex.OrderBook{
+		"BTC-ETH": {
+			Sell: []bittrex.Orderb{{Quantity: dec("2"), Rate: dec("0.0625")}, {Quantity: dec("1"), Rate: dec("0.05")}},
+			Buy:  []bittrex.Orderb{{Quantity: dec("1"), Rate: dec("0.049")}, {Quantity: dec("2"), Rate: dec("0.05")}},
+		},
+	})
+	fees = newFeeModel(feeConfig{Taker: dec("0.0025")})
+	view := newMarketView(testSummaries(), time.Now())
+	books := newOrderBookCache(paper)
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		// quantity of the input coin
+		quantity string
+		want     string
+		filled   bool
+	}{
+		// 0.1 BTC is left after the fee, 0.05 of it buys 1 ETH at 0.05 and
+		// the other 0.05 buys 0.8 ETH at 0.0625.
+		{"buy across two asks", "BTC", "ETH", "0.10025", "1.8", true},
+		// The asks only hold 0.175 BTC worth of ETH.
+		{"buy past the asks", "BTC", "ETH", "1.0025", "3", false},
+		// 2 ETH at 0.05 then 0.5 at 0.049 come to 0.1245 BTC, less the fee.
+		{"sell across two bids", "ETH", "BTC", "2.5", "0.12418875", true},
+		// The bids only take 3 ETH, for 0.149 BTC less the fee.
+		{"sell past the bids", "ETH", "BTC", "4", "0.1486275", false},
+		{"no book", "USDT", "ETH", "1", "0", false},
+		{"no market", "ETH", "LTC", "1", "0", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, filled := view.depthConvert(test.input, test.output, dec(test.quantity), books)
+			if filled != test.filled {
+				t.Errorf("filled = %v, want %v", filled, test.filled)
+			}
+			assertDecimal(t, "output", output, test.want)
+		})
+	}
+}
+
+func TestEvaluateDepth(t *testing.T) {
+	paper := newDepthPaper(t, map[string]decimal.Decimal{"BTC": dec("0.005"), "USDT": dec("5")}, map[string]bittrex.OrderBook{
+		"BTC-ETH":  {Sell: []bittrex.Orderb{{Quantity: dec("1"), Rate: dec("0.0625")}, {Quantity: dec("0.04"), Rate: dec("0.05")}}},
+		"USDT-ETH": {Buy: []bittrex.Orderb{{Quantity: dec("1"), Rate: dec("500")}, {Quantity: dec("0.05"), Rate: dec("511")}}},
+		"USDT-BTC": {Sell: []bittrex.Orderb{{Quantity: dec("1"), Rate: dec("12500")}, {Quantity: dec("0.002"), Rate: dec("10000")}}},
+	})
+	fees = newFeeModel(feeConfig{})
+	view := newMarketView(testSummaries(), time.Now())
+	view.createSummaries(paper)
+	view.sortSummaries()
+	view.evaluateDepth(paper)
+
+	routes := view.summaries["BTC"]["USDT"]
+	if len(routes) != 1 || routes[0].Vessel != "ETH" {
+		t.Fatalf("BTC to USDT routes %+v, want one through ETH", routes)
+	}
+	route := routes[0]
+	if !route.DepthEvaluated {
+		t.Fatal("route not evaluated against the books")
+	}
+	// 0.002 BTC buys 0.04 ETH and 0.003 buys 0.048 more. 0.05 ETH sells for
+	// 25.55 USDT and 0.038 for 19, then 20 USDT buys 0.002 BTC and 24.55
+	// buys 0.001964.
+	assertDecimal(t, "top of book indirect", route.Indirect, "0.00511")
+	assertDecimal(t, "depth indirect", route.DepthIndirect, "0.003964")
+	assertDecimal(t, "depth gain", route.DepthGain, "-0.001036")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// Exchange is the set of venue operations the arbitrage pipeline relies on.
+// The bittrex types are used as the common currency between backends so the
+// route math does not need to know which venue it is talking to.
+type Exchange interface {
+	Name() string
+	GetMarketSummaries() ([]bittrex.MarketSummary, error)
+	GetBalances() ([]bittrex.Balance, error)
+	GetOrderBook(market string) (bittrex.OrderBook, error)
+	BuyLimit(market string, quantity, rate decimal.Decimal) (string, error)
+	SellLimit(market string, quantity, rate decimal.Decimal) (string, error)
+	CancelOrder(orderId string) error
+	GetOrder(orderId string) (bittrex.Order2, error)
+}
+
+// newExchange builds the client for a configured exchange's backend. A nil
+// httpClient uses the backend's default one. Bittrex is the only backend, so
+// spatial trades between Bittrex-backed exchanges, such as Bittrex accounts
+// or venues that serve its API.
+func newExchange(backend, key, secret string, httpClient *http.Client) (Exchange, error) {
+	switch backend {
+	case "Bittrex":
+		return newBittrexExchange(key, secret, httpClient), nil
+	}
+	return nil, fmt.Errorf("%v is not a supported backend, only Bittrex is implemented", backend)
+}
+
+/* ******************************************************************
+ * Bittrex
+ * *****************************************************************/
+// bittrexExchange records the latency and errors of every REST call in
+// metrics. Calls go through a callGuard, see placeOrder for how orders are
+// placed.
+type bittrexExchange struct {
+	client *bittrex.Bittrex
+	// httpClient makes the calls the vendored client has no method for
+	httpClient *http.Client
+	guard      *callGuard
+	// restOnly is set for clients of a fake Bittrex or a cassette, neither of
+	// which has a websocket
+	restOnly bool
+}
+
+func newBittrexExchange(key, secret string, httpClient *http.Client) *bittrexExchange {
+	exchange := &bittrexExchange{guard: newCallGuard("Bittrex", apiPolicy)}
+	if httpClient != nil {
+		exchange.client = bittrex.NewWithCustomHttpClient(key, secret, httpClient)
+		exchange.httpClient = httpClient
+	} else {
+		exchange.client = bittrex.New(key, secret)
+		exchange.httpClient = &http.Client{Timeout: bittrexTimeout}
+	}
+	return exchange
+}
+
+// newRestOnlyExchange builds a Bittrex client that sends its requests through
+// transport, to a fake Bittrex or a cassette rather than the exchange.
+func newRestOnlyExchange(key, secret string, transport http.RoundTripper) *bittrexExchange {
+	exchange := newBittrexExchange(key, secret, &http.Client{Transport: transport, Timeout: restOnlyTimeout})
+	exchange.restOnly = true
+	return exchange
+}
+
+func (b *bittrexExchange) Name() string {
+	return "Bittrex"
+}
+
+func (b *bittrexExchange) circuitErr() error {
+	return b.guard.circuitErr()
+}
+
+func (b *bittrexExchange) GetMarketSummaries() (marketSummaries []bittrex.MarketSummary, err error) {
+	defer observeCall("GetMarketSummaries", time.Now(), &err)
+	err = b.guard.call("GetMarketSummaries", true, func() (err error) {
+		marketSummaries, err = b.client.GetMarketSummaries()
+		return err
+	})
+	return marketSummaries, err
+}
+
+func (b *bittrexExchange) GetMarkets() (markets []bittrex.Market, err error) {
+	defer observeCall("GetMarkets", time.Now(), &err)
+	err = b.guard.call("GetMarkets", true, func() (err error) {
+		markets, err = b.client.GetMarkets()
+		return err
+	})
+	return markets, err
+}
+
+// GetMarketPrecisions reads how many decimal places each market's rates take
+// from the v3 market list, v1.1 lists none. Markets are named the v1.1 way.
+func (b *bittrexExchange) GetMarketPrecisions() (precisions map[string]int32, err error) {
+	defer observeCall("GetMarketPrecisions", time.Now(), &err)
+	err = b.guard.call("GetMarketPrecisions", true, func() error {
+		response, err := b.httpClient.Get(bittrexMarketsURL)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return errors.New(response.Status)
+		}
+		var markets []bittrexMarketV3
+		if err := json.NewDecoder(response.Body).Decode(&markets); err != nil {
+			return err
+		}
+		precisions = make(map[string]int32, len(markets))
+		for _, market := range markets {
+			precisions[getMarketName(market.QuoteCurrencySymbol, market.BaseCurrencySymbol)] = market.Precision
+		}
+		return nil
+	})
+	return precisions, err
+}
+
+// bittrexMarketV3 is a market in the v3 market list, where ETH-BTC is the
+// v1.1 BTC-ETH.
+type bittrexMarketV3 struct {
+	Symbol              string `json:"symbol"`
+	BaseCurrencySymbol  string `json:"baseCurrencySymbol"`
+	QuoteCurrencySymbol string `json:"quoteCurrencySymbol"`
+	Precision           int32  `json:"precision"`
+}
+
+func (b *bittrexExchange) GetCurrencies() (currencies []bittrex.Currency, err error) {
+	defer observeCall("GetCurrencies", time.Now(), &err)
+	err = b.guard.call("GetCurrencies", true, func() (err error) {
+		currencies, err = b.client.GetCurrencies()
+		return err
+	})
+	return currencies, err
+}
+
+func (b *bittrexExchange) GetBalances() (balances []bittrex.Balance, err error) {
+	defer observeCall("GetBalances", time.Now(), &err)
+	err = b.guard.call("GetBalances", true, func() (err error) {
+		balances, err = b.client.GetBalances()
+		return err
+	})
+	return balances, err
+}
+
+func (b *bittrexExchange) GetOrderBook(market string) (orderBook bittrex.OrderBook, err error) {
+	defer observeCall("GetOrderBook", time.Now(), &err)
+	err = b.guard.call("GetOrderBook", true, func() (err error) {
+		orderBook, err = b.client.GetOrderBook(market, "both")
+		return err
+	})
+	return orderBook, err
+}
+
+func (b *bittrexExchange) BuyLimit(market string, quantity, rate decimal.Decimal) (orderId string, err error) {
+	defer observeCall("BuyLimit", time.Now(), &err)
+	return b.placeOrder("BuyLimit", "LIMIT_BUY", market, quantity, rate, b.client.BuyLimit)
+}
+
+func (b *bittrexExchange) SellLimit(market string, quantity, rate decimal.Decimal) (orderId string, err error) {
+	defer observeCall("SellLimit", time.Now(), &err)
+	return b.placeOrder("SellLimit", "LIMIT_SELL", market, quantity, rate, b.client.SellLimit)
+}
+
+// CancelOrder is retried too: canceling twice at worst gets ORDER_NOT_OPEN,
+// and callers read the order afterwards to see how it ended.
+func (b *bittrexExchange) CancelOrder(orderId string) (err error) {
+	defer observeCall("CancelOrder", time.Now(), &err)
+	return b.guard.call("CancelOrder", true, func() error {
+		return b.client.CancelOrder(orderId)
+	})
+}
+
+func (b *bittrexExchange) GetOpenOrders(market string) (openOrders []bittrex.Order, err error) {
+	defer observeCall("GetOpenOrders", time.Now(), &err)
+	err = b.guard.call("GetOpenOrders", true, func() (err error) {
+		openOrders, err = b.client.GetOpenOrders(market)
+		return err
+	})
+	return openOrders, err
+}
+
+// GetOrder fails when no order comes back, which the client does not check.
+func (b *bittrexExchange) GetOrder(orderId string) (order bittrex.Order2, err error) {
+	defer observeCall("GetOrder", time.Now(), &err)
+	err = b.guard.call("GetOrder", true, func() (err error) {
+		order, err = b.client.GetOrder(orderId)
+		if err == nil && order.OrderUuid == "" {
+			err = fmt.Errorf("%w : %v", errOrderNotReturned, orderId)
+		}
+		return err
+	})
+	return order, err
+}
+
+func (b *bittrexExchange) SubscribeExchangeUpdate(market string, dataCh chan<- bittrex.ExchangeState, stop <-chan bool) error {
+	if b.restOnly {
+		return errors.New("streaming is only available from the exchange")
+	}
+	return b.client.SubscribeExchangeUpdate(market, dataCh, stop)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// Unwind policies for coins left over when a route leg fails:
+// market sells them straight back to the origin with unwindSlippage,
+// hold leaves them in the account, and retry re-submits the failed leg up to
+// unwindRetries times before falling back to market.
+const (
+	unwindMarket = "market"
+	unwindHold   = "hold"
+	unwindRetry  = "retry"
+)
+
+type routeOutcome struct {
+	Path     []string
+	Legs     []legFill
+	Complete bool
+	// Result is the origin coin the route ended with, after any unwind.
+	Result decimal.Decimal
+	// Stranded is whatever could not be brought back to the origin.
+	Stranded map[string]decimal.Decimal
+	// Interrupted routes stopped between legs for a shutdown and hold
+	// Stranded until reconcile resumes or unwinds them.
+	Interrupted bool
+}
+
+// placedOrder says whether any leg got as far as placing an order.
+func (o routeOutcome) placedOrder() bool {
+	for _, leg := range o.Legs {
+		if leg.OrderId != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// executeRoute trades stake of path[0] around the cycle path[0] -> ... ->
+// path[0], feeding each leg only what the previous leg actually delivered.
+// The route stops at the first rejected or partially filled leg and the
+// leftovers are dealt with according to unwindPolicy.
+func (v *marketView) executeRoute(routeId string, path []string, stake decimal.Decimal, exchange Exchange) routeOutcome {
+	return v.executeLegs(routeId, path, 0, stake, exchange)
+}
+
+// executeLegs trades holding of path[start] along the rest of the cycle back
+// to path[0]. Once shutdown has begun no further leg is started.
+func (v *marketView) executeLegs(routeId string, path []string, start int, holding decimal.Decimal, exchange Exchange) routeOutcome {
+	origin := path[0]
+	routeName := strings.Join(append(append([]string{}, path...), origin), " -> ")
+	outcome := routeOutcome{
+		Path:     path,
+		Result:   decimal.Zero,
+		Stranded: make(map[string]decimal.Decimal),
+	}
+
+	routeLogger := logger.with(field("route", routeName), field("routeId", routeId))
+	stake := holding
+	for index := start; index < len(path); index++ {
+		inputCoinName := path[index]
+		if index > start && routeGate.isClosed() {
+			routeLogger.warn("route interrupted by shutdown", field("currency", inputCoinName), field("amount", holding))
+			outcome.Interrupted = true
+			outcome.Stranded[inputCoinName] = holding
+			routesMetric.inc("interrupted")
+			return outcome
+		}
+		outputCoinName := path[(index+1)%len(path)]
+
+		fill, err := v.transfer(routeId, inputCoinName, outputCoinName, holding, decimal.Zero, exchange)
+		outcome.Legs = append(outcome.Legs, fill)
+		received := fill.Received
+		leftover := holding.Sub(fill.Spent)
+
+		attempts := 0
+		for (err != nil || !fill.Complete) && unwindPolicy == unwindRetry && attempts < unwindRetries && leftover.GreaterThan(decimal.Zero) {
+			attempts++
+			routeLogger.warn("retrying leg", field("leg", inputCoinName+" -> "+outputCoinName), field("quantity", leftover), field("attempt", attempts))
+			fill, err = v.transfer(routeId, inputCoinName, outputCoinName, leftover, decimal.Zero, exchange)
+			outcome.Legs = append(outcome.Legs, fill)
+			received = received.Add(fill.Received)
+			leftover = leftover.Sub(fill.Spent)
+		}
+
+		if err != nil || !fill.Complete {
+			reason := "not fully filled"
+			if err != nil {
+				reason = err.Error()
+			}
+			routeLogger.warn("route aborted", field("leg", inputCoinName+" -> "+outputCoinName), field("reason", reason))
+			if leftover.GreaterThan(decimal.Zero) {
+				outcome.Stranded[inputCoinName] = outcome.Stranded[inputCoinName].Add(leftover)
+			}
+			if received.GreaterThan(decimal.Zero) {
+				outcome.Stranded[outputCoinName] = outcome.Stranded[outputCoinName].Add(received)
+			}
+			routesMetric.inc("aborted")
+			outcome.Result = v.unwind(routeId, origin, outcome.Stranded, exchange)
+			for coinName, amount := range outcome.Stranded {
+				routeLogger.warn("stranded", field("currency", coinName), field("amount", amount))
+			}
+			return outcome
+		}
+		holding = received
+	}
+
+	outcome.Complete = true
+	routesMetric.inc("complete")
+	outcome.Result = holding
+	routeLogger.info("route complete", field("stake", stake), field("currency", path[start]), field("result", holding))
+	return outcome
+}
+
+// unwind converts holdings back to origin and returns how much origin was
+// recovered. Anything it could not convert is left in holdings.
+func (v *marketView) unwind(routeId string, origin string, holdings map[string]decimal.Decimal, exchange Exchange) decimal.Decimal {
+	recovered := holdings[origin]
+	delete(holdings, origin)
+	if unwindPolicy == unwindHold {
+		return recovered
+	}
+
+	for coinName, amount := range holdings {
+		if v.existingMarket(coinName, origin) == "" {
+			logger.warn("no market to unwind", field("currency", coinName), field("amount", amount), field("origin", origin))
+			continue
+		}
+		fill, err := v.transfer(routeId, coinName, origin, amount, unwindSlippage, exchange)
+		recovered = recovered.Add(fill.Received)
+		remaining := amount.Sub(fill.Spent)
+		if (err != nil || !fill.Complete) && remaining.GreaterThan(decimal.Zero) {
+			logger.warn("could not unwind", field("currency", coinName), field("amount", remaining), field("origin", origin), field("err", err))
+			holdings[coinName] = remaining
+		} else {
+			delete(holdings, coinName)
+		}
+	}
+	return recovered
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// thinBTCETH leaves only 0.04 ETH for sale, so the first leg of the test
+// route spends 0.002 of its 0.005 BTC.
+var thinBTCETH = bittrex.OrderBook{
+	Buy:  []bittrex.Orderb{{Quantity: dec("10"), Rate: dec("0.0499")}},
+	Sell: []bittrex.Orderb{{Quantity: dec("0.04"), Rate: dec("0.05")}},
+}
+
+func assertStranded(t *testing.T, outcome routeOutcome, want map[string]string) {
+	t.Helper()
+	if len(outcome.Stranded) != len(want) {
+		t.Errorf("stranded %v, want %v", outcome.Stranded, want)
+		return
+	}
+	for coinName, amount := range want {
+		assertDecimal(t, "stranded "+coinName, outcome.Stranded[coinName], amount)
+	}
+}
+
+func TestExecuteStopsBeforeNextLegOnShutdown(t *testing.T) {
+	_, client, stop := startTestBittrex(t, map[string]decimal.Decimal{"BTC": dec("1")})
+	defer stop()
+	routeGate.close(0)
+	outcome := runTestRoute(t, client)
+	if outcome.Complete || !outcome.Interrupted || len(outcome.Legs) != 1 {
+		t.Fatalf("route complete %v interrupted %v after %v legs, want interrupted after 1", outcome.Complete, outcome.Interrupted, len(outcome.Legs))
+	}
+	// The first leg was already under way, the ETH it bought is held for
+	// reconcile rather than unwound.
+	assertStranded(t, outcome, map[string]string{"ETH": "0.1"})
+	assertDecimal(t, "result", outcome.Result, "0")
+	assertBalance(t, client, "BTC", "0.995")
+	assertBalance(t, client, "ETH", "0.1")
+}
+
+func TestExecuteRetriesFailedLeg(t *testing.T) {
+	fake, client, stop := startTestBittrex(t, map[string]decimal.Decimal{"BTC": dec("1")})
+	defer stop()
+	unwindPolicy = unwindRetry
+	fake.fail(fakeError{Endpoint: "buylimit", Message: "INSUFFICIENT_FUNDS"})
+	outcome := runTestRoute(t, client)
+	if !outcome.Complete || len(outcome.Legs) != 4 {
+		t.Fatalf("route complete %v after %v legs, want complete after 4", outcome.Complete, len(outcome.Legs))
+	}
+	if leg := outcome.Legs[0]; leg.OrderId != "" {
+		t.Errorf("rejected buy placed %v", leg.OrderId)
+	}
+	assertDecimal(t, "result", outcome.Result, "0.00511")
+	assertBalance(t, client, "BTC", "1.00011")
+}
+
+func TestExecuteRetriesThenUnwinds(t *testing.T) {
+	fake, client, stop := startTestBittrex(t, map[string]decimal.Decimal{"BTC": dec("1")})
+	defer stop()
+	unwindPolicy = unwindRetry
+	fake.fail(fakeError{Endpoint: "selllimit", Message: "INSUFFICIENT_FUNDS", Times: 1 + unwindRetries})
+	outcome := runTestRoute(t, client)
+	if outcome.Complete || len(outcome.Legs) != 2+unwindRetries {
+		t.Fatalf("route complete %v after %v legs, want aborted after %v", outcome.Complete, len(outcome.Legs), 2+unwindRetries)
+	}
+	// Once the retries are used up the 0.1 ETH is sold back at 0.0499.
+	assertStranded(t, outcome, map[string]string{})
+	assertDecimal(t, "result", outcome.Result, "0.00499")
+	assertBalance(t, client, "BTC", "0.99999")
+	assertBalance(t, client, "ETH", "0")
+}
+
+func TestExecuteHoldsPartialFill(t *testing.T) {
+	fake, client, stop := startTestBittrex(t, map[string]decimal.Decimal{"BTC": dec("1")})
+	defer stop()
+	unwindPolicy = unwindHold
+	fake.setOrderBook("BTC-ETH", thinBTCETH)
+	outcome := runTestRoute(t, client)
+	if outcome.Complete || len(outcome.Legs) != 1 {
+		t.Fatalf("route complete %v after %v legs, want aborted after 1", outcome.Complete, len(outcome.Legs))
+	}
+	// The unspent BTC counts towards the result, the ETH stays in the account.
+	assertStranded(t, outcome, map[string]string{"ETH": "0.04"})
+	assertDecimal(t, "result", outcome.Result, "0.003")
+	assertBalance(t, client, "BTC", "0.998")
+	assertBalance(t, client, "ETH", "0.04")
+}
+
+func TestUnwindMarketSellsBackToOrigin(t *testing.T) {
+	_, client, stop := startTestBittrex(t, map[string]decimal.Decimal{"BTC": dec("1"), "ETH": dec("1")})
+	defer stop()
+	view := newMarketView(testSummaries(), time.Now())
+	holdings := map[string]decimal.Decimal{"BTC": dec("0.001"), "ETH": dec("0.1"), "XYZ": dec("5")}
+	recovered := view.unwind("route-1", "BTC", holdings, client)
+	// 0.1 ETH sold at 0.0499 on top of the 0.001 BTC held. There is no
+	// market to sell XYZ in.
+	assertDecimal(t, "recovered", recovered, "0.00599")
+	if len(holdings) != 1 {
+		t.Errorf("left %v, want only XYZ", holdings)
+	}
+	assertDecimal(t, "XYZ", holdings["XYZ"], "5")
+	assertBalance(t, client, "BTC", "1.00499")
+	assertBalance(t, client, "ETH", "0.9")
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// fakeScript sets up a fake Bittrex. Prices come from Summaries and
+// OrderBooks, or from recorded snapshot files replayed one per
+// getmarketsummaries call. Orders fill against the order book of their
+// market, so a thin book fills them partially and an empty side leaves them
+// open until canceled. Summaries without a TimeStamp are stamped when served.
+type fakeScript struct {
+	Fee            decimal.Decimal              `json:"fee"`
+	Balances       map[string]decimal.Decimal   `json:"balances"`
+	Summaries      []bittrex.MarketSummary      `json:"summaries"`
+	OrderBooks     map[string]bittrex.OrderBook `json:"orderBooks"`
+	Snapshots      []string                     `json:"snapshots"`
+	MinTradeSizes  map[string]decimal.Decimal   `json:"minTradeSizes"`
+	WithdrawalFees map[string]decimal.Decimal   `json:"withdrawalFees"`
+	RatePrecisions map[string]int32             `json:"ratePrecisions"`
+	Errors         []fakeError                  `json:"errors"`
+}
+
+// fakeError fails Times calls to Endpoint, such as buylimit, once After calls
+// have gone through. A Status other than 200 fails the HTTP request instead
+// of answering success false with Message. Executed calls take effect before
+// failing, like an order placed by an exchange that then times out.
+type fakeError struct {
+	Endpoint string `json:"endpoint"`
+	Status   int    `json:"status"`
+	Message  string `json:"message"`
+	After    int    `json:"after"`
+	Times    int    `json:"times"`
+	Executed bool   `json:"executed"`
+}
+
+func loadFakeScript(path string) (fakeScript, error) {
+	var script fakeScript
+	file, err := os.Open(path)
+	if err != nil {
+		return script, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&script); err != nil {
+		return script, fmt.Errorf("%v: %v", path, err)
+	}
+	return script, nil
+}
+
+/* ******************************************************************
+ * Fake Exchange
+ * *****************************************************************/
+
+// fakeBittrex answers the Bittrex v1.1 REST endpoints the vendored client
+// calls. Balances, fills and fees are those of a paper exchange fed from the
+// script, and private endpoints check the apikey and apisign the client
+// sends. Scripting methods may be called while it serves.
+type fakeBittrex struct {
+	lock    sync.Mutex
+	key     string
+	secret  string
+	script  fakeScript
+	source  *fakeSource
+	paper   *paperExchange
+	calls   map[string]int
+	pending []fakeError
+}
+
+// fakeSource serves the current snapshot, making up an order book from the
+// summary for markets the snapshot has none for.
+type fakeSource struct {
+	replay *replaySource
+}
+
+func (s fakeSource) GetMarketSummaries() ([]bittrex.MarketSummary, error) {
+	return s.replay.GetMarketSummaries()
+}
+
+func (s fakeSource) GetOrderBook(market string) (bittrex.OrderBook, error) {
+	if orderBook, err := s.replay.GetOrderBook(market); err == nil {
+		return orderBook, nil
+	}
+	summaries, err := s.replay.GetMarketSummaries()
+	if err != nil {
+		return bittrex.OrderBook{}, err
+	}
+	for _, marketSummary := range summaries {
+		if marketSummary.MarketName == market {
+			return bittrex.OrderBook{
+				Buy:  []bittrex.Orderb{{Quantity: fakeBookQuantity, Rate: marketSummary.Bid}},
+				Sell: []bittrex.Orderb{{Quantity: fakeBookQuantity, Rate: marketSummary.Ask}},
+			}, nil
+		}
+	}
+	return bittrex.OrderBook{}, errors.New("INVALID_MARKET")
+}
+
+func newFakeBittrex(script fakeScript, key string, secret string) (*fakeBittrex, error) {
+	snapshots := []marketSnapshot{{
+		Time:       time.Now().UTC(),
+		Exchange:   "Bittrex",
+		Summaries:  script.Summaries,
+		OrderBooks: script.OrderBooks,
+	}}
+	if len(script.Snapshots) > 0 {
+		recorded, err := loadSnapshots(script.Snapshots)
+		if err != nil {
+			return nil, err
+		}
+		if len(recorded) == 0 {
+			return nil, errors.New("no snapshots recorded in " + strings.Join(script.Snapshots, ", "))
+		}
+		snapshots = recorded
+	}
+	for index := range snapshots {
+		if snapshots[index].OrderBooks == nil {
+			snapshots[index].OrderBooks = make(map[string]bittrex.OrderBook)
+		}
+	}
+	source := &fakeSource{replay: &replaySource{snapshots: snapshots}}
+	source.replay.next()
+
+	paper := newPaperExchange(source, script.Balances, true)
+	paper.name = "FakeBittrex"
+	paper.fees = newFeeModel(feeConfig{Maker: script.Fee, Taker: script.Fee})
+	// Orders placed before the first getmarketsummaries still see prices.
+	if _, err := paper.GetMarketSummaries(); err != nil {
+		return nil, err
+	}
+	return &fakeBittrex{
+		key:     key,
+		secret:  secret,
+		script:  script,
+		source:  source,
+		paper:   paper,
+		calls:   make(map[string]int),
+		pending: append([]fakeError{}, script.Errors...),
+	}, nil
+}
+
+// setSummaries replaces the current market summaries.
+func (f *fakeBittrex) setSummaries(summaries []bittrex.MarketSummary) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	replay := f.source.replay
+	replay.snapshots[replay.current-1].Summaries = summaries
+	f.paper.GetMarketSummaries()
+}
+
+// setOrderBook replaces the order book orders in market fill against.
+func (f *fakeBittrex) setOrderBook(market string, orderBook bittrex.OrderBook) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	replay := f.source.replay
+	replay.snapshots[replay.current-1].OrderBooks[market] = orderBook
+}
+
+func (f *fakeBittrex) setBalance(currency string, amount decimal.Decimal) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.paper.lock.Lock()
+	defer f.paper.lock.Unlock()
+	f.paper.balances[currency] = amount
+}
+
+// fail queues an error the way the script's errors are.
+func (f *fakeBittrex) fail(failure fakeError) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pending = append(f.pending, failure)
+}
+
+// scriptedError returns the queued error the call to endpoint hits, if any.
+func (f *fakeBittrex) scriptedError(endpoint string) (fakeError, bool) {
+	f.calls[endpoint]++
+	for index := range f.pending {
+		failure := &f.pending[index]
+		if failure.Endpoint != endpoint || f.calls[endpoint] <= failure.After {
+			continue
+		}
+		if failure.Times <= 0 {
+			failure.Times = 1
+		}
+		triggered := *failure
+		failure.Times--
+		if failure.Times == 0 {
+			f.pending = append(f.pending[:index], f.pending[index+1:]...)
+		}
+		return triggered, true
+	}
+	return fakeError{}, false
+}
+
+// authenticate checks the apikey and the apisign HMAC the vendored client
+// computes over the URL it requested.
+func (f *fakeBittrex) authenticate(r *http.Request) error {
+	query := r.URL.Query()
+	if query.Get("apikey") == "" {
+		return errors.New("APIKEY_NOT_PROVIDED")
+	}
+	if query.Get("nonce") == "" {
+		return errors.New("NONCE_NOT_PROVIDED")
+	}
+	if query.Get("apikey") != f.key {
+		return errors.New("APIKEY_INVALID")
+	}
+	signature := r.Header.Get("apisign")
+	if signature == "" {
+		return errors.New("APISIGN_NOT_PROVIDED")
+	}
+	requested := strings.TrimSuffix(bittrex.API_BASE, "/api/") + r.URL.RequestURI()
+	mac := hmac.New(sha512.New, []byte(f.secret))
+	mac.Write([]byte(requested))
+	if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return errors.New("INVALID_SIGNATURE")
+	}
+	return nil
+}
+
+func (f *fakeBittrex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.URL.Path == "/v3/markets" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(f.marketsV3()); err != nil {
+			logger.error("could not write fake bittrex response", field("err", err))
+		}
+		return
+	}
+	resource := strings.TrimPrefix(r.URL.Path, "/api/"+bittrex.API_VERSION+"/")
+	group, endpoint := "", resource
+	if slash := strings.Index(resource, "/"); slash >= 0 {
+		group, endpoint = resource[:slash], resource[slash+1:]
+	}
+	if group == "account" || group == "market" {
+		if err := f.authenticate(r); err != nil {
+			writeBittrex(w, nil, err)
+			return
+		}
+	}
+	if failure, failed := f.scriptedError(endpoint); failed {
+		if failure.Executed {
+			f.serve(discardResponse{header: make(http.Header)}, r, resource, endpoint)
+		}
+		if failure.Status != 0 && failure.Status != http.StatusOK {
+			http.Error(w, failure.Message, failure.Status)
+			return
+		}
+		writeBittrex(w, nil, errors.New(failure.Message))
+		return
+	}
+	f.serve(w, r, resource, endpoint)
+}
+
+func (f *fakeBittrex) serve(w http.ResponseWriter, r *http.Request, resource string, endpoint string) {
+	query := r.URL.Query()
+	market := strings.ToUpper(query.Get("market"))
+	switch resource {
+	case "public/getmarketsummaries":
+		if f.source.replay.current < len(f.source.replay.snapshots) {
+			f.source.replay.next()
+		}
+		summaries, err := f.paper.GetMarketSummaries()
+		stamped := make([]bittrex.MarketSummary, len(summaries))
+		for index, marketSummary := range summaries {
+			if marketSummary.TimeStamp == "" {
+				marketSummary.TimeStamp = time.Now().UTC().Format(bittrex.TIME_FORMAT)
+			}
+			stamped[index] = marketSummary
+		}
+		writeBittrex(w, stamped, err)
+	case "public/getmarkets":
+		writeBittrex(w, f.markets(), nil)
+	case "public/getcurrencies":
+		writeBittrex(w, f.currencies(), nil)
+	case "public/getorderbook":
+		orderBook, err := f.source.GetOrderBook(market)
+		switch query.Get("type") {
+		case "buy":
+			writeBittrex(w, orderBook.Buy, err)
+		case "sell":
+			writeBittrex(w, orderBook.Sell, err)
+		default:
+			writeBittrex(w, orderBook, err)
+		}
+	case "account/getbalances":
+		balances, err := f.paper.GetBalances()
+		writeBittrex(w, balances, err)
+	case "account/getorder":
+		order, err := f.paper.GetOrder(query.Get("uuid"))
+		writeBittrex(w, order, err)
+	case "market/buylimit", "market/selllimit":
+		quantity, quantityErr := decimal.NewFromString(query.Get("quantity"))
+		rate, rateErr := decimal.NewFromString(query.Get("rate"))
+		if quantityErr != nil || rateErr != nil {
+			writeBittrex(w, nil, errors.New("INVALID_QUANTITY_OR_RATE"))
+			return
+		}
+		if err := f.checkOrder(market, quantity); err != nil {
+			writeBittrex(w, nil, err)
+			return
+		}
+		var orderId string
+		var err error
+		if endpoint == "buylimit" {
+			orderId, err = f.paper.BuyLimit(market, quantity, rate)
+		} else {
+			orderId, err = f.paper.SellLimit(market, quantity, rate)
+		}
+		writeBittrex(w, bittrex.Uuid{Id: orderId}, err)
+	case "market/cancel":
+		writeBittrex(w, nil, f.paper.CancelOrder(query.Get("uuid")))
+	case "market/getopenorders", "account/getorderhistory":
+		if market == "" {
+			market = "all"
+		}
+		var orders []bittrex.Order
+		var err error
+		if endpoint == "getopenorders" {
+			orders, err = f.paper.GetOpenOrders(market)
+		} else {
+			orders, err = f.paper.GetOrderHistory(market)
+		}
+		writeBittrex(w, orders, err)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// checkOrder rejects orders for markets the fake does not list or below the
+// scripted minimum trade size.
+func (f *fakeBittrex) checkOrder(market string, quantity decimal.Decimal) error {
+	for _, listed := range f.markets() {
+		if listed.MarketName == market {
+			if quantity.LessThan(listed.MinTradeSize) {
+				return errors.New("MIN_TRADE_REQUIREMENT_NOT_MET")
+			}
+			return nil
+		}
+	}
+	return errors.New("INVALID_MARKET")
+}
+
+func (f *fakeBittrex) markets() []bittrex.Market {
+	summaries, _ := f.source.GetMarketSummaries()
+	markets := make([]bittrex.Market, 0, len(summaries))
+	for _, marketSummary := range summaries {
+		base, currency := splitMarketName(marketSummary.MarketName)
+		markets = append(markets, bittrex.Market{
+			MarketCurrency: currency,
+			BaseCurrency:   base,
+			MinTradeSize:   f.script.MinTradeSizes[marketSummary.MarketName],
+			MarketName:     marketSummary.MarketName,
+			IsActive:       true,
+		})
+	}
+	return markets
+}
+
+// marketsV3 lists the markets the v3 way, with the scripted rate precision
+// or the default.
+func (f *fakeBittrex) marketsV3() []bittrexMarketV3 {
+	markets := f.markets()
+	output := make([]bittrexMarketV3, 0, len(markets))
+	for _, market := range markets {
+		precision, scripted := f.script.RatePrecisions[market.MarketName]
+		if !scripted {
+			precision = ratePrecision
+		}
+		output = append(output, bittrexMarketV3{
+			Symbol:              getMarketName(market.MarketCurrency, market.BaseCurrency),
+			BaseCurrencySymbol:  market.MarketCurrency,
+			QuoteCurrencySymbol: market.BaseCurrency,
+			Precision:           precision,
+		})
+	}
+	return output
+}
+
+func (f *fakeBittrex) currencies() []bittrex.Currency {
+	seen := make(map[string]bool)
+	currencies := make([]bittrex.Currency, 0)
+	for _, market := range f.markets() {
+		for _, name := range []string{market.BaseCurrency, market.MarketCurrency} {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			currencies = append(currencies, bittrex.Currency{
+				Currency: name,
+				TxFee:    f.script.WithdrawalFees[name],
+				IsActive: true,
+			})
+		}
+	}
+	return currencies
+}
+
+// discardResponse takes the answer to a call that executes before failing,
+// which the client never sees.
+type discardResponse struct {
+	header http.Header
+}
+
+func (d discardResponse) Header() http.Header { return d.header }
+
+func (d discardResponse) Write(data []byte) (int, error) { return len(data), nil }
+
+func (d discardResponse) WriteHeader(status int) {}
+
+// writeBittrex answers in the envelope every Bittrex endpoint uses.
+func writeBittrex(w http.ResponseWriter, result interface{}, err error) {
+	response := struct {
+		Success bool        `json:"success"`
+		Message string      `json:"message"`
+		Result  interface{} `json:"result"`
+	}{Success: err == nil, Result: result}
+	if err != nil {
+		response.Message = err.Error()
+		response.Result = nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if encodeErr := json.NewEncoder(w).Encode(response); encodeErr != nil {
+		logger.error("could not write fake bittrex response", field("err", encodeErr))
+	}
+}
+
+/* ******************************************************************
+ * Serving
+ * *****************************************************************/
+
+// fakeServer serves a fakeBittrex on a local port.
+type fakeServer struct {
+	url    *url.URL
+	server *http.Server
+}
+
+func startFakeServer(fake *fakeBittrex) (*fakeServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("could not start fake bittrex : %v", err)
+	}
+	server := &http.Server{Handler: fake}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.error("fake bittrex stopped", field("err", err))
+		}
+	}()
+	return &fakeServer{
+		url:    &url.URL{Scheme: "http", Host: listener.Addr().String()},
+		server: server,
+	}, nil
+}
+
+func (s *fakeServer) Close() error {
+	return s.server.Close()
+}
+
+// redirectTransport sends every request to target instead of the host the
+// vendored client asked for, which it cannot be told.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	redirected := r.Clone(r.Context())
+	redirected.URL.Scheme = t.target.Scheme
+	redirected.URL.Host = t.target.Host
+	redirected.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(redirected)
+}
+
+func (s *fakeServer) transport() http.RoundTripper {
+	return redirectTransport{target: s.url}
+}
+
+// client builds the real Bittrex client, talking to the fake.
+func (s *fakeServer) client(key string, secret string) *bittrexExchange {
+	return newRestOnlyExchange(key, secret, s.transport())
+}
+
+// startDemo serves the script on a fake Bittrex that takes demoKey and
+// demoSecret.
+func startDemo(path string) (*fakeServer, error) {
+	script, err := loadFakeScript(path)
+	if err != nil {
+		return nil, err
+	}
+	fake, err := newFakeBittrex(script, demoKey, demoSecret)
+	if err != nil {
+		return nil, err
+	}
+	server, err := startFakeServer(fake)
+	if err != nil {
+		return nil, err
+	}
+	logger.info("serving fake bittrex", field("script", path), field("url", server.url.String()))
+	return server, nil
+}
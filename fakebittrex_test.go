@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// startTestBittrex serves testSummaries with no fees on a fake Bittrex
+// holding balances, and trades live through the real client talking to it.
+func startTestBittrex(t *testing.T, balances map[string]decimal.Decimal) (*fakeBittrex, *bittrexExchange, func()) {
+	t.Helper()
+	setupTest(t)
+	fees = newFeeModel(feeConfig{})
+	live = true
+	fake, err := newFakeBittrex(fakeScript{Summaries: testSummaries(), Balances: balances}, demoKey, demoSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := startFakeServer(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.client(demoKey, demoSecret)
+	activeExchange = client
+	if err := acctBalance.updateAccountBalances(client); err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return fake, client, func() { server.Close() }
+}
+
+// runTestRoute trades the default stake of BTC through ETH and USDT.
+func runTestRoute(t *testing.T, client *bittrexExchange) routeOutcome {
+	t.Helper()
+	summaries, err := client.GetMarketSummaries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := newMarketView(summaries, time.Now())
+	return view.executeRoute("route-1", []string{"BTC", "ETH", "USDT"}, validOrigins[exchangeName]["BTC"], client)
+}
+
+// assertBalance checks what the fake holds of currency, read through the API.
+func assertBalance(t *testing.T, client *bittrexExchange, currency string, want string) {
+	t.Helper()
+	balances, err := client.GetBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := decimal.Zero
+	for _, balance := range balances {
+		if balance.Currency == currency {
+			held = balance.Available
+		}
+	}
+	assertDecimal(t, currency+" balance", held, want)
+}
+
+func TestFakeBittrexProfitableRoute(t *testing.T) {
+	_, client, stop := startTestBittrex(t, map[string]decimal.Decimal{"BTC": dec("1")})
+	defer stop()
+	outcome := runTestRoute(t, client)
+	if !outcome.Complete || len(outcome.Legs) != 3 {
+		t.Fatalf("route complete %v after %v legs, want complete after 3", outcome.Complete, len(outcome.Legs))
+	}
+	// 0.005 BTC buys 0.1 ETH, sold for 51.1 USDT, which buys 0.00511 BTC.
+	assertDecimal(t, "result", outcome.Result, "0.00511")
+	assertBalance(t, client, "BTC", "1.00011")
+	assertBalance(t, client, "ETH", "0")
+}
+
+func TestFakeBittrexPartialFill(t *testing.T) {
+	fake, client, stop := startTestBittrex(t, map[string]decimal.Decimal{"BTC": dec("1")})
+	defer stop()
+	fake.setOrderBook("BTC-ETH", thinBTCETH)
+	outcome := runTestRoute(t, client)
+	if outcome.Complete || len(outcome.Legs) != 1 {
+		t.Fatalf("route complete %v after %v legs, want aborted after 1", outcome.Complete, len(outcome.Legs))
+	}
+	// Only 0.04 ETH is offered, for 0.002 BTC. The order is canceled with the
+	// rest open and the 0.04 ETH sold back at 0.0499.
+	leg := outcome.Legs[0]
+	assertDecimal(t, "spent", leg.Spent, "0.002")
+	assertDecimal(t, "received", leg.Received, "0.04")
+	assertDecimal(t, "result", outcome.Result, "0.004996")
+	assertBalance(t, client, "BTC", "0.999996")
+	assertBalance(t, client, "ETH", "0")
+}
+
+func TestFakeBittrexAPIError(t *testing.T) {
+	fake, client, stop := startTestBittrex(t, map[string]decimal.Decimal{"BTC": dec("1")})
+	defer stop()
+	fake.fail(fakeError{Endpoint: "selllimit", Message: "INSUFFICIENT_FUNDS"})
+	outcome := runTestRoute(t, client)
+	if outcome.Complete || len(outcome.Legs) != 2 {
+		t.Fatalf("route complete %v after %v legs, want aborted after 2", outcome.Complete, len(outcome.Legs))
+	}
+	if leg := outcome.Legs[1]; leg.OrderId != "" {
+		t.Errorf("rejected sell placed %v", leg.OrderId)
+	}
+	// The 0.1 ETH the first leg bought is sold back at 0.0499.
+	assertDecimal(t, "result", outcome.Result, "0.00499")
+	assertBalance(t, client, "BTC", "0.99999")
+	assertBalance(t, client, "ETH", "0")
+}
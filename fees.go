@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/shopspring/decimal"
+)
+
+type feeRates struct {
+	Maker decimal.Decimal `json:"maker"`
+	Taker decimal.Decimal `json:"taker"`
+}
+
+// feeConfig is the fee schedule of one exchange. A market's rates are looked
+// up in Markets first, then in the account's Tier, then fall back to
+// Maker/Taker.
+type feeConfig struct {
+	Maker   decimal.Decimal     `json:"maker"`
+	Taker   decimal.Decimal     `json:"taker"`
+	Tier    string              `json:"tier"`
+	Tiers   map[string]feeRates `json:"tiers"`
+	Markets map[string]feeRates `json:"markets"`
+}
+
+// feeModel prices trades per market.
+// Bittrex charges trade commission in the base currency: on top of the price
+// for buys and out of the proceeds for sells.
+type feeModel struct {
+	lock     sync.RWMutex
+	defaults feeRates
+	markets  map[string]feeRates
+}
+
+func newFeeModel(schedule feeConfig) *feeModel {
+	defaults := feeRates{Maker: schedule.Maker, Taker: schedule.Taker}
+	if tier, hasTier := schedule.Tiers[schedule.Tier]; hasTier {
+		defaults = tier
+	}
+	markets := make(map[string]feeRates, len(schedule.Markets))
+	for market, rates := range schedule.Markets {
+		markets[market] = rates
+	}
+	return &feeModel{
+		defaults: defaults,
+		markets:  markets,
+	}
+}
+
+func (f *feeModel) rates(market string) feeRates {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if rates, exists := f.markets[market]; exists {
+		return rates
+	}
+	return f.defaults
+}
+
+// taker is charged on orders that cross the book, which is every order
+// transfer places since it trades at the quoted Ask or Bid.
+func (f *feeModel) taker(market string) decimal.Decimal {
+	return f.rates(market).Taker
+}
+
+// maker is charged on the part of an order that rested on the book first.
+func (f *feeModel) maker(market string) decimal.Decimal {
+	return f.rates(market).Maker
+}
+
+// afterBuyFee is how much of input, in the base of market, is left to pay the
+// price with once the taker commission is added on top.
+func afterBuyFee(market string, input decimal.Decimal) decimal.Decimal {
+	return input.Div(decimal.NewFromFloat(1).Add(fees.taker(market)))
+}
+
+// afterSellFee is what proceeds, in the base of market, come to after the
+// taker commission is taken out.
+func afterSellFee(market string, proceeds decimal.Decimal) decimal.Decimal {
+	return proceeds.Sub(proceeds.Mul(fees.taker(market)))
+}
+
+// afterTradeFee charges input for trading it into outputName on whichever
+// market joins the two coins.
+func (v *marketView) afterTradeFee(inputName string, outputName string, input decimal.Decimal) decimal.Decimal {
+	if market := getMarketName(inputName, outputName); v.marketNames[market] {
+		return afterBuyFee(market, input)
+	}
+	return afterSellFee(getMarketName(outputName, inputName), input)
+}
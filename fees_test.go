@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFeeModelRates(t *testing.T) {
+	schedule := feeConfig{
+		Maker: dec("0.002"),
+		Taker: dec("0.003"),
+		Tier:  "vip",
+		Tiers: map[string]feeRates{
+			"vip":  {Maker: dec("0.001"), Taker: dec("0.0015")},
+			"base": {Maker: dec("0.0025"), Taker: dec("0.0025")},
+		},
+		Markets: map[string]feeRates{"USDT-BTC": {Maker: dec("0"), Taker: dec("0.0005")}},
+	}
+	tests := []struct {
+		name   string
+		tier   string
+		market string
+		maker  string
+		taker  string
+	}{
+		{"account tier", "vip", "BTC-ETH", "0.001", "0.0015"},
+		{"market over tier", "vip", "USDT-BTC", "0", "0.0005"},
+		{"other tier", "base", "BTC-ETH", "0.0025", "0.0025"},
+		{"unknown tier", "gold", "BTC-ETH", "0.002", "0.003"},
+		{"no tier", "", "USDT-ETH", "0.002", "0.003"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tiered := schedule
+			tiered.Tier = test.tier
+			model := newFeeModel(tiered)
+			assertDecimal(t, "maker", model.maker(test.market), test.maker)
+			assertDecimal(t, "taker", model.taker(test.market), test.taker)
+		})
+	}
+}
+
+func TestAfterTradeFee(t *testing.T) {
+	setupTest(t)
+	fees = newFeeModel(feeConfig{
+		Taker:   dec("0.0025"),
+		Markets: map[string]feeRates{"USDT-BTC": {Taker: dec("0.001")}},
+	})
+	view := newMarketView(testSummaries(), time.Now())
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		amount string
+		want   string
+	}{
+		// Buys pay the commission on top, so less is left to spend.
+		{"buy", "BTC", "ETH", "1.0025", "1"},
+		{"buy at the market's rate", "USDT", "BTC", "10.01", "10"},
+		// Sells pay it out of the proceeds.
+		{"sell", "ETH", "BTC", "0.1", "0.09975"},
+		{"sell at the market's rate", "BTC", "USDT", "50", "49.95"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertDecimal(t, "after fee", view.afterTradeFee(test.input, test.output, dec(test.amount)), test.want)
+		})
+	}
+}
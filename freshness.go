@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/toorop/go-bittrex"
+)
+
+// freshnessConfig keeps routes off quotes that are too old to trade on.
+// Durations are written like 30s, and a limit left out is no limit.
+type freshnessConfig struct {
+	// MaxAge is how long before now a quote may have been received.
+	MaxAge string `json:"maxAge"`
+	// MaxSkew is how far apart the quotes of a route's legs may have been
+	// received.
+	MaxSkew string `json:"maxSkew"`
+}
+
+func (f freshnessConfig) validate() []string {
+	problems := make([]string, 0)
+	for label, value := range map[string]string{"maxAge": f.MaxAge, "maxSkew": f.MaxSkew} {
+		if value == "" {
+			continue
+		}
+		if limit, err := time.ParseDuration(value); err != nil || limit <= 0 {
+			problems = append(problems, fmt.Sprintf("freshness: %v %q must be a positive duration such as 30s", label, value))
+		}
+	}
+	return problems
+}
+
+// limits are the durations the config allows, zero for those it leaves out.
+func (f freshnessConfig) limits() (time.Duration, time.Duration) {
+	var maxAge, maxSkew time.Duration
+	if f.MaxAge != "" {
+		maxAge, _ = time.ParseDuration(f.MaxAge)
+	}
+	if f.MaxSkew != "" {
+		maxSkew, _ = time.ParseDuration(f.MaxSkew)
+	}
+	return maxAge, maxSkew
+}
+
+// parseQuoteTime reads the UTC time an exchange stamped a market summary
+// with, zero when it is missing or unreadable.
+func parseQuoteTime(stamp string) time.Time {
+	if stamp == "" {
+		return time.Time{}
+	}
+	parsed, err := time.ParseInLocation(bittrex.TIME_FORMAT, stamp, time.UTC)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
+
+// age is how long before now the quote was received. The exchange's stamp
+// is left out: our clock running ahead of the exchange's would age every
+// quote by the difference and reject fresh ones.
+func (r Relationship) age(now time.Time) time.Duration {
+	if r.Received.IsZero() {
+		return 0
+	}
+	if age := now.Sub(r.Received); age > 0 {
+		return age
+	}
+	return 0
+}
+
+// now is the time the view's quotes are aged at. A replayed view ages them
+// as of when it was recorded, so backtests see quotes as fresh as they were.
+func (v *marketView) now() time.Time {
+	if v.replayed {
+		return v.received
+	}
+	return time.Now()
+}
+
+// checkFreshness says why the quotes, keyed by market, are too old or were
+// received too far apart to trade on together.
+func checkFreshness(quotes map[string]Relationship, now time.Time) error {
+	markets := make([]string, 0, len(quotes))
+	for market := range quotes {
+		markets = append(markets, market)
+	}
+	sort.Strings(markets)
+	var oldest, newest time.Time
+	for _, market := range markets {
+		quote := quotes[market]
+		if age := quote.age(now); maxQuoteAge > 0 && age > maxQuoteAge {
+			return fmt.Errorf("%v quote is %v old, the limit is %v", market, age.Round(time.Millisecond), maxQuoteAge)
+		}
+		if quote.Received.IsZero() {
+			continue
+		}
+		if oldest.IsZero() || quote.Received.Before(oldest) {
+			oldest = quote.Received
+		}
+		if newest.IsZero() || quote.Received.After(newest) {
+			newest = quote.Received
+		}
+	}
+	if skew := newest.Sub(oldest); maxQuoteSkew > 0 && skew > maxQuoteSkew {
+		return fmt.Errorf("quotes of %v were received %v apart, the limit is %v", strings.Join(markets, ", "), skew.Round(time.Millisecond), maxQuoteSkew)
+	}
+	return nil
+}
+
+// routeFreshness checks the quotes of every market the route trades on.
+func (v *marketView) routeFreshness(route []string) error {
+	if maxQuoteAge <= 0 && maxQuoteSkew <= 0 {
+		return nil
+	}
+	quotes := make(map[string]Relationship, len(route))
+	for index := 0; index+1 < len(route); index++ {
+		if _, exists := v.coins[route[index]]; !exists {
+			continue
+		}
+		if _, exists := v.coins[route[index+1]]; !exists {
+			continue
+		}
+		market, _, _ := v.tradeSide(route[index], route[index+1])
+		base, currency := splitMarketName(market)
+		if relationship, exists := v.coins[currency].Relationships[base]; exists {
+			quotes[market] = relationship
+		}
+	}
+	return checkFreshness(quotes, v.now())
+}
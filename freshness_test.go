@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckFreshness(t *testing.T) {
+	now := time.Now()
+	ago := func(duration time.Duration) time.Time { return now.Add(-duration) }
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		skew   time.Duration
+		quotes map[string]Relationship
+		err    string
+	}{
+		{
+			name:   "fresh",
+			maxAge: 30 * time.Second, skew: 5 * time.Second,
+			quotes: map[string]Relationship{"BTC-ETH": {Received: ago(time.Second)}, "USDT-ETH": {Received: ago(2 * time.Second)}},
+		},
+		{
+			name:   "stale quote",
+			maxAge: 30 * time.Second,
+			quotes: map[string]Relationship{"BTC-ETH": {Received: ago(time.Second)}, "USDT-ETH": {Received: ago(2 * time.Minute)}},
+			err:    "USDT-ETH quote is 2m0s old",
+		},
+		{
+			name: "excessive skew",
+			skew: 5 * time.Second,
+			quotes: map[string]Relationship{
+				"BTC-ETH":  {Received: ago(time.Second)},
+				"USDT-BTC": {Received: ago(4 * time.Second)},
+				"USDT-ETH": {Received: ago(11 * time.Second)},
+			},
+			err: "received 10s apart",
+		},
+		{
+			name:   "local clock ahead of the exchange's",
+			maxAge: 30 * time.Second,
+			quotes: map[string]Relationship{"BTC-ETH": {Timestamp: ago(5 * time.Minute), Received: ago(time.Second)}},
+		},
+		{
+			name:   "no limits",
+			quotes: map[string]Relationship{"BTC-ETH": {Received: ago(time.Hour)}, "USDT-ETH": {Received: ago(time.Second)}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			maxQuoteAge, maxQuoteSkew = test.maxAge, test.skew
+			err := checkFreshness(test.quotes, now)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("err = %v, want none", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("err = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestRouteFreshnessOfReplayedView(t *testing.T) {
+	setupTest(t)
+	maxQuoteAge = 30 * time.Second
+	route := []string{"BTC", "ETH", "USDT", "BTC"}
+	recorded := time.Now().Add(-time.Hour)
+
+	view := newMarketView(testSummaries(), recorded)
+	if err := view.routeFreshness(route); err == nil {
+		t.Error("hour old quotes traded on")
+	}
+	view.replayed = true
+	if err := view.routeFreshness(route); err != nil {
+		t.Errorf("replayed quotes aged past when they were recorded: %v", err)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Journal entry kinds. Every route gets a decision, then an order and status
+// entries for each order it placed, then an outcome unless it was blocked.
+// An interrupted outcome is followed by the orders and outcome of settling it.
+const (
+	entryDecision = "decision"
+	entryOrder    = "order"
+	entryStatus   = "status"
+	entryOutcome  = "outcome"
+)
+
+type journalEntry struct {
+	Time     time.Time        `json:"time"`
+	Kind     string           `json:"kind"`
+	RouteId  string           `json:"routeId,omitempty"`
+	Decision *journalDecision `json:"decision,omitempty"`
+	Order    *journalOrder    `json:"order,omitempty"`
+	Status   *bittrex.Order2  `json:"status,omitempty"`
+	Outcome  *journalOutcome  `json:"outcome,omitempty"`
+}
+
+type journalDecision struct {
+	Path         []string        `json:"path"`
+	Stake        decimal.Decimal `json:"stake"`
+	ExpectedGain decimal.Decimal `json:"expectedGain"`
+	Paper        bool            `json:"paper"`
+	// Venues are the exchanges a spatial route buys and sells on.
+	Venues []string `json:"venues,omitempty"`
+	// Blocked is why the risk manager refused the route, empty when it traded.
+	Blocked string `json:"blocked,omitempty"`
+}
+
+type journalOrder struct {
+	OrderId   string          `json:"orderId"`
+	Market    string          `json:"market"`
+	LimitType string          `json:"limitType"`
+	Quantity  decimal.Decimal `json:"quantity"`
+	Rate      decimal.Decimal `json:"rate"`
+	Err       string          `json:"err,omitempty"`
+}
+
+type journalOutcome struct {
+	Path     []string                   `json:"path"`
+	Stake    decimal.Decimal            `json:"stake"`
+	Result   decimal.Decimal            `json:"result"`
+	Complete bool                       `json:"complete"`
+	Legs     []legFill                  `json:"legs"`
+	Stranded map[string]decimal.Decimal `json:"stranded,omitempty"`
+	Paper    bool                       `json:"paper"`
+	// Interrupted routes are settled by reconcile on the next start.
+	Interrupted bool `json:"interrupted,omitempty"`
+	// Pnl includes stranded coins and is valued in Currency when the route
+	// finished, Valued is false when there was no price to do it with.
+	Pnl      decimal.Decimal `json:"pnl"`
+	Currency string          `json:"currency"`
+	Valued   bool            `json:"valued"`
+}
+
+// tradeJournal keeps every entry in a bbolt database, one bucket per route
+// under journalBucket. Entries are keyed by a sequence shared by all routes so
+// they read back in the order they were written, and every write is its own
+// synced transaction. The database is only open, and locked, while an entry
+// is written or read, so the journal command can report while a trade runs.
+// Every method is a no-op on a nil journal.
+type tradeJournal struct {
+	lock sync.Mutex
+	path string
+}
+
+// openJournal checks the journal can be written, creating it if needed.
+func openJournal(path string) (*tradeJournal, error) {
+	db, err := openJournalDB(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Close(); err != nil {
+		return nil, fmt.Errorf("could not open journal : %v", err)
+	}
+	return &tradeJournal{path: path}, nil
+}
+
+// openJournalDB waits journalLockTimeout for whoever is writing or reading
+// the journal to let go of it.
+func openJournalDB(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: journalLockTimeout, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("journal %v is in use by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open journal : %v", err)
+	}
+	return db, nil
+}
+
+func (j *tradeJournal) write(entry journalEntry) {
+	if j == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	db, err := openJournalDB(j.path, false)
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			return putJournalEntry(tx, entry)
+		})
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		logger.error("could not write journal", field("path", j.path), field("kind", entry.Kind), field("err", err))
+	}
+}
+
+func putJournalEntry(tx *bolt.Tx, entry journalEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	routes, err := tx.CreateBucketIfNotExists(journalBucket)
+	if err != nil {
+		return err
+	}
+	routeId := entry.RouteId
+	if routeId == "" {
+		routeId = "-"
+	}
+	route, err := routes.CreateBucketIfNotExists([]byte(routeId))
+	if err != nil {
+		return err
+	}
+	sequence, err := routes.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return route.Put(key, value)
+}
+
+// entries reads back every entry in the order it was written. Entries that
+// can't be decoded are logged and skipped.
+func (j *tradeJournal) entries() ([]journalEntry, error) {
+	type sequenced struct {
+		sequence uint64
+		entry    journalEntry
+	}
+	if _, err := os.Stat(j.path); err != nil {
+		return nil, err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	db, err := openJournalDB(j.path, true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	read := make([]sequenced, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		routes := tx.Bucket(journalBucket)
+		if routes == nil {
+			return nil
+		}
+		return routes.ForEach(func(routeId []byte, _ []byte) error {
+			route := routes.Bucket(routeId)
+			if route == nil {
+				return nil
+			}
+			return route.ForEach(func(key []byte, value []byte) error {
+				var entry journalEntry
+				if err := json.Unmarshal(value, &entry); err != nil || len(key) != 8 {
+					logger.warn("skipping unreadable journal entry", field("path", j.path), field("route", string(routeId)), field("err", err))
+					return nil
+				}
+				read = append(read, sequenced{sequence: binary.BigEndian.Uint64(key), entry: entry})
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(read, func(aIndex, bIndex int) bool {
+		return read[aIndex].sequence < read[bIndex].sequence
+	})
+	entries := make([]journalEntry, len(read))
+	for index := range read {
+		entries[index] = read[index].entry
+	}
+	return entries, nil
+}
+
+func (j *tradeJournal) decision(routeId string, path []string, stake decimal.Decimal, expectedGain decimal.Decimal, blocked error) {
+	j.venueDecision(routeId, path, nil, stake, expectedGain, blocked)
+}
+
+func (j *tradeJournal) venueDecision(routeId string, path []string, venues []string, stake decimal.Decimal, expectedGain decimal.Decimal, blocked error) {
+	decision := &journalDecision{
+		Path:         path,
+		Stake:        stake,
+		ExpectedGain: expectedGain,
+		Paper:        paperTrading,
+		Venues:       venues,
+	}
+	if blocked != nil {
+		decision.Blocked = blocked.Error()
+	}
+	j.write(journalEntry{Kind: entryDecision, RouteId: routeId, Decision: decision})
+}
+
+func (j *tradeJournal) order(tracked trackedOrder) {
+	order := &journalOrder{
+		OrderId:   tracked.OrderId,
+		Market:    tracked.Market,
+		LimitType: tracked.LimitType,
+		Quantity:  tracked.Quantity,
+		Rate:      tracked.Rate,
+	}
+	if tracked.Err != nil {
+		order.Err = tracked.Err.Error()
+	}
+	j.write(journalEntry{Kind: entryOrder, RouteId: tracked.RouteId, Order: order})
+}
+
+func (j *tradeJournal) status(routeId string, order bittrex.Order2) {
+	j.write(journalEntry{Kind: entryStatus, RouteId: routeId, Status: &order})
+}
+
+func (j *tradeJournal) outcome(v *marketView, routeId string, stake decimal.Decimal, outcome routeOutcome) {
+	pnl, valued := v.outcomePnl(outcome.Path[0], risk.limits.Currency, stake, outcome)
+	j.write(journalEntry{Kind: entryOutcome, RouteId: routeId, Outcome: &journalOutcome{
+		Path:        outcome.Path,
+		Stake:       stake,
+		Result:      outcome.Result,
+		Complete:    outcome.Complete,
+		Legs:        outcome.Legs,
+		Stranded:    outcome.Stranded,
+		Paper:       paperTrading,
+		Interrupted: outcome.Interrupted,
+		Pnl:         pnl,
+		Currency:    risk.limits.Currency,
+		Valued:      valued,
+	}})
+}
+
+// Close is kept for symmetry with openJournal, nothing stays open between
+// entries.
+func (j *tradeJournal) Close() error {
+	return nil
+}
+
+var routeSequence int64
+
+// newRouteId is unique within the journal as long as the clock does not go
+// backwards between restarts.
+func newRouteId() string {
+	return "route-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatInt(atomic.AddInt64(&routeSequence, 1), 10)
+}
+
+// readJournal reads every entry of the journal at path.
+func readJournal(path string) ([]journalEntry, error) {
+	return (&tradeJournal{path: path}).entries()
+}
+
+/* ******************************************************************
+ * P&L Report
+ * *****************************************************************/
+
+// Ways the journal command groups realized P&L.
+const (
+	groupRoute  = "route"
+	groupVessel = "vessel"
+	groupDay    = "day"
+)
+
+type pnlGroup struct {
+	Routes   int
+	Complete int
+	Wins     int
+	Unvalued int
+	Pnl      decimal.Decimal
+	Currency string
+	// Gains is the result less the stake, in each origin coin
+	Gains map[string]decimal.Decimal
+}
+
+// groupKey names the group an outcome falls in. The vessel is every coin
+// the route passed through between its origins, or the coin a spatial route
+// bought and sold.
+func groupKey(entry journalEntry, by string) string {
+	path := entry.Outcome.Path
+	switch by {
+	case groupVessel:
+		vessels := path[1 : len(path)-1]
+		if len(vessels) == 0 {
+			vessels = path[1:]
+		}
+		return strings.Join(vessels, ",")
+	case groupDay:
+		return entry.Time.UTC().Format("2006-01-02")
+	}
+	return strings.Join(append(append([]string{}, path...), path[0]), " -> ")
+}
+
+// journalPnl totals the outcomes traded live, or on paper with paper set.
+// Interrupted outcomes are left out, the outcome that settled them counts.
+func journalPnl(entries []journalEntry, by string, paper bool) map[string]*pnlGroup {
+	groups := make(map[string]*pnlGroup)
+	for _, entry := range entries {
+		if entry.Kind != entryOutcome || entry.Outcome == nil || entry.Outcome.Interrupted || entry.Outcome.Paper != paper || len(entry.Outcome.Path) < 2 {
+			continue
+		}
+		key := groupKey(entry, by)
+		group, exists := groups[key]
+		if !exists {
+			group = &pnlGroup{Pnl: decimal.Zero, Gains: make(map[string]decimal.Decimal)}
+			groups[key] = group
+		}
+		outcome := entry.Outcome
+		group.Routes++
+		if outcome.Complete {
+			group.Complete++
+		}
+		gain := outcome.Result.Sub(outcome.Stake)
+		if gain.GreaterThan(decimal.Zero) {
+			group.Wins++
+		}
+		origin := outcome.Path[0]
+		group.Gains[origin] = group.Gains[origin].Add(gain)
+		if outcome.Valued {
+			group.Pnl = group.Pnl.Add(outcome.Pnl)
+			group.Currency = outcome.Currency
+		} else {
+			group.Unvalued++
+		}
+	}
+	return groups
+}
+
+func runJournal(args []string) int {
+	flags := newFlagSet("journal", "[flags]")
+	configPath := flags.String("config", os.Getenv("CHAINGANG_CONFIG"), "config file naming the journal")
+	path := flags.String("journal", "", "journal file, defaults to the configured one")
+	by := flags.String("by", groupRoute+","+groupVessel+","+groupDay, "group realized P&L by route, vessel and/or day, comma separated")
+	paper := flags.Bool("paper", false, "report paper trades instead of live ones")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	groupings := strings.Split(*by, ",")
+	for _, grouping := range groupings {
+		if grouping != groupRoute && grouping != groupVessel && grouping != groupDay {
+			fmt.Fprintf(os.Stderr, "--by must list %v, %v or %v\n", groupRoute, groupVessel, groupDay)
+			return exitUsage
+		}
+	}
+
+	if *path == "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return fail(err)
+		}
+		*path = cfg.Journal
+	}
+	if *path == "" {
+		return fail(errors.New("no journal: pass --journal or set journal in the config"))
+	}
+	entries, err := readJournal(*path)
+	if err != nil {
+		return fail(err)
+	}
+
+	for _, grouping := range groupings {
+		groups := journalPnl(entries, grouping, *paper)
+		keys := make([]string, 0, len(groups))
+		for key := range groups {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		logger.info("journal", field("path", *path), field("by", grouping), field("paper", *paper), field("groups", len(keys)))
+		for _, key := range keys {
+			group := groups[key]
+			origins := make([]string, 0, len(group.Gains))
+			for origin := range group.Gains {
+				origins = append(origins, origin)
+			}
+			sort.Strings(origins)
+			gains := make([]string, 0, len(origins))
+			for _, origin := range origins {
+				gains = append(gains, group.Gains[origin].String()+" "+origin)
+			}
+			logger.info("journal pnl", field(grouping, key), field("routes", group.Routes), field("complete", group.Complete), field("wins", group.Wins), field("gain", strings.Join(gains, ", ")), field("pnl", group.Pnl.StringFixed(4)), field("currency", group.Currency), field("unvalued", group.Unvalued))
+		}
+	}
+	return exitOK
+}
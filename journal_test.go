@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempJournalPath(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "chaingang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "journal.db"), func() { os.RemoveAll(dir) }
+}
+
+func journalRouteIds(entries []journalEntry) []string {
+	routeIds := make([]string, len(entries))
+	for index, entry := range entries {
+		routeIds[index] = entry.RouteId
+	}
+	return routeIds
+}
+
+func assertRouteIds(t *testing.T, entries []journalEntry, want ...string) {
+	t.Helper()
+	got := journalRouteIds(entries)
+	if len(got) != len(want) {
+		t.Fatalf("route ids = %v, want %v", got, want)
+	}
+	for index := range want {
+		if got[index] != want[index] {
+			t.Fatalf("route ids = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestJournalKeepsWriteOrder(t *testing.T) {
+	setupTest(t)
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+
+	journal, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path3 := []string{"BTC", "ETH", "USDT"}
+	journal.decision("route-1", path3, dec("0.005"), dec("0.0001"), nil)
+	journal.decision("route-2", path3, dec("0.005"), dec("0.0001"), nil)
+	journal.order(trackedOrder{RouteId: "route-1", OrderId: "order-1", Market: "BTC-ETH", LimitType: "buy"})
+	journal.order(trackedOrder{OrderId: "order-2", Market: "BTC-ETH", LimitType: "sell"})
+	entries, err := journal.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRouteIds(t, entries, "route-1", "route-2", "route-1", "")
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = readJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRouteIds(t, entries, "route-1", "route-2", "route-1", "")
+	if entries[2].Kind != entryOrder || entries[2].Order.OrderId != "order-1" {
+		t.Errorf("third entry = %+v, want order-1", entries[2])
+	}
+}
+
+func TestReadJournalWhileTrading(t *testing.T) {
+	setupTest(t)
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+
+	journal, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	path3 := []string{"BTC", "ETH", "USDT"}
+	journal.decision("route-1", path3, dec("0.005"), dec("0.0001"), nil)
+	entries, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("could not read the journal of a running trade: %v", err)
+	}
+	assertRouteIds(t, entries, "route-1")
+	journal.decision("route-2", path3, dec("0.005"), dec("0.0001"), nil)
+	if entries, err = readJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	assertRouteIds(t, entries, "route-1", "route-2")
+
+	if _, err := readJournal(path + ".missing"); !os.IsNotExist(err) {
+		t.Errorf("reading a missing journal = %v, want not exist", err)
+	}
+}
+
+func TestJournalPnl(t *testing.T) {
+	day := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	outcome := func(at time.Time, path []string, result string, pnl string, change func(*journalOutcome)) journalEntry {
+		entry := journalEntry{Time: at, Kind: entryOutcome, Outcome: &journalOutcome{
+			Path:     path,
+			Stake:    dec("0.005"),
+			Result:   dec(result),
+			Complete: true,
+			Pnl:      dec(pnl),
+			Currency: "USDT",
+			Valued:   true,
+		}}
+		if change != nil {
+			change(entry.Outcome)
+		}
+		return entry
+	}
+	entries := []journalEntry{
+		{Time: day, Kind: entryDecision, RouteId: "route-1"},
+		outcome(day, []string{"BTC", "ETH", "USDT"}, "0.0051", "1", nil),
+		outcome(day, []string{"BTC", "LTC", "USDT"}, "0.0049", "-1", func(o *journalOutcome) { o.Complete = false }),
+		outcome(day.Add(24*time.Hour), []string{"BTC", "ETH", "USDT"}, "0.0052", "2", func(o *journalOutcome) { o.Valued = false }),
+		// a spatial route buys and sells ETH
+		outcome(day.Add(24*time.Hour), []string{"BTC", "ETH"}, "0.0053", "3", nil),
+		outcome(day, []string{"BTC", "ETH", "USDT"}, "0.004", "-10", func(o *journalOutcome) { o.Interrupted = true }),
+		outcome(day, []string{"BTC", "ETH", "USDT"}, "0.006", "10", func(o *journalOutcome) { o.Paper = true }),
+	}
+	tests := []struct {
+		by     string
+		groups map[string]pnlGroup
+	}{
+		{by: groupRoute, groups: map[string]pnlGroup{
+			"BTC -> ETH -> USDT -> BTC": {Routes: 2, Complete: 2, Wins: 2, Unvalued: 1, Pnl: dec("1")},
+			"BTC -> LTC -> USDT -> BTC": {Routes: 1, Complete: 0, Wins: 0, Pnl: dec("-1")},
+			"BTC -> ETH -> BTC":         {Routes: 1, Complete: 1, Wins: 1, Pnl: dec("3")},
+		}},
+		{by: groupVessel, groups: map[string]pnlGroup{
+			"ETH": {Routes: 3, Complete: 3, Wins: 3, Unvalued: 1, Pnl: dec("4")},
+			"LTC": {Routes: 1, Complete: 0, Wins: 0, Pnl: dec("-1")},
+		}},
+		{by: groupDay, groups: map[string]pnlGroup{
+			"2018-01-01": {Routes: 2, Complete: 1, Wins: 1, Pnl: dec("0")},
+			"2018-01-02": {Routes: 2, Complete: 2, Wins: 2, Unvalued: 1, Pnl: dec("3")},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.by, func(t *testing.T) {
+			groups := journalPnl(entries, test.by, false)
+			if len(groups) != len(test.groups) {
+				t.Errorf("%v groups, want %v", len(groups), len(test.groups))
+			}
+			for key, want := range test.groups {
+				got, exists := groups[key]
+				if !exists {
+					t.Errorf("no %v group", key)
+					continue
+				}
+				if got.Routes != want.Routes || got.Complete != want.Complete || got.Wins != want.Wins || got.Unvalued != want.Unvalued {
+					t.Errorf("%v: %v routes, %v complete, %v wins and %v unvalued, want %v, %v, %v and %v", key, got.Routes, got.Complete, got.Wins, got.Unvalued, want.Routes, want.Complete, want.Wins, want.Unvalued)
+				}
+				assertDecimal(t, key+" pnl", got.Pnl, want.Pnl.String())
+			}
+		})
+	}
+	if paper := journalPnl(entries, groupRoute, true); len(paper) != 1 || paper["BTC -> ETH -> USDT -> BTC"] == nil {
+		t.Errorf("paper groups = %v, want only the paper route", paper)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// Log formats: logfmt writes key=value pairs, json one object per line.
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+)
+
+const redacted = "[REDACTED]"
+
+// Fields with these keys are never written, whatever they hold.
+var secretFieldKeys = map[string]bool{
+	"key":    true,
+	"secret": true,
+	"apikey": true,
+}
+
+type logField struct {
+	Key   string
+	Value interface{}
+}
+
+func field(key string, value interface{}) logField {
+	return logField{Key: key, Value: value}
+}
+
+// logSink is shared by a logger and every logger derived from it with with.
+type logSink struct {
+	lock    sync.Mutex
+	output  io.Writer
+	level   logLevel
+	format  string
+	secrets []string
+}
+
+type structuredLogger struct {
+	sink   *logSink
+	fields []logField
+}
+
+func newLogger(output io.Writer, level logLevel, format string) *structuredLogger {
+	return &structuredLogger{
+		sink: &logSink{
+			output: output,
+			level:  level,
+			format: format,
+		},
+	}
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range logLevelNames {
+		if levelName == strings.ToLower(name) {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("log level %q must be debug, info, warn or error", name)
+}
+
+// configure switches level and format, for every logger sharing the sink.
+func (l *structuredLogger) configure(levelName string, format string) error {
+	level, err := parseLogLevel(levelName)
+	if err != nil {
+		return err
+	}
+	if format != logFormatLogfmt && format != logFormatJSON {
+		return fmt.Errorf("log format %q must be %v or %v", format, logFormatLogfmt, logFormatJSON)
+	}
+	l.sink.lock.Lock()
+	defer l.sink.lock.Unlock()
+	l.sink.level = level
+	l.sink.format = format
+	return nil
+}
+
+// redact replaces secret wherever it shows up in a message or field.
+func (l *structuredLogger) redact(secret string) {
+	if secret == "" {
+		return
+	}
+	l.sink.lock.Lock()
+	defer l.sink.lock.Unlock()
+	l.sink.secrets = append(l.sink.secrets, secret)
+}
+
+// with returns a logger that adds fields to everything it writes.
+func (l *structuredLogger) with(fields ...logField) *structuredLogger {
+	combined := make([]logField, 0, len(l.fields)+len(fields))
+	combined = append(combined, l.fields...)
+	combined = append(combined, fields...)
+	return &structuredLogger{sink: l.sink, fields: combined}
+}
+
+func (l *structuredLogger) debug(message string, fields ...logField) {
+	l.write(levelDebug, message, fields)
+}
+
+func (l *structuredLogger) info(message string, fields ...logField) {
+	l.write(levelInfo, message, fields)
+}
+
+func (l *structuredLogger) warn(message string, fields ...logField) {
+	l.write(levelWarn, message, fields)
+}
+
+func (l *structuredLogger) error(message string, fields ...logField) {
+	l.write(levelError, message, fields)
+}
+
+func (l *structuredLogger) write(level logLevel, message string, fields []logField) {
+	l.sink.lock.Lock()
+	defer l.sink.lock.Unlock()
+	if level < l.sink.level {
+		return
+	}
+
+	record := make([]logField, 0, len(l.fields)+len(fields)+3)
+	record = append(record, field("time", time.Now().UTC().Format(time.RFC3339Nano)), field("level", logLevelNames[level]), field("msg", message))
+	record = append(record, l.fields...)
+	record = append(record, fields...)
+
+	var line strings.Builder
+	if l.sink.format == logFormatJSON {
+		line.WriteString("{")
+		for index, recordField := range record {
+			if index > 0 {
+				line.WriteString(",")
+			}
+			key, _ := json.Marshal(recordField.Key)
+			line.Write(key)
+			line.WriteString(":")
+			line.WriteString(l.sink.jsonValue(recordField))
+		}
+		line.WriteString("}\n")
+	} else {
+		for index, recordField := range record {
+			if index > 0 {
+				line.WriteString(" ")
+			}
+			line.WriteString(recordField.Key)
+			line.WriteString("=")
+			line.WriteString(logfmtQuote(l.sink.textValue(recordField)))
+		}
+		line.WriteString("\n")
+	}
+	io.WriteString(l.sink.output, line.String())
+}
+
+func (s *logSink) textValue(recordField logField) string {
+	if secretFieldKeys[strings.ToLower(recordField.Key)] {
+		return redacted
+	}
+	var text string
+	switch value := recordField.Value.(type) {
+	case nil:
+		text = ""
+	case error:
+		text = value.Error()
+	case fmt.Stringer:
+		text = value.String()
+	case []string:
+		text = strings.Join(value, ",")
+	default:
+		text = fmt.Sprint(value)
+	}
+	return s.scrub(text)
+}
+
+func (s *logSink) jsonValue(recordField logField) string {
+	switch recordField.Value.(type) {
+	case bool, int, int32, int64, float64:
+		if !secretFieldKeys[strings.ToLower(recordField.Key)] {
+			encoded, _ := json.Marshal(recordField.Value)
+			return string(encoded)
+		}
+	}
+	encoded, _ := json.Marshal(s.textValue(recordField))
+	return string(encoded)
+}
+
+func (s *logSink) scrub(text string) string {
+	for _, secret := range s.secrets {
+		text = strings.Replace(text, secret, redacted, -1)
+	}
+	return text
+}
+
+func logfmtQuote(text string) string {
+	if text == "" || strings.ContainsAny(text, " =\"\t\n") {
+		return strconv.Quote(text)
+	}
+	return text
+}
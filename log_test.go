@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogRedactsSecrets(t *testing.T) {
+	for _, format := range []string{logFormatLogfmt, logFormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			var output bytes.Buffer
+			testLogger := newLogger(&output, levelInfo, format)
+			testLogger.redact("s3cr3t-sign")
+			testLogger.with(field("apikey", "k3y-123")).info("signed with s3cr3t-sign",
+				field("Secret", "s3cr3t-sign"),
+				field("key", 31337),
+				field("err", errors.New("bad apisign s3cr3t-sign")),
+				field("market", "BTC-ETH"))
+
+			line := output.String()
+			for _, secret := range []string{"k3y-123", "s3cr3t-sign"} {
+				if strings.Contains(line, secret) {
+					t.Errorf("%q written in %v", secret, line)
+				}
+			}
+			want := map[string]string{
+				"msg":    "signed with " + redacted,
+				"apikey": redacted,
+				"Secret": redacted,
+				"key":    redacted,
+				"err":    "bad apisign " + redacted,
+				"market": "BTC-ETH",
+			}
+			if format == logFormatJSON {
+				var record map[string]interface{}
+				if err := json.Unmarshal(output.Bytes(), &record); err != nil {
+					t.Fatalf("%v: %v", line, err)
+				}
+				for key, value := range want {
+					if record[key] != value {
+						t.Errorf("%v = %v, want %v", key, record[key], value)
+					}
+				}
+				return
+			}
+			for key, value := range want {
+				if pair := key + "=" + logfmtQuote(value); !strings.Contains(line, pair) {
+					t.Errorf("%v missing from %v", pair, line)
+				}
+			}
+		})
+	}
+}
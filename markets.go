@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// marketLimit is what an order on one market has to respect. Precisions are
+// the exchange defaults unless its market data lists them.
+type marketLimit struct {
+	Active            bool
+	MinTradeSize      decimal.Decimal
+	QuantityPrecision int32
+	RatePrecision     int32
+}
+
+// marketCatalog holds the limits of every market GetMarkets listed. Markets
+// it does not know are not checked.
+type marketCatalog struct {
+	lock   sync.RWMutex
+	limits map[string]marketLimit
+}
+
+func newMarketCatalog() *marketCatalog {
+	return &marketCatalog{
+		limits: make(map[string]marketLimit),
+	}
+}
+
+func (c *marketCatalog) set(markets []bittrex.Market) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, market := range markets {
+		c.limits[market.MarketName] = marketLimit{
+			Active:            market.IsActive,
+			MinTradeSize:      market.MinTradeSize,
+			QuantityPrecision: quantityPrecision,
+			RatePrecision:     ratePrecision,
+		}
+	}
+}
+
+// setRatePrecisions overrides the default rate precision of listed markets.
+func (c *marketCatalog) setRatePrecisions(precisions map[string]int32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for market, precision := range precisions {
+		if limit, exists := c.limits[market]; exists {
+			limit.RatePrecision = precision
+			c.limits[market] = limit
+		}
+	}
+}
+
+func (c *marketCatalog) get(market string) marketLimit {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if limit, exists := c.limits[market]; exists {
+		return limit
+	}
+	return marketLimit{
+		Active:            true,
+		MinTradeSize:      decimal.Zero,
+		QuantityPrecision: quantityPrecision,
+		RatePrecision:     ratePrecision,
+	}
+}
+
+// roundQuantity rounds down so an order never needs more than was planned.
+func (l marketLimit) roundQuantity(quantity decimal.Decimal) decimal.Decimal {
+	return quantity.Truncate(l.QuantityPrecision)
+}
+
+// roundRate rounds buy rates up and sell rates down so a rate quoted at the
+// Ask or Bid still crosses the book.
+func (l marketLimit) roundRate(rate decimal.Decimal, limitType string) decimal.Decimal {
+	rounded := rate.Truncate(l.RatePrecision)
+	if limitType == "buy" && rounded.LessThan(rate) {
+		rounded = rounded.Add(decimal.New(1, -l.RatePrecision))
+	}
+	return rounded
+}
+
+// check reports why quantity of the market currency cannot be ordered.
+func (l marketLimit) check(market string, quantity decimal.Decimal) error {
+	if !l.Active {
+		return fmt.Errorf("%v is not active", market)
+	}
+	if !quantity.GreaterThan(decimal.Zero) {
+		return fmt.Errorf("%v quantity rounds to zero", market)
+	}
+	if quantity.LessThan(l.MinTradeSize) {
+		return fmt.Errorf("%v quantity %v is below the minimum trade size %v", market, quantity, l.MinTradeSize)
+	}
+	return nil
+}
+
+type marketSource interface {
+	GetMarkets() ([]bittrex.Market, error)
+}
+
+// precisionSource is an exchange whose market data says how many decimal
+// places each market's rates take.
+type precisionSource interface {
+	GetMarketPrecisions() (map[string]int32, error)
+}
+
+// loadMarketLimits reads minimum trade sizes into catalog when the exchange
+// lists markets, and rate precisions when it lists those. Markets keep the
+// default precision when they can't be read.
+func loadMarketLimits(exchange Exchange, catalog *marketCatalog) error {
+	source, isSource := exchange.(marketSource)
+	if !isSource {
+		return nil
+	}
+	markets, err := source.GetMarkets()
+	if err != nil {
+		return fmt.Errorf("could not load markets : %v", err)
+	}
+	catalog.set(markets)
+	if source, isSource := exchange.(precisionSource); isSource {
+		precisions, err := source.GetMarketPrecisions()
+		if err != nil {
+			logger.warn("could not load market precision", field("default", ratePrecision), field("err", err))
+		} else {
+			catalog.setRatePrecisions(precisions)
+		}
+	}
+	return nil
+}
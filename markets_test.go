@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+func TestMarketLimitRounding(t *testing.T) {
+	limit := marketLimit{Active: true, QuantityPrecision: 8, RatePrecision: 3}
+	tests := []struct {
+		name  string
+		round func() string
+		want  string
+	}{
+		{"quantity rounds down", func() string { return limit.roundQuantity(dec("1.123456789")).String() }, "1.12345678"},
+		{"exact quantity", func() string { return limit.roundQuantity(dec("0.5")).String() }, "0.5"},
+		{"buy rate rounds up", func() string { return limit.roundRate(dec("0.05012"), "buy").String() }, "0.051"},
+		{"sell rate rounds down", func() string { return limit.roundRate(dec("0.05098"), "sell").String() }, "0.05"},
+		{"exact buy rate", func() string { return limit.roundRate(dec("0.051"), "buy").String() }, "0.051"},
+	}
+	for _, test := range tests {
+		if got := test.round(); !dec(got).Equal(dec(test.want)) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMarketLimitCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    marketLimit
+		quantity string
+		ok       bool
+	}{
+		{"tradeable", marketLimit{Active: true, MinTradeSize: dec("0.01")}, "0.5", true},
+		{"at the minimum", marketLimit{Active: true, MinTradeSize: dec("0.01")}, "0.01", true},
+		{"below the minimum", marketLimit{Active: true, MinTradeSize: dec("0.01")}, "0.009", false},
+		{"rounds to zero", marketLimit{Active: true}, "0", false},
+		{"inactive", marketLimit{MinTradeSize: dec("0.01")}, "0.5", false},
+	}
+	for _, test := range tests {
+		if err := test.limit.check("BTC-ETH", dec(test.quantity)); (err == nil) != test.ok {
+			t.Errorf("%v: check = %v", test.name, err)
+		}
+	}
+}
+
+func TestMarketCatalogPrecision(t *testing.T) {
+	catalog := newMarketCatalog()
+	catalog.set([]bittrex.Market{
+		{MarketName: "BTC-ETH", IsActive: true, MinTradeSize: dec("0.01")},
+		{MarketName: "USDT-BTC", IsActive: true},
+	})
+	catalog.setRatePrecisions(map[string]int32{"USDT-BTC": 3, "BTC-XRP": 8})
+	if precision := catalog.get("BTC-ETH").RatePrecision; precision != ratePrecision {
+		t.Errorf("BTC-ETH rate precision = %v, want the default %v", precision, ratePrecision)
+	}
+	if precision := catalog.get("USDT-BTC").RatePrecision; precision != 3 {
+		t.Errorf("USDT-BTC rate precision = %v, want 3", precision)
+	}
+	if _, exists := catalog.limits["BTC-XRP"]; exists {
+		t.Error("a precision added a market that isn't listed")
+	}
+	if limit := catalog.get("BTC-XRP"); !limit.Active || limit.RatePrecision != ratePrecision {
+		t.Errorf("unknown market limit = %+v, want active with default precision", limit)
+	}
+}
+
+func TestLoadMarketLimitsReadsPrecision(t *testing.T) {
+	setupTest(t)
+	fake, err := newFakeBittrex(fakeScript{
+		Summaries:      testSummaries(),
+		MinTradeSizes:  map[string]decimal.Decimal{"BTC-ETH": dec("0.01")},
+		RatePrecisions: map[string]int32{"USDT-BTC": 3},
+	}, demoKey, demoSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := startFakeServer(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	catalog := newMarketCatalog()
+	if err := loadMarketLimits(server.client(demoKey, demoSecret), catalog); err != nil {
+		t.Fatal(err)
+	}
+	assertDecimal(t, "BTC-ETH minimum", catalog.get("BTC-ETH").MinTradeSize, "0.01")
+	if precision := catalog.get("USDT-BTC").RatePrecision; precision != 3 {
+		t.Errorf("USDT-BTC rate precision = %v, want 3", precision)
+	}
+	if precision := catalog.get("USDT-ETH").RatePrecision; precision != 8 {
+		t.Errorf("USDT-ETH rate precision = %v, want 8", precision)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Metric kinds, as named in the Prometheus text format.
+const (
+	metricGauge     = "gauge"
+	metricCounter   = "counter"
+	metricHistogram = "histogram"
+)
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type metricFamily struct {
+	lock       *sync.Mutex
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*metricSeries
+}
+
+// metricRegistry renders every family it created in the Prometheus text
+// exposition format.
+type metricRegistry struct {
+	lock     sync.Mutex
+	families []*metricFamily
+}
+
+func newMetricRegistry() *metricRegistry {
+	return &metricRegistry{}
+}
+
+func (r *metricRegistry) register(name string, help string, kind string, buckets []float64, labelNames []string) *metricFamily {
+	family := &metricFamily{
+		lock:       &r.lock,
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*metricSeries),
+	}
+	r.lock.Lock()
+	r.families = append(r.families, family)
+	r.lock.Unlock()
+	return family
+}
+
+func (r *metricRegistry) newGauge(name string, help string, labelNames ...string) *metricFamily {
+	return r.register(name, help, metricGauge, nil, labelNames)
+}
+
+func (r *metricRegistry) newCounter(name string, help string, labelNames ...string) *metricFamily {
+	return r.register(name, help, metricCounter, nil, labelNames)
+}
+
+func (r *metricRegistry) newHistogram(name string, help string, buckets []float64, labelNames ...string) *metricFamily {
+	return r.register(name, help, metricHistogram, buckets, labelNames)
+}
+
+// get must be called with the registry locked.
+func (f *metricFamily) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	series, exists := f.series[key]
+	if !exists {
+		series = &metricSeries{
+			labels:  append([]string{}, labels...),
+			buckets: make([]uint64, len(f.buckets)),
+		}
+		f.series[key] = series
+	}
+	return series
+}
+
+func (f *metricFamily) set(value float64, labels ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.get(labels).value = value
+}
+
+func (f *metricFamily) add(delta float64, labels ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.get(labels).value += delta
+}
+
+func (f *metricFamily) inc(labels ...string) {
+	f.add(1, labels...)
+}
+
+func (f *metricFamily) observe(value float64, labels ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	series := f.get(labels)
+	for index, bound := range f.buckets {
+		if value <= bound {
+			series.buckets[index]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// reset drops every series, for gauges whose label sets change each cycle.
+func (f *metricFamily) reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.series = make(map[string]*metricSeries)
+}
+
+func (r *metricRegistry) write(output io.Writer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var text strings.Builder
+	for _, family := range r.families {
+		fmt.Fprintf(&text, "# HELP %v %v\n# TYPE %v %v\n", family.name, family.help, family.name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			series := family.series[key]
+			if family.kind != metricHistogram {
+				fmt.Fprintf(&text, "%v%v %v\n", family.name, formatLabels(family.labelNames, series.labels, "", ""), formatMetricValue(series.value))
+				continue
+			}
+			for index, bound := range family.buckets {
+				fmt.Fprintf(&text, "%v_bucket%v %v\n", family.name, formatLabels(family.labelNames, series.labels, "le", formatMetricValue(bound)), series.buckets[index])
+			}
+			fmt.Fprintf(&text, "%v_bucket%v %v\n", family.name, formatLabels(family.labelNames, series.labels, "le", "+Inf"), series.count)
+			fmt.Fprintf(&text, "%v_sum%v %v\n", family.name, formatLabels(family.labelNames, series.labels, "", ""), formatMetricValue(series.sum))
+			fmt.Fprintf(&text, "%v_count%v %v\n", family.name, formatLabels(family.labelNames, series.labels, "", ""), series.count)
+		}
+	}
+	_, err := io.WriteString(output, text.String())
+	return err
+}
+
+func (r *metricRegistry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := r.write(writer); err != nil {
+		logger.warn("could not write metrics", field("err", err))
+	}
+}
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for index, name := range names {
+		pairs = append(pairs, name+"=\""+escapeLabelValue(values[index])+"\"")
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+escapeLabelValue(extraValue)+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func decimalFloat(value decimal.Decimal) float64 {
+	float, _ := value.Float64()
+	return float
+}
+
+var (
+	metrics       = newMetricRegistry()
+	latencyBounds = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	bestGainMetric         = metrics.newGauge("chaingang_best_gain", "Gain of the best route of each origin pair, in the origin coin.", "origin", "output")
+	bestGainUsdtMetric     = metrics.newGauge("chaingang_best_gain_usdt", "Gain of the best route of each origin pair, in USDT.", "origin", "output")
+	candidateVesselsMetric = metrics.newGauge("chaingang_candidate_vessels", "Vessels with a complete route for each origin pair in the last cycle.", "origin", "output")
+	rejectedRoutesMetric   = metrics.newGauge("chaingang_rejected_routes", "Routes left out by market limits in the last cycle.")
+	cyclesMetric           = metrics.newCounter("chaingang_cycles_total", "Polling cycles run.")
+	apiLatencyMetric       = metrics.newHistogram("chaingang_api_request_duration_seconds", "Exchange API call latency.", latencyBounds, "call")
+	apiErrorsMetric        = metrics.newCounter("chaingang_api_errors_total", "Exchange API calls that returned an error.", "call")
+	apiRetriesMetric       = metrics.newCounter("chaingang_api_retries_total", "Exchange API calls made again after failing for a transient reason.", "call")
+	circuitOpenMetric      = metrics.newGauge("chaingang_api_circuit_open", "1 while calls to the exchange are refused after repeated failures.", "exchange")
+	ordersMetric           = metrics.newCounter("chaingang_orders_total", "Orders by the state they reached: placed, filled, partial, canceled or failed.", "state")
+	routesMetric           = metrics.newCounter("chaingang_routes_total", "Routes executed, complete, aborted or interrupted.", "result")
+	realizedMetric         = metrics.newGauge("chaingang_realized_pnl", "Realized profit and loss of executed routes.", "currency")
+	streamDroppedMetric    = metrics.newCounter("chaingang_stream_quotes_dropped_total", "Stream quotes dropped because the loop was too far behind to take them.")
+)
+
+// observeCall records the latency and outcome of an exchange API call, use as
+// defer observeCall("GetOrder", time.Now(), &err).
+func observeCall(call string, started time.Time, err *error) {
+	apiLatencyMetric.observe(time.Since(started).Seconds(), call)
+	if *err != nil {
+		apiErrorsMetric.inc(call)
+	}
+}
+
+// recordCycleMetrics publishes the opportunities found by the last cycle.
+func (v *marketView) recordCycleMetrics() {
+	cyclesMetric.inc()
+	bestGainMetric.reset()
+	bestGainUsdtMetric.reset()
+	candidateVesselsMetric.reset()
+	for originName := range validOrigins[exchangeName] {
+		for otherOriginName, routes := range v.summaries[originName] {
+			candidateVesselsMetric.set(float64(len(routes)), originName, otherOriginName)
+			if len(routes) == 0 {
+				continue
+			}
+			best := routes[len(routes)-1]
+			bestGainMetric.set(decimalFloat(best.Gain), originName, otherOriginName)
+			if gainUsdt, valued := v.valueIn(originName, valuationCurrency, best.Gain); valued {
+				bestGainUsdtMetric.set(decimalFloat(gainUsdt), originName, otherOriginName)
+			}
+		}
+	}
+	rejectedRoutesMetric.set(float64(len(v.rejections)))
+}
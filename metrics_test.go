@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricExposition(t *testing.T) {
+	registry := newMetricRegistry()
+	orders := registry.newCounter("test_orders_total", "Orders placed.", "market", "state")
+	balance := registry.newGauge("test_balance", "Balance held.")
+	latency := registry.newHistogram("test_latency_seconds", "Call latency.", []float64{0.1, 1}, "endpoint")
+	gains := registry.newGauge("test_route_gain", "Gain of each route.", "route")
+
+	orders.inc("USDT-BTC", "filled")
+	orders.add(2, "BTC-ETH", "filled")
+	orders.inc("BTC-ETH", "canceled")
+	orders.inc(`BTC "quoted"`, "a\\b\nc")
+	balance.set(0.5)
+	latency.observe(0.05, "getticker")
+	latency.observe(0.5, "getticker")
+	latency.observe(2, "getticker")
+	gains.set(1, "BTC -> ETH -> USDT")
+	// Reset series are left out, the family is still described.
+	gains.reset()
+
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, request)
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("content type %v, want the Prometheus text format", contentType)
+	}
+
+	want := `# HELP test_orders_total Orders placed.
+# TYPE test_orders_total counter
+test_orders_total{market="BTC \"quoted\"",state="a\\b\nc"} 1
+test_orders_total{market="BTC-ETH",state="canceled"} 1
+test_orders_total{market="BTC-ETH",state="filled"} 2
+test_orders_total{market="USDT-BTC",state="filled"} 1
+# HELP test_balance Balance held.
+# TYPE test_balance gauge
+test_balance 0.5
+# HELP test_latency_seconds Call latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{endpoint="getticker",le="0.1"} 1
+test_latency_seconds_bucket{endpoint="getticker",le="1"} 2
+test_latency_seconds_bucket{endpoint="getticker",le="+Inf"} 3
+test_latency_seconds_sum{endpoint="getticker"} 2.55
+test_latency_seconds_count{endpoint="getticker"} 3
+# HELP test_route_gain Gain of each route.
+# TYPE test_route_gain gauge
+`
+	if got := recorder.Body.String(); got != want {
+		t.Errorf("exposition:\n%v\nwant:\n%v", got, want)
+	}
+}
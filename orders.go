@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+type orderState string
+
+// pending and partial orders are still working on the exchange, the rest are
+// final. An order canceled after some of it executed stays partial.
+const (
+	orderPending  orderState = "pending"
+	orderPartial  orderState = "partial"
+	orderFilled   orderState = "filled"
+	orderCanceled orderState = "canceled"
+	orderFailed   orderState = "failed"
+)
+
+type trackedOrder struct {
+	RouteId   string
+	OrderId   string
+	Market    string
+	LimitType string
+	Quantity  decimal.Decimal
+	Rate      decimal.Decimal
+	State     orderState
+	Order     bittrex.Order2
+	Err       error
+	Placed    time.Time
+	Updated   time.Time
+	// exchange is where the order was placed
+	exchange Exchange
+}
+
+func (o trackedOrder) isOpen() bool {
+	switch o.State {
+	case orderPending:
+		return true
+	case orderPartial:
+		return o.Order.IsOpen
+	}
+	return false
+}
+
+// orderManager places limit orders, follows them with GetOrder until they
+// close or orderDeadline passes, and cancels whatever is still working then.
+// Orders are kept in orders while they are followed, then moved to closed,
+// which only holds the last closedOrderLimit of them.
+type orderManager struct {
+	lock   sync.RWMutex
+	orders map[string]*trackedOrder
+	closed []*trackedOrder
+}
+
+func newOrderManager() *orderManager {
+	return &orderManager{
+		orders: make(map[string]*trackedOrder),
+	}
+}
+
+// place submits the order and blocks until it reaches a final state.
+func (m *orderManager) place(exchange Exchange, routeId string, market string, limitType string, quantity decimal.Decimal, rate decimal.Decimal) trackedOrder {
+	tracked := &trackedOrder{
+		RouteId:   routeId,
+		Market:    market,
+		LimitType: limitType,
+		Quantity:  quantity,
+		Rate:      rate,
+		State:     orderPending,
+		Placed:    time.Now(),
+		exchange:  exchange,
+	}
+	tracked.Updated = tracked.Placed
+
+	var err error
+	if limitType == "buy" {
+		tracked.OrderId, err = exchange.BuyLimit(market, quantity, rate)
+	} else {
+		tracked.OrderId, err = exchange.SellLimit(market, quantity, rate)
+	}
+	if err == nil && tracked.OrderId == "" {
+		err = errors.New("exchange returned no order id")
+	}
+	if err != nil {
+		tracked.State = orderFailed
+		tracked.Err = err
+		m.retire(tracked)
+		ordersMetric.inc(string(orderFailed))
+		journal.order(*tracked)
+		return *tracked
+	}
+	logger.info("order placed", field("orderId", tracked.OrderId), field("market", market), field("type", limitType), field("quantity", quantity), field("rate", rate))
+
+	m.lock.Lock()
+	m.orders[tracked.OrderId] = tracked
+	m.lock.Unlock()
+	ordersMetric.inc("placed")
+	journal.order(*tracked)
+	final := m.wait(exchange, tracked.OrderId)
+	m.retire(tracked)
+	ordersMetric.inc(string(final.State))
+	return final
+}
+
+// retire moves an order that is no longer followed to closed, dropping the
+// oldest closed order past closedOrderLimit.
+func (m *orderManager) retire(tracked *trackedOrder) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if tracked.OrderId != "" {
+		delete(m.orders, tracked.OrderId)
+	}
+	m.closed = append(m.closed, tracked)
+	if excess := len(m.closed) - closedOrderLimit; excess > 0 {
+		m.closed = append([]*trackedOrder{}, m.closed[excess:]...)
+	}
+}
+
+// wait polls an order until it closes, canceling it once orderDeadline has
+// passed since it was placed.
+func (m *orderManager) wait(exchange Exchange, orderId string) trackedOrder {
+	m.lock.RLock()
+	tracked, exists := m.orders[orderId]
+	m.lock.RUnlock()
+	if !exists {
+		return trackedOrder{OrderId: orderId, State: orderFailed, Err: errors.New("unknown order")}
+	}
+
+	orderLogger := logger.with(field("orderId", orderId), field("market", tracked.Market))
+	deadline := tracked.Placed.Add(orderDeadline)
+	hasOrder := false
+	for {
+		order, err := exchange.GetOrder(orderId)
+		if err == nil {
+			logger.debug("order status", orderFields(order)...)
+			m.update(tracked, order, nil)
+			journal.status(tracked.RouteId, order)
+			hasOrder = true
+		} else {
+			orderLogger.warn("could not get order", field("err", err))
+		}
+		if hasOrder && !tracked.isOpen() {
+			return m.snapshot(tracked)
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		if remaining > orderPollInterval {
+			remaining = orderPollInterval
+		}
+		time.Sleep(remaining)
+	}
+
+	orderLogger.warn("order still open, canceling", field("deadline", orderDeadline))
+	cancelErr := exchange.CancelOrder(orderId)
+	if cancelErr == nil {
+		orderLogger.info("order canceled")
+	} else {
+		orderLogger.error("could not cancel order", field("err", cancelErr))
+	}
+	// Fills can land between the last poll and the cancel, read the final state.
+	order, err := exchange.GetOrder(orderId)
+	if err == nil {
+		m.update(tracked, order, cancelErr)
+		journal.status(tracked.RouteId, order)
+	} else if !hasOrder {
+		m.fail(tracked, err)
+	} else {
+		last := tracked.Order
+		if cancelErr == nil {
+			// Canceled, though fills since the last read are unknown.
+			last.IsOpen = false
+		}
+		m.update(tracked, last, err)
+	}
+	if executed := tracked.Order.Quantity.Sub(tracked.Order.QuantityRemaining); tracked.State == orderPartial && executed.GreaterThan(decimal.Zero) {
+		orderLogger.warn("order partially filled", field("executed", executed), field("quantity", tracked.Order.Quantity))
+	}
+	return m.snapshot(tracked)
+}
+
+func (m *orderManager) update(tracked *trackedOrder, order bittrex.Order2, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tracked.Order = order
+	tracked.Err = err
+	tracked.Updated = time.Now()
+	executed := order.Quantity.Sub(order.QuantityRemaining)
+	switch {
+	case !order.IsOpen && order.QuantityRemaining.Equal(decimal.Zero):
+		tracked.State = orderFilled
+	case executed.GreaterThan(decimal.Zero):
+		tracked.State = orderPartial
+	case !order.IsOpen:
+		tracked.State = orderCanceled
+	default:
+		tracked.State = orderPending
+	}
+}
+
+func (m *orderManager) fail(tracked *trackedOrder, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tracked.State = orderFailed
+	tracked.Err = err
+	tracked.Updated = time.Now()
+}
+
+func (m *orderManager) snapshot(tracked *trackedOrder) trackedOrder {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return *tracked
+}
+
+func (m *orderManager) get(orderId string) (trackedOrder, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if tracked, exists := m.orders[orderId]; exists {
+		return *tracked, true
+	}
+	for _, tracked := range m.closed {
+		if tracked.OrderId == orderId {
+			return *tracked, true
+		}
+	}
+	return trackedOrder{}, false
+}
+
+// open returns the orders that are still working on the exchange.
+func (m *orderManager) open() []trackedOrder {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	output := make([]trackedOrder, 0)
+	for _, tracked := range m.orders {
+		if tracked.isOpen() {
+			output = append(output, *tracked)
+		}
+	}
+	return output
+}
+
+// recent returns up to limit orders, newest first, including closed ones.
+func (m *orderManager) recent(limit int) []trackedOrder {
+	m.lock.RLock()
+	output := make([]trackedOrder, 0, len(m.orders)+len(m.closed))
+	for _, tracked := range m.orders {
+		output = append(output, *tracked)
+	}
+	for _, tracked := range m.closed {
+		output = append(output, *tracked)
+	}
+	m.lock.RUnlock()
+	sort.Slice(output, func(aIndex, bIndex int) bool {
+		return output[aIndex].Placed.After(output[bIndex].Placed)
+	})
+	if len(output) > limit {
+		output = output[:limit]
+	}
+	return output
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+type stubRead struct {
+	order bittrex.Order2
+	err   error
+}
+
+// stubExchange places every order as "order-1" and answers GetOrder from
+// reads in turn, repeating the last one, then from canceled once the order
+// has been canceled.
+type stubExchange struct {
+	lock      sync.Mutex
+	placeErr  error
+	reads     []stubRead
+	canceled  stubRead
+	cancels   int
+	readCount int
+}
+
+func (s *stubExchange) Name() string { return "stub" }
+
+func (s *stubExchange) GetMarketSummaries() ([]bittrex.MarketSummary, error) {
+	return testSummaries(), nil
+}
+
+func (s *stubExchange) GetBalances() ([]bittrex.Balance, error) { return nil, nil }
+
+func (s *stubExchange) GetOrderBook(market string) (bittrex.OrderBook, error) {
+	return bittrex.OrderBook{}, nil
+}
+
+func (s *stubExchange) BuyLimit(market string, quantity, rate decimal.Decimal) (string, error) {
+	if s.placeErr != nil {
+		return "", s.placeErr
+	}
+	return "order-1", nil
+}
+
+func (s *stubExchange) SellLimit(market string, quantity, rate decimal.Decimal) (string, error) {
+	return s.BuyLimit(market, quantity, rate)
+}
+
+func (s *stubExchange) CancelOrder(orderId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancels++
+	return nil
+}
+
+func (s *stubExchange) GetOrder(orderId string) (bittrex.Order2, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readCount++
+	if s.cancels > 0 {
+		return s.canceled.order, s.canceled.err
+	}
+	read := s.reads[len(s.reads)-1]
+	if s.readCount <= len(s.reads) {
+		read = s.reads[s.readCount-1]
+	}
+	return read.order, read.err
+}
+
+func stubOrder(quantity string, remaining string, isOpen bool) bittrex.Order2 {
+	return bittrex.Order2{OrderUuid: "order-1", Quantity: dec(quantity), QuantityRemaining: dec(remaining), IsOpen: isOpen}
+}
+
+func TestOrderManagerPlace(t *testing.T) {
+	errRead := errors.New("read failed")
+	tests := []struct {
+		name     string
+		exchange *stubExchange
+		state    orderState
+		executed string
+		cancels  int
+		err      bool
+	}{
+		{
+			name: "filled",
+			exchange: &stubExchange{reads: []stubRead{
+				{order: stubOrder("2", "2", true)},
+				{order: stubOrder("2", "0", false)},
+			}},
+			state: orderFilled, executed: "2",
+		},
+		{
+			name: "partly filled then canceled at the deadline",
+			exchange: &stubExchange{
+				reads:    []stubRead{{order: stubOrder("2", "1", true)}},
+				canceled: stubRead{order: stubOrder("2", "1", false)},
+			},
+			state: orderPartial, executed: "1", cancels: 1,
+		},
+		{
+			name: "fills land before the cancel",
+			exchange: &stubExchange{
+				reads:    []stubRead{{order: stubOrder("2", "2", true)}},
+				canceled: stubRead{order: stubOrder("2", "0", false)},
+			},
+			state: orderFilled, executed: "2", cancels: 1,
+		},
+		{
+			name: "final read fails",
+			exchange: &stubExchange{
+				reads:    []stubRead{{order: stubOrder("2", "1", true)}},
+				canceled: stubRead{err: errRead},
+			},
+			state: orderPartial, executed: "1", cancels: 1, err: true,
+		},
+		{
+			name: "every read fails",
+			exchange: &stubExchange{
+				reads:    []stubRead{{err: errRead}},
+				canceled: stubRead{err: errRead},
+			},
+			state: orderFailed, executed: "0", cancels: 1, err: true,
+		},
+		{
+			name:     "placing fails",
+			exchange: &stubExchange{placeErr: errors.New("INSUFFICIENT_FUNDS")},
+			state:    orderFailed, executed: "0", err: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			orderPollInterval = time.Millisecond
+			orderDeadline = 20 * time.Millisecond
+			tracked := orderTracker.place(test.exchange, "route-1", "BTC-ETH", "buy", dec("2"), dec("0.05"))
+			if tracked.State != test.state {
+				t.Errorf("state = %v, want %v", tracked.State, test.state)
+			}
+			if tracked.isOpen() {
+				t.Error("order still open")
+			}
+			assertDecimal(t, "executed", tracked.Order.Quantity.Sub(tracked.Order.QuantityRemaining), test.executed)
+			if test.exchange.cancels != test.cancels {
+				t.Errorf("canceled %v times, want %v", test.exchange.cancels, test.cancels)
+			}
+			if (tracked.Err != nil) != test.err {
+				t.Errorf("err = %v, want an error %v", tracked.Err, test.err)
+			}
+		})
+	}
+}
+
+func TestOrderManagerRetiresClosedOrders(t *testing.T) {
+	setupTest(t)
+	defer func(limit int) { closedOrderLimit = limit }(closedOrderLimit)
+	closedOrderLimit = 3
+	exchange := &stubExchange{reads: []stubRead{{order: stubOrder("2", "0", false)}}}
+	for index := 0; index < 5; index++ {
+		orderTracker.place(exchange, "route-1", "BTC-ETH", "buy", dec("2"), dec("0.05"))
+	}
+	orderTracker.place(&stubExchange{placeErr: errors.New("INSUFFICIENT_FUNDS")}, "route-2", "BTC-ETH", "buy", dec("2"), dec("0.05"))
+	if len(orderTracker.orders) != 0 {
+		t.Errorf("%v closed orders still followed", len(orderTracker.orders))
+	}
+	if len(orderTracker.closed) != closedOrderLimit {
+		t.Errorf("kept %v closed orders, want %v", len(orderTracker.closed), closedOrderLimit)
+	}
+	recent := orderTracker.recent(10)
+	if len(recent) != closedOrderLimit {
+		t.Fatalf("recent = %v orders, want %v", len(recent), closedOrderLimit)
+	}
+	if recent[0].RouteId != "route-2" {
+		t.Errorf("newest order is from %v, want the failed one of route-2", recent[0].RouteId)
+	}
+	if _, tracked := orderTracker.get("order-1"); !tracked {
+		t.Error("closed order-1 no longer tracked")
+	}
+}
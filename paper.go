@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// marketDataSource is the read-only half of an Exchange. The paper exchange
+// takes its prices from one so it can run on live data or on a replay.
+type marketDataSource interface {
+	GetMarketSummaries() ([]bittrex.MarketSummary, error)
+	GetOrderBook(market string) (bittrex.OrderBook, error)
+}
+
+// routeRecorder is implemented by exchanges that keep per-route results.
+type routeRecorder interface {
+	recordRoute(origin, vessel, outputOrigin string, stake decimal.Decimal, result decimal.Decimal)
+}
+
+type routeResult struct {
+	Origin       string
+	Vessel       string
+	OutputOrigin string
+	Stake        decimal.Decimal
+	Result       decimal.Decimal
+}
+
+type paperRoute struct {
+	Count    int
+	Wins     int
+	Staked   decimal.Decimal
+	Realized decimal.Decimal
+}
+
+// paperExchange is a simulated Exchange holding virtual balances. Limit
+// orders are filled against the latest Ask/Bid of the source, or against the
+// order book when useDepth is set, and are charged the market's maker or taker
+// fee. What orders take from a book is gone until the next market summaries.
+type paperExchange struct {
+	lock sync.Mutex
+	// name, when set, replaces the source's name and tells its order ids
+	// apart from those of other paper exchanges
+	name      string
+	fees      *feeModel
+	source    marketDataSource
+	useDepth  bool
+	balances  map[string]decimal.Decimal
+	summaries map[string]bittrex.MarketSummary
+	orders    map[string]*bittrex.Order2
+	// taken is the quantity filled at each rate of each side of a book,
+	// see bookSide
+	taken   map[string]map[string]decimal.Decimal
+	routes  map[string]*paperRoute
+	history []routeResult
+	nextId  int
+}
+
+func newPaperExchange(source marketDataSource, startingBalances map[string]decimal.Decimal, useDepth bool) *paperExchange {
+	p := &paperExchange{
+		fees:      fees,
+		source:    source,
+		useDepth:  useDepth,
+		balances:  make(map[string]decimal.Decimal),
+		summaries: make(map[string]bittrex.MarketSummary),
+		orders:    make(map[string]*bittrex.Order2),
+		taken:     make(map[string]map[string]decimal.Decimal),
+		routes:    make(map[string]*paperRoute),
+	}
+	for currency, amount := range startingBalances {
+		p.balances[currency] = amount
+	}
+	return p
+}
+
+// paperBalances is what a paper account starts with: paperStakeMultiple
+// maximum stakes of each origin.
+func paperBalances(stakes map[string]decimal.Decimal) map[string]decimal.Decimal {
+	return scaleStakes(stakes, paperStakeMultiple)
+}
+
+func (p *paperExchange) Name() string {
+	if p.name != "" {
+		return p.name
+	}
+	if named, ok := p.source.(Exchange); ok {
+		return named.Name()
+	}
+	return "Paper"
+}
+
+func (p *paperExchange) GetMarketSummaries() ([]bittrex.MarketSummary, error) {
+	marketSummaries, err := p.source.GetMarketSummaries()
+	if err != nil {
+		return marketSummaries, err
+	}
+	p.lock.Lock()
+	for _, marketSummary := range marketSummaries {
+		p.summaries[marketSummary.MarketName] = marketSummary
+	}
+	p.taken = make(map[string]map[string]decimal.Decimal)
+	p.lock.Unlock()
+	return marketSummaries, nil
+}
+
+func (p *paperExchange) GetOrderBook(market string) (bittrex.OrderBook, error) {
+	return p.source.GetOrderBook(market)
+}
+
+func (p *paperExchange) GetBalances() ([]bittrex.Balance, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	output := make([]bittrex.Balance, 0, len(p.balances))
+	for currency, amount := range p.balances {
+		output = append(output, bittrex.Balance{
+			Currency:  currency,
+			Balance:   amount,
+			Available: amount,
+		})
+	}
+	return output, nil
+}
+
+func (p *paperExchange) BuyLimit(market string, quantity, rate decimal.Decimal) (string, error) {
+	return p.placeOrder("LIMIT_BUY", market, quantity, rate)
+}
+
+func (p *paperExchange) SellLimit(market string, quantity, rate decimal.Decimal) (string, error) {
+	return p.placeOrder("LIMIT_SELL", market, quantity, rate)
+}
+
+func (p *paperExchange) CancelOrder(orderId string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	order, exists := p.orders[orderId]
+	if !exists {
+		return errors.New("INVALID_ORDER")
+	}
+	if !order.IsOpen {
+		return errors.New("ORDER_NOT_OPEN")
+	}
+	base, currency := splitMarketName(order.Exchange)
+	// Release whatever is still held for the unfilled remainder.
+	if order.Type == "LIMIT_BUY" {
+		p.balances[base] = p.balances[base].Add(order.ReserveRemaining).Add(order.CommissionReserveRemaining)
+	} else {
+		p.balances[currency] = p.balances[currency].Add(order.QuantityRemaining)
+	}
+	order.ReserveRemaining = decimal.Zero
+	order.CommissionReserveRemaining = decimal.Zero
+	order.IsOpen = false
+	order.CancelInitiated = true
+	order.Closed = time.Now().UTC().Format(bittrex.TIME_FORMAT)
+	return nil
+}
+
+func (p *paperExchange) GetOrder(orderId string) (bittrex.Order2, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	order, exists := p.orders[orderId]
+	if !exists {
+		return bittrex.Order2{}, errors.New("INVALID_ORDER")
+	}
+	if order.IsOpen {
+		p.fill(order, false)
+	}
+	return *order, nil
+}
+
+// GetOpenOrders lists the orders still open in market, or in every market
+// for "all".
+func (p *paperExchange) GetOpenOrders(market string) ([]bittrex.Order, error) {
+	return p.listOrders(market, true), nil
+}
+
+// GetOrderHistory lists the orders closed in market, or in every market for
+// "all".
+func (p *paperExchange) GetOrderHistory(market string) ([]bittrex.Order, error) {
+	return p.listOrders(market, false), nil
+}
+
+func (p *paperExchange) listOrders(market string, open bool) []bittrex.Order {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	orderIds := make([]string, 0, len(p.orders))
+	for orderId := range p.orders {
+		orderIds = append(orderIds, orderId)
+	}
+	sort.Strings(orderIds)
+	output := make([]bittrex.Order, 0)
+	for _, orderId := range orderIds {
+		order := p.orders[orderId]
+		if order.IsOpen != open || (market != "all" && order.Exchange != market) {
+			continue
+		}
+		listed := bittrex.Order{
+			OrderUuid:         order.OrderUuid,
+			Exchange:          order.Exchange,
+			OrderType:         order.Type,
+			Limit:             order.Limit,
+			Quantity:          order.Quantity,
+			QuantityRemaining: order.QuantityRemaining,
+			Commission:        order.CommissionPaid,
+			Price:             order.Price,
+			PricePerUnit:      order.PricePerUnit,
+		}
+		listed.TimeStamp.Time, _ = time.Parse(bittrex.TIME_FORMAT, order.Opened)
+		output = append(output, listed)
+	}
+	return output
+}
+
+func (p *paperExchange) placeOrder(orderType string, market string, quantity, rate decimal.Decimal) (string, error) {
+	if !quantity.GreaterThan(decimal.Zero) || !rate.GreaterThan(decimal.Zero) {
+		return "", errors.New("INVALID_QUANTITY_OR_RATE")
+	}
+	base, currency := splitMarketName(market)
+	if base == "" || currency == "" {
+		return "", errors.New("INVALID_MARKET")
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	order := &bittrex.Order2{
+		AccountId:         "paper",
+		Exchange:          market,
+		Type:              orderType,
+		Quantity:          quantity,
+		QuantityRemaining: quantity,
+		Limit:             rate,
+		Opened:            time.Now().UTC().Format(bittrex.TIME_FORMAT),
+		IsOpen:            true,
+	}
+	// Funds for the full order are held up front the way the exchange does.
+	if orderType == "LIMIT_BUY" {
+		reserve := quantity.Mul(rate)
+		commission := reserve.Mul(p.fees.taker(market))
+		if p.balances[base].LessThan(reserve.Add(commission)) {
+			return "", errors.New("INSUFFICIENT_FUNDS")
+		}
+		p.balances[base] = p.balances[base].Sub(reserve).Sub(commission)
+		order.Reserved = reserve
+		order.ReserveRemaining = reserve
+		order.CommissionReserved = commission
+		order.CommissionReserveRemaining = commission
+	} else {
+		if p.balances[currency].LessThan(quantity) {
+			return "", errors.New("INSUFFICIENT_FUNDS")
+		}
+		p.balances[currency] = p.balances[currency].Sub(quantity)
+	}
+
+	p.nextId++
+	order.OrderUuid = "paper-" + strconv.Itoa(p.nextId)
+	if p.name != "" {
+		order.OrderUuid = "paper-" + p.name + "-" + strconv.Itoa(p.nextId)
+	}
+	p.orders[order.OrderUuid] = order
+	p.fill(order, true)
+	return order.OrderUuid, nil
+}
+
+// fill matches the remainder of an open order against current prices and
+// settles balances for whatever quantity crosses the limit rate. Fills made
+// as the order is placed pay the taker fee, later ones the maker fee.
+func (p *paperExchange) fill(order *bittrex.Order2, taker bool) {
+	isBuy := order.Type == "LIMIT_BUY"
+	levels := p.priceLevels(order.Exchange, isBuy)
+
+	base, currency := splitMarketName(order.Exchange)
+	fee := p.fees.maker(order.Exchange)
+	if taker {
+		fee = p.fees.taker(order.Exchange)
+	}
+	for _, level := range levels {
+		if order.QuantityRemaining.Equal(decimal.Zero) {
+			break
+		}
+		if isBuy && level.Rate.GreaterThan(order.Limit) {
+			break
+		}
+		if !isBuy && level.Rate.LessThan(order.Limit) {
+			break
+		}
+		filled := order.QuantityRemaining
+		if level.Quantity.GreaterThan(decimal.Zero) {
+			if level.Quantity.LessThan(filled) {
+				filled = level.Quantity
+			}
+			side := bookSide(order.Exchange, isBuy)
+			if p.taken[side] == nil {
+				p.taken[side] = make(map[string]decimal.Decimal)
+			}
+			rate := level.Rate.String()
+			p.taken[side][rate] = p.taken[side][rate].Add(filled)
+		}
+		price := filled.Mul(level.Rate)
+		commission := price.Mul(fee)
+
+		if isBuy {
+			reserved := filled.Mul(order.Limit)
+			reservedCommission := reserved.Mul(p.fees.taker(order.Exchange))
+			// Buying below the limit returns the unused part of the hold.
+			p.balances[base] = p.balances[base].Add(reserved.Sub(price)).Add(reservedCommission.Sub(commission))
+			p.balances[currency] = p.balances[currency].Add(filled)
+			order.ReserveRemaining = order.ReserveRemaining.Sub(reserved)
+			order.CommissionReserveRemaining = order.CommissionReserveRemaining.Sub(reservedCommission)
+		} else {
+			p.balances[base] = p.balances[base].Add(price).Sub(commission)
+		}
+		order.QuantityRemaining = order.QuantityRemaining.Sub(filled)
+		order.Price = order.Price.Add(price)
+		order.CommissionPaid = order.CommissionPaid.Add(commission)
+	}
+
+	executed := order.Quantity.Sub(order.QuantityRemaining)
+	if executed.GreaterThan(decimal.Zero) {
+		order.PricePerUnit = order.Price.Div(executed)
+	}
+	if order.QuantityRemaining.Equal(decimal.Zero) {
+		order.IsOpen = false
+		order.Closed = time.Now().UTC().Format(bittrex.TIME_FORMAT)
+	}
+}
+
+// priceLevels returns the side of the book an order would take from, best
+// price first. Without depth the top of book is treated as unlimited size.
+func (p *paperExchange) priceLevels(market string, isBuy bool) []bittrex.Orderb {
+	if p.useDepth {
+		orderBook, err := p.source.GetOrderBook(market)
+		if err == nil {
+			levels := orderBook.Buy
+			if isBuy {
+				levels = orderBook.Sell
+			}
+			sorted := make([]bittrex.Orderb, 0, len(levels))
+			for _, level := range levels {
+				level.Quantity = level.Quantity.Sub(p.taken[bookSide(market, isBuy)][level.Rate.String()])
+				if level.Quantity.GreaterThan(decimal.Zero) {
+					sorted = append(sorted, level)
+				}
+			}
+			sort.Slice(sorted, func(aIndex, bIndex int) bool {
+				if isBuy {
+					return sorted[aIndex].Rate.LessThan(sorted[bIndex].Rate)
+				}
+				return sorted[aIndex].Rate.GreaterThan(sorted[bIndex].Rate)
+			})
+			return sorted
+		}
+		logger.warn("paper order book unavailable, using top of book", field("market", market), field("err", err))
+	}
+
+	marketSummary, exists := p.summaries[market]
+	if !exists {
+		return nil
+	}
+	rate := marketSummary.Bid
+	if isBuy {
+		rate = marketSummary.Ask
+	}
+	return []bittrex.Orderb{{Rate: rate}}
+}
+
+// bookSide names the side of market's book that buys, or sells, take from.
+func bookSide(market string, isBuy bool) string {
+	if isBuy {
+		return market + " sell"
+	}
+	return market + " buy"
+}
+
+func (p *paperExchange) recordRoute(origin, vessel, outputOrigin string, stake decimal.Decimal, result decimal.Decimal) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.history = append(p.history, routeResult{
+		Origin:       origin,
+		Vessel:       vessel,
+		OutputOrigin: outputOrigin,
+		Stake:        stake,
+		Result:       result,
+	})
+	route := origin + "-" + vessel + "-" + outputOrigin
+	r, exists := p.routes[route]
+	if !exists {
+		r = &paperRoute{}
+		p.routes[route] = r
+	}
+	gain := result.Sub(stake)
+	r.Count++
+	if gain.GreaterThan(decimal.Zero) {
+		r.Wins++
+	}
+	r.Staked = r.Staked.Add(stake)
+	r.Realized = r.Realized.Add(gain)
+}
+
+func (p *paperExchange) printRoutes() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	names := make([]string, 0, len(p.routes))
+	for name := range p.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := p.routes[name]
+		logger.info("paper route", field("route", name), field("trades", r.Count), field("wins", r.Wins), field("staked", r.Staked), field("realized", r.Realized))
+	}
+}
+
+// results returns every recorded route in the order it was executed.
+func (p *paperExchange) results() []routeResult {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	output := make([]routeResult, len(p.history))
+	copy(output, p.history)
+	return output
+}
+
+func splitMarketName(market string) (string, string) {
+	split := strings.Split(market, "-")
+	if len(split) != 2 {
+		return "", ""
+	}
+	return split[0], split[1]
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+func newTestPaper(t *testing.T, useDepth bool, orderBooks map[string]bittrex.OrderBook) *paperExchange {
+	t.Helper()
+	setupTest(t)
+	paper := newPaperExchange(testSource(testSummaries(), orderBooks), map[string]decimal.Decimal{"BTC": dec("1"), "ETH": dec("5")}, useDepth)
+	paper.fees = newFeeModel(feeConfig{Maker: dec("0.001"), Taker: dec("0.0025")})
+	if _, err := paper.GetMarketSummaries(); err != nil {
+		t.Fatal(err)
+	}
+	return paper
+}
+
+func paperBalance(t *testing.T, paper *paperExchange, currency string) decimal.Decimal {
+	t.Helper()
+	balances, err := paper.GetBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, balance := range balances {
+		if balance.Currency == currency {
+			return balance.Available
+		}
+	}
+	return decimal.Zero
+}
+
+func TestPaperBuyWalksTheBook(t *testing.T) {
+	paper := newTestPaper(t, true, map[string]bittrex.OrderBook{
+		"BTC-ETH": {Sell: []bittrex.Orderb{{Quantity: dec("2"), Rate: dec("0.051")}, {Quantity: dec("1"), Rate: dec("0.05")}}},
+	})
+	orderId, err := paper.BuyLimit("BTC-ETH", dec("2"), dec("0.051"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := paper.GetOrder(orderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.IsOpen {
+		t.Fatal("order still open")
+	}
+	// 1 at 0.05 and 1 at 0.051, with the taker fee on top.
+	assertDecimal(t, "price", order.Price, "0.101")
+	assertDecimal(t, "price per unit", order.PricePerUnit, "0.0505")
+	assertDecimal(t, "commission", order.CommissionPaid, "0.0002525")
+	assertDecimal(t, "BTC", paperBalance(t, paper, "BTC"), "0.8987475")
+	assertDecimal(t, "ETH", paperBalance(t, paper, "ETH"), "7")
+}
+
+func TestPaperSellWalksTheBook(t *testing.T) {
+	paper := newTestPaper(t, true, map[string]bittrex.OrderBook{
+		"BTC-ETH": {Buy: []bittrex.Orderb{{Quantity: dec("5"), Rate: dec("0.049")}, {Quantity: dec("2"), Rate: dec("0.05")}}},
+	})
+	orderId, err := paper.SellLimit("BTC-ETH", dec("3"), dec("0.049"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, _ := paper.GetOrder(orderId)
+	// 2 at 0.05 and 1 at 0.049, the fee taken out of the proceeds.
+	assertDecimal(t, "price", order.Price, "0.149")
+	assertDecimal(t, "commission", order.CommissionPaid, "0.0003725")
+	assertDecimal(t, "BTC", paperBalance(t, paper, "BTC"), "1.1486275")
+	assertDecimal(t, "ETH", paperBalance(t, paper, "ETH"), "2")
+}
+
+func TestPaperTopOfBook(t *testing.T) {
+	paper := newTestPaper(t, false, nil)
+	orderId, err := paper.BuyLimit("BTC-ETH", dec("10"), dec("0.06"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, _ := paper.GetOrder(orderId)
+	// The whole order fills at the Ask, below the limit, and the unused
+	// part of the hold comes back.
+	assertDecimal(t, "price", order.Price, "0.5")
+	assertDecimal(t, "commission", order.CommissionPaid, "0.00125")
+	assertDecimal(t, "BTC", paperBalance(t, paper, "BTC"), "0.49875")
+	assertDecimal(t, "ETH", paperBalance(t, paper, "ETH"), "15")
+}
+
+func TestPaperRestingOrderHoldsFunds(t *testing.T) {
+	paper := newTestPaper(t, true, map[string]bittrex.OrderBook{
+		"BTC-ETH": {Sell: []bittrex.Orderb{{Quantity: dec("1"), Rate: dec("0.05")}}},
+	})
+	orderId, err := paper.BuyLimit("BTC-ETH", dec("2"), dec("0.05"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, _ := paper.GetOrder(orderId)
+	if !order.IsOpen {
+		t.Fatal("order closed with half the book missing")
+	}
+	// 1 filled, and the other 1 plus its taker fee is still held.
+	assertDecimal(t, "BTC", paperBalance(t, paper, "BTC"), "0.89975")
+	assertDecimal(t, "ETH", paperBalance(t, paper, "ETH"), "6")
+
+	if _, err := paper.SellLimit("BTC-ETH", dec("7"), dec("0.01")); err == nil {
+		t.Error("sold coins that are not there")
+	}
+	if err := paper.CancelOrder(orderId); err != nil {
+		t.Fatal(err)
+	}
+	assertDecimal(t, "BTC after cancel", paperBalance(t, paper, "BTC"), "0.949875")
+	if err := paper.CancelOrder(orderId); err == nil {
+		t.Error("canceled a closed order")
+	}
+}
+
+func TestPaperLaterFillsPayMaker(t *testing.T) {
+	paper := newTestPaper(t, true, map[string]bittrex.OrderBook{
+		"BTC-ETH": {Sell: []bittrex.Orderb{{Quantity: dec("1"), Rate: dec("0.06")}}},
+	})
+	orderId, _ := paper.BuyLimit("BTC-ETH", dec("1"), dec("0.05"))
+	paper.source.(*replaySource).snapshots[0].OrderBooks["BTC-ETH"] = bittrex.OrderBook{
+		Sell: []bittrex.Orderb{{Quantity: dec("1"), Rate: dec("0.04")}},
+	}
+	order, _ := paper.GetOrder(orderId)
+	if order.IsOpen {
+		t.Fatal("order still open once the book crossed it")
+	}
+	assertDecimal(t, "commission", order.CommissionPaid, "0.00004")
+	assertDecimal(t, "BTC", paperBalance(t, paper, "BTC"), "0.95996")
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+type openOrderSource interface {
+	GetOpenOrders(market string) ([]bittrex.Order, error)
+}
+
+// unfinishedRoute is a route the journal saw start but never finish, because
+// the process died mid-route or a shutdown interrupted it.
+type unfinishedRoute struct {
+	RouteId string
+	Path    []string
+	Stake   decimal.Decimal
+	// Orders are in the order they were placed, with the last status seen.
+	Orders   []journalOrder
+	Statuses map[string]bittrex.Order2
+	// Interrupted is set when a shutdown stopped the route between legs.
+	Interrupted *journalOutcome
+}
+
+// unfinishedRoutes replays the journal, oldest route first.
+func unfinishedRoutes(entries []journalEntry) []*unfinishedRoute {
+	routes := make(map[string]*unfinishedRoute)
+	order := make([]string, 0)
+	for _, entry := range entries {
+		route, exists := routes[entry.RouteId]
+		switch entry.Kind {
+		case entryDecision:
+			// Spatial routes place a single order on each venue and are
+			// left to their venues.
+			if entry.Decision == nil || entry.Decision.Blocked != "" || entry.Decision.Paper || len(entry.Decision.Venues) > 0 {
+				continue
+			}
+			routes[entry.RouteId] = &unfinishedRoute{
+				RouteId:  entry.RouteId,
+				Path:     entry.Decision.Path,
+				Stake:    entry.Decision.Stake,
+				Orders:   make([]journalOrder, 0),
+				Statuses: make(map[string]bittrex.Order2),
+			}
+			order = append(order, entry.RouteId)
+		case entryOrder:
+			if exists && entry.Order != nil && entry.Order.Err == "" {
+				route.Orders = append(route.Orders, *entry.Order)
+			}
+		case entryStatus:
+			if exists && entry.Status != nil {
+				route.Statuses[entry.Status.OrderUuid] = *entry.Status
+			}
+		case entryOutcome:
+			if exists && entry.Outcome != nil && entry.Outcome.Interrupted {
+				route.Interrupted = entry.Outcome
+				// Orders placed after this belong to a later attempt.
+				route.Orders = route.Orders[:0]
+			} else {
+				delete(routes, entry.RouteId)
+			}
+		}
+	}
+
+	output := make([]*unfinishedRoute, 0, len(routes))
+	for _, routeId := range order {
+		if route, exists := routes[routeId]; exists {
+			output = append(output, route)
+		}
+	}
+	return output
+}
+
+// holdings is what the route left in each coin, origin included, once every
+// order it placed is final.
+func (u *unfinishedRoute) holdings() map[string]decimal.Decimal {
+	held := make(map[string]decimal.Decimal)
+	if u.Interrupted != nil {
+		held[u.Path[0]] = u.Interrupted.Result
+		for coinName, amount := range u.Interrupted.Stranded {
+			held[coinName] = held[coinName].Add(amount)
+		}
+	} else {
+		held[u.Path[0]] = u.Stake
+	}
+	for _, placed := range u.Orders {
+		status, exists := u.Statuses[placed.OrderId]
+		if !exists {
+			continue
+		}
+		base, currency := splitMarketName(placed.Market)
+		input, output := currency, base
+		if placed.LimitType == "buy" {
+			input, output = base, currency
+		}
+		held[input] = held[input].Sub(orderCost(status, placed.LimitType))
+		held[output] = held[output].Add(orderProceeds(status, placed.LimitType))
+	}
+	for coinName, amount := range held {
+		if !amount.GreaterThan(decimal.Zero) {
+			delete(held, coinName)
+		}
+	}
+	return held
+}
+
+// reconcile settles the routes a previous run left unfinished before trading
+// starts: their orders still open are canceled, then each route is resumed
+// or unwound, whichever is quoted to bring back more of the origin coin.
+// Open orders the journal does not know about are reported and left alone.
+func reconcile(exchange Exchange, routeJournal *tradeJournal) error {
+	entries, err := routeJournal.entries()
+	if err != nil {
+		return fmt.Errorf("could not read journal : %v", err)
+	}
+	routes := unfinishedRoutes(entries)
+
+	openOrders := make(map[string]bittrex.Order)
+	if source, isSource := exchange.(openOrderSource); isSource {
+		orders, err := source.GetOpenOrders("all")
+		if err != nil {
+			return fmt.Errorf("could not get open orders : %v", err)
+		}
+		for _, order := range orders {
+			openOrders[order.OrderUuid] = order
+		}
+	} else {
+		logger.warn("exchange cannot list open orders, trusting the journal", field("exchange", exchange.Name()))
+	}
+	logger.info("reconciling", field("journal", routeJournal.path), field("unfinishedRoutes", len(routes)), field("openOrders", len(openOrders)))
+
+	for _, route := range routes {
+		for _, placed := range route.Orders {
+			status, seen := route.Statuses[placed.OrderId]
+			_, open := openOrders[placed.OrderId]
+			delete(openOrders, placed.OrderId)
+			if seen && !status.IsOpen && !open {
+				continue
+			}
+			if open {
+				if err := exchange.CancelOrder(placed.OrderId); err != nil {
+					return fmt.Errorf("could not cancel order %v of %v : %v", placed.OrderId, route.RouteId, err)
+				}
+				logger.info("order canceled", field("routeId", route.RouteId), field("orderId", placed.OrderId), field("market", placed.Market))
+			}
+			order, err := exchange.GetOrder(placed.OrderId)
+			if err != nil {
+				return fmt.Errorf("could not get order %v of %v : %v", placed.OrderId, route.RouteId, err)
+			}
+			route.Statuses[placed.OrderId] = order
+			journal.status(route.RouteId, order)
+		}
+	}
+	for orderId, order := range openOrders {
+		logger.warn("open order not placed by a journaled route, leaving it", field("orderId", orderId), field("market", order.Exchange), field("type", order.OrderType), field("quantity", order.Quantity), field("rate", order.Limit))
+	}
+	if len(routes) == 0 {
+		return nil
+	}
+
+	marketSummaries, err := updateMarketSummaries(exchange)
+	if err != nil {
+		return fmt.Errorf("could not get market summaries : %v", err)
+	}
+	if err := acctBalance.updateAccountBalances(exchange); err != nil {
+		return fmt.Errorf("could not get balances : %v", err)
+	}
+	view := newMarketView(marketSummaries, time.Now().UTC())
+	for _, route := range routes {
+		view.settle(route, exchange)
+	}
+	return nil
+}
+
+// settle resumes or unwinds one unfinished route and journals its outcome.
+func (v *marketView) settle(route *unfinishedRoute, exchange Exchange) {
+	origin := route.Path[0]
+	held := route.holdings()
+	recovered := held[origin]
+	delete(held, origin)
+	// Only what is still in the account can be traded.
+	for coinName, amount := range held {
+		if available, _ := acctBalance.get(coinName); available.LessThan(amount) {
+			held[coinName] = available
+		}
+		if !held[coinName].GreaterThan(decimal.Zero) {
+			delete(held, coinName)
+		}
+	}
+	routeLogger := logger.with(field("route", strings.Join(append(append([]string{}, route.Path...), origin), " -> ")), field("routeId", route.RouteId))
+	for coinName, amount := range held {
+		routeLogger.info("unfinished route holds", field("currency", coinName), field("amount", amount))
+	}
+
+	outcome := routeOutcome{
+		Path:     route.Path,
+		Result:   decimal.Zero,
+		Stranded: held,
+	}
+	switch resumeAt, resumed, unwound := v.resumeOrUnwind(route.Path, held); {
+	case len(held) == 0:
+		routeLogger.info("unfinished route has nothing left to settle")
+	case unwindPolicy == unwindHold:
+		routeLogger.warn("holding leftovers of unfinished route", field("unwind", unwindHold))
+	case resumeAt > 0 && resumed.GreaterThan(unwound):
+		routeLogger.info("resuming route", field("leg", resumeAt), field("quoted", resumed), field("unwindQuoted", unwound))
+		outcome = v.executeLegs(route.RouteId, route.Path, resumeAt, held[route.Path[resumeAt]], exchange)
+	default:
+		routeLogger.info("unwinding route", field("quoted", unwound))
+		outcome.Result = v.unwind(route.RouteId, origin, held, exchange)
+	}
+	outcome.Result = outcome.Result.Add(recovered)
+	risk.recordOutcome(v, origin, route.Stake, outcome)
+	journal.outcome(v, route.RouteId, route.Stake, outcome)
+	dashboard.recordRoute(route.Path, route.Stake, outcome)
+}
+
+// resumeOrUnwind quotes finishing the route from the one coin it holds
+// against converting that coin straight back to the origin. resumeAt is 0
+// when the route cannot be resumed.
+func (v *marketView) resumeOrUnwind(path []string, held map[string]decimal.Decimal) (int, decimal.Decimal, decimal.Decimal) {
+	origin := path[0]
+	if len(held) != 1 {
+		return 0, decimal.Zero, decimal.Zero
+	}
+	for coinName, amount := range held {
+		unwound := decimal.Zero
+		if v.existingMarket(coinName, origin) != "" {
+			if quoted, tradable, err := v.quoteTrade(coinName, origin, amount); tradable && err == nil {
+				unwound = quoted
+			}
+		}
+		for index := 1; index < len(path); index++ {
+			if path[index] != coinName {
+				continue
+			}
+			resumed := amount
+			for legIndex := index; legIndex < len(path); legIndex++ {
+				quoted, tradable, err := v.quoteTrade(path[legIndex], path[(legIndex+1)%len(path)], resumed)
+				if !tradable || err != nil {
+					return 0, decimal.Zero, unwound
+				}
+				resumed = quoted
+			}
+			return index, resumed, unwound
+		}
+		return 0, decimal.Zero, unwound
+	}
+	return 0, decimal.Zero, decimal.Zero
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+func filledOrder(orderId string, quantity string, price string) *bittrex.Order2 {
+	return &bittrex.Order2{OrderUuid: orderId, Quantity: dec(quantity), Price: dec(price)}
+}
+
+func assertHoldings(t *testing.T, got map[string]decimal.Decimal, want map[string]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("holdings %v, want %v", got, want)
+		return
+	}
+	for coinName, amount := range want {
+		assertDecimal(t, coinName, got[coinName], amount)
+	}
+}
+
+func TestUnfinishedRoutes(t *testing.T) {
+	path3 := []string{"BTC", "ETH", "USDT"}
+	decision := &journalDecision{Path: path3, Stake: dec("0.005")}
+	buy := func(orderId string) *journalOrder {
+		return &journalOrder{OrderId: orderId, Market: "BTC-ETH", LimitType: "buy"}
+	}
+	entries := []journalEntry{
+		// route-1 finished.
+		{Kind: entryDecision, RouteId: "route-1", Decision: decision},
+		{Kind: entryOrder, RouteId: "route-1", Order: buy("order-1")},
+		{Kind: entryStatus, RouteId: "route-1", Status: filledOrder("order-1", "0.1", "0.005")},
+		{Kind: entryOutcome, RouteId: "route-1", Outcome: &journalOutcome{Complete: true}},
+		// route-2 died after its first leg, with a second order rejected.
+		{Kind: entryDecision, RouteId: "route-2", Decision: decision},
+		{Kind: entryOrder, RouteId: "route-2", Order: buy("order-2")},
+		{Kind: entryStatus, RouteId: "route-2", Status: filledOrder("order-2", "0.1", "0.005")},
+		{Kind: entryOrder, RouteId: "route-2", Order: &journalOrder{Market: "USDT-ETH", LimitType: "sell", Err: "INSUFFICIENT_FUNDS"}},
+		// route-3 was interrupted holding ETH, then died selling it back.
+		{Kind: entryDecision, RouteId: "route-3", Decision: decision},
+		{Kind: entryOrder, RouteId: "route-3", Order: buy("order-3")},
+		{Kind: entryStatus, RouteId: "route-3", Status: filledOrder("order-3", "0.1", "0.005")},
+		{Kind: entryOutcome, RouteId: "route-3", Outcome: &journalOutcome{Interrupted: true, Stranded: map[string]decimal.Decimal{"ETH": dec("0.1")}}},
+		{Kind: entryOrder, RouteId: "route-3", Order: &journalOrder{OrderId: "order-4", Market: "BTC-ETH", LimitType: "sell"}},
+		{Kind: entryStatus, RouteId: "route-3", Status: filledOrder("order-4", "0.1", "0.00499")},
+		// route-4 is paper, route-5 was blocked and route-6 is spatial.
+		{Kind: entryDecision, RouteId: "route-4", Decision: &journalDecision{Path: path3, Stake: dec("0.005"), Paper: true}},
+		{Kind: entryDecision, RouteId: "route-5", Decision: &journalDecision{Path: path3, Stake: dec("0.005"), Blocked: "halted"}},
+		{Kind: entryDecision, RouteId: "route-6", Decision: &journalDecision{Path: []string{"BTC", "ETH"}, Stake: dec("0.005"), Venues: []string{"a", "b"}}},
+		// route-7 placed an order no status was seen for.
+		{Kind: entryDecision, RouteId: "route-7", Decision: decision},
+		{Kind: entryOrder, RouteId: "route-7", Order: buy("order-7")},
+	}
+
+	routes := unfinishedRoutes(entries)
+	routeIds := make([]string, len(routes))
+	for index, route := range routes {
+		routeIds[index] = route.RouteId
+	}
+	if len(routes) != 3 || routeIds[0] != "route-2" || routeIds[1] != "route-3" || routeIds[2] != "route-7" {
+		t.Fatalf("unfinished routes %v, want route-2, route-3 and route-7", routeIds)
+	}
+	if len(routes[0].Orders) != 1 {
+		t.Errorf("route-2 orders %v, want only the one placed", routes[0].Orders)
+	}
+	if routes[1].Interrupted == nil || len(routes[1].Orders) != 1 || routes[1].Orders[0].OrderId != "order-4" {
+		t.Errorf("route-3 interrupted %v with orders %v, want order-4 after the interruption", routes[1].Interrupted, routes[1].Orders)
+	}
+
+	assertHoldings(t, routes[0].holdings(), map[string]string{"ETH": "0.1"})
+	assertHoldings(t, routes[1].holdings(), map[string]string{"BTC": "0.00499"})
+	// Until its status is known the order is assumed not to have executed.
+	assertHoldings(t, routes[2].holdings(), map[string]string{"BTC": "0.005"})
+}
+
+func TestResumeOrUnwind(t *testing.T) {
+	setupTest(t)
+	fees = newFeeModel(feeConfig{})
+	path3 := []string{"BTC", "ETH", "USDT"}
+	tests := []struct {
+		name      string
+		summaries []bittrex.MarketSummary
+		held      map[string]decimal.Decimal
+		resumeAt  int
+		resumed   string
+		unwound   string
+	}{
+		// 0.1 ETH sells for 51.1 USDT and buys 0.00511 BTC, or sells straight
+		// back for 0.00499 BTC.
+		{"resume", testSummaries(), map[string]decimal.Decimal{"ETH": dec("0.1")}, 1, "0.00511", "0.00499"},
+		// USDT-BTC is far dearer, so finishing the route is quoted at 0.00425833.
+		{"unwind", []bittrex.MarketSummary{
+			testSummaries()[0],
+			testSummaries()[1],
+			{MarketName: "USDT-BTC", Ask: dec("12000"), Bid: dec("11990"), Last: dec("11995")},
+		}, map[string]decimal.Decimal{"ETH": dec("0.1")}, 1, "0.00425833", "0.00499"},
+		{"last leg", testSummaries(), map[string]decimal.Decimal{"USDT": dec("51.1")}, 2, "0.00511", "0.00511"},
+		{"not on the path", testSummaries(), map[string]decimal.Decimal{"LTC": dec("1")}, 0, "0", "0"},
+		{"several coins", testSummaries(), map[string]decimal.Decimal{"ETH": dec("0.05"), "USDT": dec("25")}, 0, "0", "0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			view := newMarketView(test.summaries, time.Now())
+			resumeAt, resumed, unwound := view.resumeOrUnwind(path3, test.held)
+			if resumeAt != test.resumeAt {
+				t.Errorf("resume at %v, want %v", resumeAt, test.resumeAt)
+			}
+			assertDecimal(t, "resumed", resumed, test.resumed)
+			assertDecimal(t, "unwound", unwound, test.unwound)
+		})
+	}
+}
+
+func TestReconcileSettlesJournaledRoutes(t *testing.T) {
+	fake, client, stop := startTestBittrex(t, map[string]decimal.Decimal{"BTC": dec("0.995"), "ETH": dec("0.1")})
+	defer stop()
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+	var err error
+	if journal, err = openJournal(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// route-1 was interrupted holding the 0.1 ETH its first leg bought.
+	path3 := []string{"BTC", "ETH", "USDT"}
+	view := newMarketView(testSummaries(), time.Now())
+	journal.decision("route-1", path3, dec("0.005"), dec("0.00011"), nil)
+	journal.outcome(view, "route-1", dec("0.005"), routeOutcome{Path: path3, Result: decimal.Zero, Stranded: map[string]decimal.Decimal{"ETH": dec("0.1")}, Interrupted: true})
+	// route-2 died with its first order resting on an empty book.
+	fake.setOrderBook("BTC-ETH", bittrex.OrderBook{Buy: []bittrex.Orderb{{Quantity: dec("10"), Rate: dec("0.0499")}}})
+	orderId, err := client.BuyLimit("BTC-ETH", dec("0.1"), dec("0.05"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.decision("route-2", path3, dec("0.005"), dec("0.00011"), nil)
+	journal.order(trackedOrder{RouteId: "route-2", OrderId: orderId, Market: "BTC-ETH", LimitType: "buy", Quantity: dec("0.1"), Rate: dec("0.05")})
+
+	if err := reconcile(client, journal); err != nil {
+		t.Fatal(err)
+	}
+	if open, err := client.GetOpenOrders("all"); err != nil || len(open) != 0 {
+		t.Errorf("open orders %v (%v), want route-2's canceled", open, err)
+	}
+	entries, err := journal.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes := unfinishedRoutes(entries); len(routes) != 0 {
+		t.Errorf("%v routes still unfinished", len(routes))
+	}
+	results := make(map[string]*journalOutcome)
+	for _, entry := range entries {
+		if entry.Kind == entryOutcome && !entry.Outcome.Interrupted {
+			results[entry.RouteId] = entry.Outcome
+		}
+	}
+	// Resuming route-1 sells the ETH for 51.1 USDT and buys 0.00511 BTC,
+	// route-2 gets its stake back.
+	if outcome := results["route-1"]; outcome == nil || !outcome.Complete {
+		t.Fatalf("route-1 outcome %+v, want it resumed to completion", outcome)
+	}
+	assertDecimal(t, "route-1 result", results["route-1"].Result, "0.00511")
+	if results["route-2"] == nil {
+		t.Fatal("no outcome for route-2")
+	}
+	assertDecimal(t, "route-2 result", results["route-2"].Result, "0.005")
+	assertBalance(t, client, "BTC", "1.00011")
+	assertBalance(t, client, "ETH", "0")
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		inFlight bool
+		cancels  int
+	}{
+		{"routes finish", false, 0},
+		{"grace passes", true, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			defer func(grace time.Duration) { shutdownGrace = grace }(shutdownGrace)
+			shutdownGrace = 10 * time.Millisecond
+			exchange := &stubExchange{}
+			orderTracker.orders["order-1"] = &trackedOrder{OrderId: "order-1", Market: "BTC-ETH", State: orderPending}
+			if test.inFlight {
+				routeGate.enter()
+				defer routeGate.leave()
+			}
+
+			shutdown(os.Interrupt, exchange)
+			if routeGate.enter() {
+				t.Error("routes may still start")
+			}
+			if exchange.cancels != test.cancels {
+				t.Errorf("%v orders canceled, want %v", exchange.cancels, test.cancels)
+			}
+			if err := risk.allowOrder(); (err != nil) != test.inFlight {
+				t.Errorf("allowOrder = %v, want halted %v", err, test.inFlight)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/toorop/go-bittrex"
+)
+
+// snapshotRecorder appends marketSnapshots to gzip compressed newline-delimited
+// JSON files, starting a new timestamped file every rotateEvery and keeping at
+// most maxFiles of them when maxFiles is positive.
+type snapshotRecorder struct {
+	lock        sync.Mutex
+	dir         string
+	rotateEvery time.Duration
+	maxFiles    int
+	file        *os.File
+	writer      *gzip.Writer
+	opened      time.Time
+}
+
+func newSnapshotRecorder(dir string, rotateEvery time.Duration, maxFiles int) (*snapshotRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &snapshotRecorder{
+		dir:         dir,
+		rotateEvery: rotateEvery,
+		maxFiles:    maxFiles,
+	}, nil
+}
+
+func (r *snapshotRecorder) record(snapshot marketSnapshot) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil || (r.rotateEvery > 0 && snapshot.Time.Sub(r.opened) >= r.rotateEvery) {
+		if err := r.rotate(snapshot.Time); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if _, err = r.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// Flush every snapshot so a killed process leaves a readable file behind.
+	return r.writer.Flush()
+}
+
+func (r *snapshotRecorder) rotate(now time.Time) error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	name := filepath.Join(r.dir, "snapshots-"+now.UTC().Format("20060102T150405")+".jsonl.gz")
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.writer = gzip.NewWriter(file)
+	r.opened = now
+	return r.prune()
+}
+
+func (r *snapshotRecorder) prune() error {
+	if r.maxFiles <= 0 {
+		return nil
+	}
+	existing, err := filepath.Glob(filepath.Join(r.dir, "snapshots-*.jsonl.gz"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(existing)
+	for len(existing) > r.maxFiles {
+		if err := os.Remove(existing[0]); err != nil {
+			return err
+		}
+		existing = existing[1:]
+	}
+	return nil
+}
+
+func (r *snapshotRecorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.writer.Close()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	r.writer = nil
+	return err
+}
+
+func (r *snapshotRecorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closeFile()
+}
+
+// candidateOrderBooks fetches the books behind the best routes of every origin
+// pair.
+func (v *marketView) candidateOrderBooks(exchange Exchange, vesselsPerPair int) map[string]bittrex.OrderBook {
+	orderBooks := make(map[string]bittrex.OrderBook)
+	for market := range v.candidateMarkets(vesselsPerPair) {
+		orderBook, err := exchange.GetOrderBook(market)
+		if err != nil {
+			logger.warn("could not get order book", field("market", market), field("err", err))
+			continue
+		}
+		orderBooks[market] = orderBook
+	}
+	return orderBooks
+}
+
+// candidateMarkets lists the direct market of every origin pair and the origin
+// and output legs through each of its top vessels.
+func (v *marketView) candidateMarkets(vesselsPerPair int) map[string]bool {
+	wanted := make(map[string]bool)
+	for originName := range v.summaries {
+		for otherOriginName, routes := range v.summaries[originName] {
+			if market := v.existingMarket(originName, otherOriginName); market != "" {
+				wanted[market] = true
+			}
+			for i := len(routes) - 1; i >= 0 && i >= len(routes)-vesselsPerPair; i-- {
+				for _, market := range []string{
+					v.existingMarket(originName, routes[i].Vessel),
+					v.existingMarket(otherOriginName, routes[i].Vessel),
+				} {
+					if market != "" {
+						wanted[market] = true
+					}
+				}
+			}
+		}
+	}
+
+	return wanted
+}
+
+// existingMarket returns whichever of a-b or b-a is listed, or "".
+func (v *marketView) existingMarket(a, b string) string {
+	if v.marketNames[getMarketName(a, b)] {
+		return getMarketName(a, b)
+	}
+	if v.marketNames[getMarketName(b, a)] {
+		return getMarketName(b, a)
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/toorop/go-bittrex"
+)
+
+func recordedSnapshots(t *testing.T, dir string) []marketSnapshot {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "snapshots-*.jsonl.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := loadSnapshots(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshots
+}
+
+func TestRecorderReplays(t *testing.T) {
+	setupTest(t)
+	dir, err := ioutil.TempDir("", "chaingang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recorder, err := newSnapshotRecorder(dir, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	start := time.Date(2018, 1, 2, 3, 0, 0, 0, time.UTC)
+	orderBook := bittrex.OrderBook{
+		Buy:  []bittrex.Orderb{{Quantity: dec("2"), Rate: dec("0.0499")}, {Quantity: dec("5"), Rate: dec("0.049")}},
+		Sell: []bittrex.Orderb{{Quantity: dec("1"), Rate: dec("0.05")}},
+	}
+	snapshots := []marketSnapshot{
+		{Time: start, Exchange: "Bittrex", Summaries: testSummaries()},
+		{Time: start.Add(30 * time.Minute), Exchange: "Bittrex", Summaries: testSummaries()[:2]},
+		{Time: start.Add(90 * time.Minute), Exchange: "Bittrex", Summaries: testSummaries(), OrderBooks: map[string]bittrex.OrderBook{"BTC-ETH": orderBook}},
+		{Time: start.Add(3 * time.Hour), Exchange: "Bittrex", Summaries: testSummaries()[1:]},
+	}
+	for _, snapshot := range snapshots[:2] {
+		if err := recorder.record(snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The file still being written to reads back as far as it was flushed.
+	if recorded := recordedSnapshots(t, dir); len(recorded) != 2 {
+		t.Fatalf("read %v snapshots while recording, want 2", len(recorded))
+	}
+	for _, snapshot := range snapshots[2:] {
+		if err := recorder.record(snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each snapshot after the first hour opened a new file, and only the
+	// newest two files are kept.
+	recorded := recordedSnapshots(t, dir)
+	if len(recorded) != 2 {
+		t.Fatalf("read %v snapshots, want the last 2", len(recorded))
+	}
+	replay := &replaySource{snapshots: recorded}
+	if _, err := replay.GetMarketSummaries(); err == nil {
+		t.Error("summaries served before the replay started")
+	}
+	for _, want := range snapshots[2:] {
+		if !replay.next() {
+			t.Fatal("replay ended early")
+		}
+		if got := replay.snapshot(); !got.Time.Equal(want.Time) || got.Exchange != want.Exchange {
+			t.Errorf("replayed %v from %v, want %v from %v", got.Time, got.Exchange, want.Time, want.Exchange)
+		}
+		summaries, err := replay.GetMarketSummaries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(summaries) != len(want.Summaries) {
+			t.Fatalf("replayed %v summaries, want %v", len(summaries), len(want.Summaries))
+		}
+		for index, summary := range summaries {
+			if summary.MarketName != want.Summaries[index].MarketName {
+				t.Errorf("summary %v is %v, want %v", index, summary.MarketName, want.Summaries[index].MarketName)
+			}
+			assertDecimal(t, summary.MarketName+" ask", summary.Ask, want.Summaries[index].Ask.String())
+			assertDecimal(t, summary.MarketName+" bid", summary.Bid, want.Summaries[index].Bid.String())
+		}
+	}
+	if replay.next() {
+		t.Error("replay went past the last snapshot")
+	}
+
+	replay = &replaySource{snapshots: recorded}
+	replay.next()
+	book, err := replay.GetOrderBook("BTC-ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Buy) != 2 || len(book.Sell) != 1 {
+		t.Fatalf("replayed book %+v, want 2 bids and 1 ask", book)
+	}
+	assertDecimal(t, "second bid", book.Buy[1].Rate, "0.049")
+	assertDecimal(t, "second bid quantity", book.Buy[1].Quantity, "5")
+	assertDecimal(t, "ask", book.Sell[0].Rate, "0.05")
+	if _, err := replay.GetOrderBook("USDT-ETH"); err == nil {
+		t.Error("replayed a book that was never recorded")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// apiConfig limits and retries the calls made to an exchange. Durations are
+// written like 500ms, and settings left out keep their defaults.
+type apiConfig struct {
+	// RateLimits caps each call, named as in the API metrics such as
+	// GetOrderBook, "default" caps the calls not listed.
+	RateLimits map[string]rateLimit `json:"rateLimits"`
+	// Retries is how often a call failing for a transient reason is made
+	// again, waiting RetryDelay doubled each time up to MaxRetryDelay.
+	Retries       *int   `json:"retries"`
+	RetryDelay    string `json:"retryDelay"`
+	MaxRetryDelay string `json:"maxRetryDelay"`
+	// BreakerFailures calls failing in a row open the circuit for
+	// BreakerCooldown, 0 never opens it.
+	BreakerFailures *int   `json:"breakerFailures"`
+	BreakerCooldown string `json:"breakerCooldown"`
+}
+
+type rateLimit struct {
+	PerSecond float64 `json:"perSecond"`
+	Burst     int     `json:"burst"`
+}
+
+func defaultAPIConfig() apiConfig {
+	retries, breakerFailures := 3, 5
+	return apiConfig{
+		RateLimits: map[string]rateLimit{
+			"default": {PerSecond: 2, Burst: 10},
+		},
+		Retries:         &retries,
+		RetryDelay:      "500ms",
+		MaxRetryDelay:   "8s",
+		BreakerFailures: &breakerFailures,
+		BreakerCooldown: "60s",
+	}
+}
+
+// over returns the defaults with every setting a has replacing them.
+func (a apiConfig) over(defaults apiConfig) apiConfig {
+	merged := defaults
+	merged.RateLimits = make(map[string]rateLimit)
+	for call, limit := range defaults.RateLimits {
+		merged.RateLimits[call] = limit
+	}
+	for call, limit := range a.RateLimits {
+		merged.RateLimits[call] = limit
+	}
+	if a.Retries != nil {
+		merged.Retries = a.Retries
+	}
+	if a.RetryDelay != "" {
+		merged.RetryDelay = a.RetryDelay
+	}
+	if a.MaxRetryDelay != "" {
+		merged.MaxRetryDelay = a.MaxRetryDelay
+	}
+	if a.BreakerFailures != nil {
+		merged.BreakerFailures = a.BreakerFailures
+	}
+	if a.BreakerCooldown != "" {
+		merged.BreakerCooldown = a.BreakerCooldown
+	}
+	return merged
+}
+
+func (a apiConfig) validate() []string {
+	problems := make([]string, 0)
+	for call, limit := range a.RateLimits {
+		if limit.PerSecond <= 0 || limit.Burst < 1 {
+			problems = append(problems, fmt.Sprintf("api: rate limit of %v needs a positive perSecond and a burst of at least 1", call))
+		}
+	}
+	if a.Retries != nil && *a.Retries < 0 {
+		problems = append(problems, fmt.Sprintf("api: retries %v must not be negative", *a.Retries))
+	}
+	if a.BreakerFailures != nil && *a.BreakerFailures < 0 {
+		problems = append(problems, fmt.Sprintf("api: breakerFailures %v must not be negative", *a.BreakerFailures))
+	}
+	for label, value := range map[string]string{
+		"retryDelay":      a.RetryDelay,
+		"maxRetryDelay":   a.MaxRetryDelay,
+		"breakerCooldown": a.BreakerCooldown,
+	} {
+		if duration, err := time.ParseDuration(value); value != "" && (err != nil || duration <= 0) {
+			problems = append(problems, fmt.Sprintf("api: %v %q must be a positive duration such as 500ms", label, value))
+		}
+	}
+	return problems
+}
+
+// callPolicy is a validated apiConfig.
+type callPolicy struct {
+	rateLimits      map[string]rateLimit
+	retries         int
+	retryDelay      time.Duration
+	maxRetryDelay   time.Duration
+	breakerFailures int
+	breakerCooldown time.Duration
+}
+
+func (a apiConfig) policy() callPolicy {
+	a = a.over(defaultAPIConfig())
+	policy := callPolicy{
+		rateLimits:      a.RateLimits,
+		retries:         *a.Retries,
+		breakerFailures: *a.BreakerFailures,
+	}
+	policy.retryDelay, _ = time.ParseDuration(a.RetryDelay)
+	policy.maxRetryDelay, _ = time.ParseDuration(a.MaxRetryDelay)
+	policy.breakerCooldown, _ = time.ParseDuration(a.BreakerCooldown)
+	return policy
+}
+
+/* ******************************************************************
+ * Errors
+ * *****************************************************************/
+
+var (
+	errCircuitOpen      = errors.New("circuit open")
+	errOrderNotReturned = errors.New("order not returned")
+)
+
+// retryable says whether a call that failed with err could succeed if made
+// again: the exchange was unreachable, timed out, was overloaded or did not
+// answer in JSON. Messages from the exchange, such as INSUFFICIENT_FUNDS, are
+// answers and making the call again would get the same one.
+func retryable(err error) bool {
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &netErr), errors.As(err, &syntaxErr), errors.Is(err, errOrderNotReturned):
+		return true
+	case err.Error() == "timeout on reading data from Bittrex API":
+		return true
+	}
+	status := httpStatus(err)
+	return status == 429 || status >= 500
+}
+
+// unsent says the request failed before the exchange could act on it, so an
+// order can be placed again without risk of placing it twice.
+func unsent(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return httpStatus(err) == 429
+}
+
+// httpStatus is the status of the response the client turned into err, or 0.
+func httpStatus(err error) int {
+	fields := strings.Fields(err.Error())
+	if len(fields) < 2 || len(fields[0]) != 3 {
+		return 0
+	}
+	status, parseErr := strconv.Atoi(fields[0])
+	if parseErr != nil || status < 100 || status > 599 {
+		return 0
+	}
+	return status
+}
+
+/* ******************************************************************
+ * Guard
+ * *****************************************************************/
+
+type tokenBucket struct {
+	perSecond float64
+	burst     float64
+	tokens    float64
+	updated   time.Time
+}
+
+// reserve takes a token and says how long to wait until it may be used.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.perSecond)
+	b.updated = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.perSecond * float64(time.Second))
+}
+
+// callGuard rate limits every call to one exchange, retries those that fail
+// for transient reasons and opens a circuit once too many fail in a row.
+// While the circuit is open calls fail at once, except cancels, and no
+// route starts; after the cooldown a single call is let through to probe
+// whether the exchange is back.
+type callGuard struct {
+	lock      sync.Mutex
+	name      string
+	policy    callPolicy
+	buckets   map[string]*tokenBucket
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCallGuard(name string, policy callPolicy) *callGuard {
+	return &callGuard{
+		name:    name,
+		policy:  policy,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// call makes do, limited and retried as call. Calls that are not idempotent
+// are only made again when the exchange cannot have received them.
+func (g *callGuard) call(call string, idempotent bool, do func() error) error {
+	if err := g.admit(call); err != nil {
+		return err
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		time.Sleep(g.reserve(call))
+		err = do()
+		if err == nil || !retryable(err) {
+			break
+		}
+		if (!idempotent && !unsent(err)) || attempt >= g.policy.retries {
+			break
+		}
+		delay := g.backoff(attempt)
+		apiRetriesMetric.inc(call)
+		logger.warn("retrying exchange call", field("exchange", g.name), field("call", call), field("attempt", attempt+1), field("delay", delay), field("err", err))
+		time.Sleep(delay)
+	}
+	g.record(call, err == nil || !retryable(err))
+	return err
+}
+
+// admit refuses calls while the circuit is open. Cancels only make the
+// account safer and always go through.
+func (g *callGuard) admit(call string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if call == "CancelOrder" || !g.open() {
+		return nil
+	}
+	if time.Now().Before(g.openUntil) || g.probing {
+		return fmt.Errorf("%v %v skipped : %w until %v", g.name, call, errCircuitOpen, g.openUntil.Format(time.RFC3339))
+	}
+	g.probing = true
+	return nil
+}
+
+func (g *callGuard) open() bool {
+	return g.policy.breakerFailures > 0 && g.failures >= g.policy.breakerFailures
+}
+
+func (g *callGuard) record(call string, answered bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	wasOpen := g.open()
+	g.probing = false
+	if answered {
+		g.failures = 0
+		if wasOpen {
+			circuitOpenMetric.set(0, g.name)
+			logger.info("circuit closed", field("exchange", g.name), field("call", call))
+		}
+		return
+	}
+	g.failures++
+	if g.open() {
+		g.openUntil = time.Now().Add(g.policy.breakerCooldown)
+		circuitOpenMetric.set(1, g.name)
+		logger.error("circuit open", field("exchange", g.name), field("call", call), field("failures", g.failures), field("until", g.openUntil.Format(time.RFC3339)))
+	}
+}
+
+// circuitErr says why no route may start on the exchange right now.
+func (g *callGuard) circuitErr() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.open() {
+		return nil
+	}
+	return fmt.Errorf("%v %w after %v failed calls", g.name, errCircuitOpen, g.failures)
+}
+
+func (g *callGuard) reserve(call string) time.Duration {
+	limit, limited := g.policy.rateLimits[call]
+	if !limited {
+		limit, limited = g.policy.rateLimits["default"]
+	}
+	if !limited {
+		return 0
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	bucket, exists := g.buckets[call]
+	if !exists {
+		bucket = &tokenBucket{perSecond: limit.PerSecond, burst: float64(limit.Burst), tokens: float64(limit.Burst), updated: time.Now()}
+		g.buckets[call] = bucket
+	}
+	return bucket.reserve(time.Now())
+}
+
+// backoff doubles the retry delay every attempt and picks a random wait
+// between half of it and all of it, so clients do not retry in step.
+func (g *callGuard) backoff(attempt int) time.Duration {
+	delay := g.policy.retryDelay << uint(attempt)
+	if delay > g.policy.maxRetryDelay || delay <= 0 {
+		delay = g.policy.maxRetryDelay
+	}
+	if delay < 2 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// circuitReporter is implemented by exchanges whose calls go through a
+// callGuard.
+type circuitReporter interface {
+	circuitErr() error
+}
+
+// exchangeHealthy says why no route should start on exchange.
+func exchangeHealthy(exchange Exchange) error {
+	if reporter, ok := exchange.(circuitReporter); ok {
+		return reporter.circuitErr()
+	}
+	return nil
+}
+
+/* ******************************************************************
+ * Order Placement
+ * *****************************************************************/
+
+// placeOrder places an order at most once. When it fails in a way that
+// leaves open whether the exchange took it, the account's orders are searched
+// for it before giving up.
+func (b *bittrexExchange) placeOrder(call string, orderType string, market string, quantity, rate decimal.Decimal, place func(string, decimal.Decimal, decimal.Decimal) (string, error)) (string, error) {
+	sent := time.Now()
+	var orderId string
+	err := b.guard.call(call, false, func() (err error) {
+		orderId, err = place(market, quantity, rate)
+		return err
+	})
+	if err == nil || !retryable(err) || unsent(err) {
+		return orderId, err
+	}
+	logger.warn("order may have been placed, looking for it", field("market", market), field("type", orderType), field("quantity", quantity), field("rate", rate), field("err", err))
+	found, lookupErr := b.findOrder(orderType, market, quantity, rate, sent.Add(-orderLookupSkew))
+	if lookupErr != nil {
+		return "", fmt.Errorf("%v, and the order may have been placed : %v", err, lookupErr)
+	}
+	if found == "" {
+		return "", fmt.Errorf("%v, no matching order was found but it may still appear", err)
+	}
+	logger.warn("order was placed despite the error", field("orderId", found), field("market", market), field("err", err))
+	return found, nil
+}
+
+// findOrder returns the id of an order not yet tracked that matches the one
+// placed, open or closed since.
+func (b *bittrexExchange) findOrder(orderType string, market string, quantity, rate decimal.Decimal, since time.Time) (string, error) {
+	var open, history []bittrex.Order
+	err := b.guard.call("GetOpenOrders", true, func() (err error) {
+		open, err = b.client.GetOpenOrders(market)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	err = b.guard.call("GetOrderHistory", true, func() (err error) {
+		history, err = b.client.GetOrderHistory(market)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, order := range append(open, history...) {
+		if _, tracked := orderTracker.get(order.OrderUuid); tracked {
+			continue
+		}
+		if order.Exchange == market && order.OrderType == orderType && order.Quantity.Equal(quantity) && order.Limit.Equal(rate) && !order.TimeStamp.Before(since) {
+			return order.OrderUuid, nil
+		}
+	}
+	return "", nil
+}
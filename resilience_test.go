@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// testPolicy retries twice without waiting long and never opens the circuit.
+func testPolicy() callPolicy {
+	retries, breakerFailures := 2, 0
+	return apiConfig{
+		Retries:         &retries,
+		RetryDelay:      "1ms",
+		MaxRetryDelay:   "2ms",
+		BreakerFailures: &breakerFailures,
+	}.policy()
+}
+
+func (f *fakeBittrex) callCount(endpoint string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[endpoint]
+}
+
+func TestCallGuardRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		failure fakeError
+		calls   int
+		err     bool
+	}{
+		{name: "retryable 5xx", failure: fakeError{Endpoint: "getmarketsummaries", Status: 503, Message: "Service Unavailable"}, calls: 2},
+		{name: "5xx past the retries", failure: fakeError{Endpoint: "getmarketsummaries", Status: 502, Message: "Bad Gateway", Times: 5}, calls: 3, err: true},
+		{name: "4xx not retried", failure: fakeError{Endpoint: "getmarketsummaries", Status: 400, Message: "Bad Request"}, calls: 1, err: true},
+		{name: "exchange answer not retried", failure: fakeError{Endpoint: "getmarketsummaries", Message: "INVALID_MARKET"}, calls: 1, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, client, stop := startTestBittrex(t, nil)
+			defer stop()
+			client.guard = newCallGuard("Bittrex", testPolicy())
+			fake.fail(test.failure)
+			_, err := client.GetMarketSummaries()
+			if (err != nil) != test.err {
+				t.Errorf("err = %v, want an error %v", err, test.err)
+			}
+			if calls := fake.callCount("getmarketsummaries"); calls != test.calls {
+				t.Errorf("called %v times, want %v", calls, test.calls)
+			}
+		})
+	}
+}
+
+func TestCallGuardBreaker(t *testing.T) {
+	setupTest(t)
+	guard := newCallGuard("test", callPolicy{breakerFailures: 2, breakerCooldown: 20 * time.Millisecond})
+	failing := func() error { return errOrderNotReturned }
+	calls := 0
+	counted := func() error {
+		calls++
+		return nil
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		guard.call("GetOrder", true, failing)
+	}
+	if err := guard.circuitErr(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("circuit not open after 2 failures: %v", err)
+	}
+	if err := guard.call("GetOrder", true, counted); !errors.Is(err, errCircuitOpen) || calls != 0 {
+		t.Errorf("call while open made %v calls and returned %v", calls, err)
+	}
+	// A cancel goes through, though here it fails and keeps the circuit open.
+	canceled := false
+	guard.call("CancelOrder", true, func() error {
+		canceled = true
+		return errOrderNotReturned
+	})
+	if !canceled {
+		t.Error("cancel refused while open")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	probing, release := make(chan struct{}), make(chan struct{})
+	probed := make(chan error)
+	go func() {
+		probed <- guard.call("GetOrder", true, func() error {
+			close(probing)
+			<-release
+			return nil
+		})
+	}()
+	<-probing
+	if err := guard.call("GetOrder", true, counted); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("second call let through while probing: %v", err)
+	}
+	close(release)
+	if err := <-probed; err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if err := guard.circuitErr(); err != nil {
+		t.Errorf("circuit still open after the probe: %v", err)
+	}
+	if err := guard.call("GetOrder", true, counted); err != nil {
+		t.Errorf("call refused once closed: %v", err)
+	}
+}
+
+func TestPlaceOrderAfterTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		executed bool
+		found    bool
+	}{
+		{name: "placed before the timeout", executed: true, found: true},
+		{name: "not placed", executed: false, found: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, client, stop := startTestBittrex(t, map[string]decimal.Decimal{"BTC": dec("1")})
+			defer stop()
+			client.guard = newCallGuard("Bittrex", testPolicy())
+			fake.fail(fakeError{Endpoint: "buylimit", Status: 504, Message: "Gateway Timeout", Executed: test.executed})
+
+			orderId, err := client.BuyLimit("BTC-ETH", dec("0.1"), dec("0.05"))
+			if calls := fake.callCount("buylimit"); calls != 1 {
+				t.Errorf("sent the order %v times, want once", calls)
+			}
+			if !test.found {
+				if err == nil || !strings.Contains(err.Error(), "no matching order") {
+					t.Errorf("err = %v, want no matching order found", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			order, err := client.GetOrder(orderId)
+			if err != nil {
+				t.Fatalf("found order %v can't be read: %v", orderId, err)
+			}
+			assertDecimal(t, "quantity", order.Quantity, "0.1")
+			history, err := client.client.GetOrderHistory("BTC-ETH")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 1 {
+				t.Errorf("%v orders on the account, want 1", len(history))
+			}
+		})
+	}
+}
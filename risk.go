@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// riskConfig limits what trading may do. Notional and loss are valued in
+// Currency at the Last price, and a zero limit is no limit.
+type riskConfig struct {
+	Currency          string          `json:"currency"`
+	MaxTradeNotional  decimal.Decimal `json:"maxTradeNotional"`
+	MaxHourlyNotional decimal.Decimal `json:"maxHourlyNotional"`
+	MaxDailyNotional  decimal.Decimal `json:"maxDailyNotional"`
+	MaxOpenOrders     int             `json:"maxOpenOrders"`
+	MaxLoss           decimal.Decimal `json:"maxLoss"`
+	// KillFile stops trading as soon as the file exists.
+	KillFile string `json:"killFile"`
+}
+
+type riskTrade struct {
+	Time     time.Time
+	Notional decimal.Decimal
+}
+
+// riskManager vets every route before it trades and every order before it is
+// placed. Once halted, by the loss limit or the kill switch, it refuses
+// everything until restarted.
+type riskManager struct {
+	lock       sync.Mutex
+	limits     riskConfig
+	trades     []*riskTrade
+	realized   decimal.Decimal
+	halted     bool
+	haltReason string
+}
+
+func newRiskManager(limits riskConfig) *riskManager {
+	if limits.Currency == "" {
+		limits.Currency = valuationCurrency
+	}
+	return &riskManager{
+		limits:   limits,
+		trades:   make([]*riskTrade, 0),
+		realized: decimal.Zero,
+	}
+}
+
+// allowRoute reserves stake of origin against the notional limits, or says
+// why the route may not trade. A route that goes on to place no order gives
+// the reservation back with release. The hourly and daily windows run on the
+// view's clock, so a backtest counts them in recorded time.
+func (r *riskManager) allowRoute(v *marketView, origin string, stake decimal.Decimal) (*riskTrade, error) {
+	if err := r.allowOrder(); err != nil {
+		return nil, err
+	}
+	notional, valued := v.valueIn(origin, r.limits.Currency, stake)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	hasNotionalLimit := r.limits.MaxTradeNotional.GreaterThan(decimal.Zero) || r.limits.MaxHourlyNotional.GreaterThan(decimal.Zero) || r.limits.MaxDailyNotional.GreaterThan(decimal.Zero)
+	if !valued {
+		if hasNotionalLimit {
+			return nil, fmt.Errorf("cannot value %v in %v", origin, r.limits.Currency)
+		}
+		return nil, nil
+	}
+
+	now := v.now()
+	r.prune(now)
+	hourly := notional
+	daily := notional
+	for _, trade := range r.trades {
+		daily = daily.Add(trade.Notional)
+		if now.Sub(trade.Time) < time.Hour {
+			hourly = hourly.Add(trade.Notional)
+		}
+	}
+	if exceeds(notional, r.limits.MaxTradeNotional) {
+		return nil, fmt.Errorf("trade notional %v %v is above the limit of %v", notional.StringFixed(2), r.limits.Currency, r.limits.MaxTradeNotional)
+	}
+	if exceeds(hourly, r.limits.MaxHourlyNotional) {
+		return nil, fmt.Errorf("hourly notional would reach %v %v, the limit is %v", hourly.StringFixed(2), r.limits.Currency, r.limits.MaxHourlyNotional)
+	}
+	if exceeds(daily, r.limits.MaxDailyNotional) {
+		return nil, fmt.Errorf("daily notional would reach %v %v, the limit is %v", daily.StringFixed(2), r.limits.Currency, r.limits.MaxDailyNotional)
+	}
+	trade := &riskTrade{Time: now, Notional: notional}
+	r.trades = append(r.trades, trade)
+	return trade, nil
+}
+
+// release gives back the notional allowRoute reserved for a route that never
+// traded.
+func (r *riskManager) release(trade *riskTrade) {
+	if trade == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for index, reserved := range r.trades {
+		if reserved == trade {
+			r.trades = append(r.trades[:index], r.trades[index+1:]...)
+			return
+		}
+	}
+}
+
+// allowOrder says why no order may be placed right now.
+func (r *riskManager) allowOrder() error {
+	if r.killFileExists() {
+		r.halt("kill file " + r.limits.KillFile + " exists")
+	}
+	r.lock.Lock()
+	halted, haltReason, maxOpenOrders := r.halted, r.haltReason, r.limits.MaxOpenOrders
+	r.lock.Unlock()
+	if halted {
+		return fmt.Errorf("trading halted : %v", haltReason)
+	}
+	if open := len(orderTracker.open()); maxOpenOrders > 0 && open >= maxOpenOrders {
+		return fmt.Errorf("%v orders open, the limit is %v", open, maxOpenOrders)
+	}
+	return nil
+}
+
+// recordOutcome books what a route made or lost and halts trading once the
+// losses reach MaxLoss. Stranded coins are valued where they are.
+func (r *riskManager) recordOutcome(v *marketView, origin string, stake decimal.Decimal, outcome routeOutcome) {
+	pnl, valued := v.outcomePnl(origin, r.limits.Currency, stake, outcome)
+	if !valued {
+		return
+	}
+
+	r.lock.Lock()
+	r.realized = r.realized.Add(pnl)
+	realized := r.realized
+	r.lock.Unlock()
+	realizedMetric.set(decimalFloat(realized), r.limits.Currency)
+	logger.info("realized", field("pnl", pnl.StringFixed(4)), field("realized", realized.StringFixed(4)), field("currency", r.limits.Currency))
+	if r.limits.MaxLoss.GreaterThan(decimal.Zero) && !realized.GreaterThan(decimal.Zero.Sub(r.limits.MaxLoss)) {
+		r.halt(fmt.Sprintf("realized %v %v, the loss limit is %v", realized.StringFixed(4), r.limits.Currency, r.limits.MaxLoss))
+	}
+}
+
+// outcomePnl values what a route made or lost in currency, stranded coins
+// included where they can be valued.
+func (v *marketView) outcomePnl(origin string, currency string, stake decimal.Decimal, outcome routeOutcome) (decimal.Decimal, bool) {
+	stakeValue, stakeValued := v.valueIn(origin, currency, stake)
+	resultValue, resultValued := v.valueIn(origin, currency, outcome.Result)
+	if !stakeValued || !resultValued {
+		return decimal.Zero, false
+	}
+	pnl := resultValue.Sub(stakeValue)
+	for coinName, amount := range outcome.Stranded {
+		if value, valued := v.valueIn(coinName, currency, amount); valued {
+			pnl = pnl.Add(value)
+		}
+	}
+	return pnl, true
+}
+
+func (r *riskManager) halt(reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.halted {
+		return
+	}
+	r.halted = true
+	r.haltReason = reason
+	logger.error("trading halted", field("reason", reason))
+}
+
+// kill halts trading and cancels every order that is still open, on the
+// exchange it was placed on when that is known.
+func (r *riskManager) kill(exchange Exchange, reason string) {
+	r.halt(reason)
+	for _, tracked := range orderTracker.open() {
+		placedOn := exchange
+		if tracked.exchange != nil {
+			placedOn = tracked.exchange
+		}
+		if err := placedOn.CancelOrder(tracked.OrderId); err != nil {
+			logger.error("could not cancel order", field("orderId", tracked.OrderId), field("market", tracked.Market), field("err", err))
+		} else {
+			logger.info("order canceled", field("orderId", tracked.OrderId), field("market", tracked.Market))
+		}
+	}
+}
+
+func (r *riskManager) killFileExists() bool {
+	if r.limits.KillFile == "" {
+		return false
+	}
+	_, err := os.Stat(r.limits.KillFile)
+	return err == nil
+}
+
+// watch kills trading on SIGUSR1 or once the kill file appears.
+func (r *riskManager) watch(exchange Exchange) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	ticker := time.NewTicker(killFilePollInterval)
+	go func() {
+		for {
+			select {
+			case received := <-signals:
+				r.kill(exchange, "received "+received.String())
+			case <-ticker.C:
+				if r.killFileExists() {
+					r.kill(exchange, "kill file "+r.limits.KillFile+" exists")
+				}
+			}
+		}
+	}()
+}
+
+func (r *riskManager) prune(now time.Time) {
+	kept := r.trades[:0]
+	for _, trade := range r.trades {
+		if now.Sub(trade.Time) < 24*time.Hour {
+			kept = append(kept, trade)
+		}
+	}
+	r.trades = kept
+}
+
+func exceeds(value decimal.Decimal, limit decimal.Decimal) bool {
+	return limit.GreaterThan(decimal.Zero) && value.GreaterThan(limit)
+}
+
+// valueIn values amount of coinName in currency at the Last price of the
+// market between them.
+func (v *marketView) valueIn(coinName string, currency string, amount decimal.Decimal) (decimal.Decimal, bool) {
+	if coinName == currency {
+		return amount, true
+	}
+	if coin, exists := v.coins[coinName]; exists && v.marketNames[getMarketName(currency, coinName)] {
+		return amount.Mul(coin.Relationships[currency].Last), true
+	}
+	if coin, exists := v.coins[currency]; exists && v.marketNames[getMarketName(coinName, currency)] {
+		if last := coin.Relationships[coinName].Last; last.GreaterThan(decimal.Zero) {
+			return amount.Div(last), true
+		}
+	}
+	return decimal.Zero, false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// newRiskView prices BTC at a Last of 9995 USDT, so a 0.005 BTC stake is
+// 49.975 USDT of notional.
+func newRiskView(t *testing.T, limits riskConfig) *marketView {
+	t.Helper()
+	setupTest(t)
+	risk = newRiskManager(limits)
+	return newMarketView(testSummaries(), time.Now())
+}
+
+func TestRiskLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits riskConfig
+		// earlier trades, as how long ago and their notional
+		earlier map[time.Duration]string
+		origin  string
+		stake   string
+		allowed bool
+	}{
+		{name: "no limits", origin: "BTC", stake: "1", allowed: true},
+		{name: "within the trade limit", limits: riskConfig{MaxTradeNotional: dec("50")}, origin: "BTC", stake: "0.005", allowed: true},
+		{name: "above the trade limit", limits: riskConfig{MaxTradeNotional: dec("50")}, origin: "BTC", stake: "0.006", allowed: false},
+		{
+			name:    "above the hourly limit",
+			limits:  riskConfig{MaxHourlyNotional: dec("80")},
+			earlier: map[time.Duration]string{30 * time.Minute: "40"},
+			origin:  "BTC", stake: "0.005", allowed: false,
+		},
+		{
+			name:    "hourly limit only counts the last hour",
+			limits:  riskConfig{MaxHourlyNotional: dec("80")},
+			earlier: map[time.Duration]string{2 * time.Hour: "40"},
+			origin:  "BTC", stake: "0.005", allowed: true,
+		},
+		{
+			name:    "above the daily limit",
+			limits:  riskConfig{MaxDailyNotional: dec("80")},
+			earlier: map[time.Duration]string{2 * time.Hour: "40"},
+			origin:  "BTC", stake: "0.005", allowed: false,
+		},
+		{
+			name:    "daily limit only counts the last day",
+			limits:  riskConfig{MaxDailyNotional: dec("80")},
+			earlier: map[time.Duration]string{25 * time.Hour: "40"},
+			origin:  "BTC", stake: "0.005", allowed: true,
+		},
+		{name: "origin that can't be valued", limits: riskConfig{MaxTradeNotional: dec("50")}, origin: "XRP", stake: "1", allowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			view := newRiskView(t, test.limits)
+			for ago, notional := range test.earlier {
+				risk.trades = append(risk.trades, &riskTrade{Time: time.Now().Add(-ago), Notional: dec(notional)})
+			}
+			_, err := risk.allowRoute(view, test.origin, dec(test.stake))
+			if (err == nil) != test.allowed {
+				t.Errorf("allowRoute = %v, want allowed %v", err, test.allowed)
+			}
+		})
+	}
+}
+
+func TestRiskOpenOrderLimit(t *testing.T) {
+	view := newRiskView(t, riskConfig{MaxOpenOrders: 1})
+	if _, err := risk.allowRoute(view, "BTC", dec("0.005")); err != nil {
+		t.Fatal(err)
+	}
+	orderTracker.orders["order-1"] = &trackedOrder{OrderId: "order-1", State: orderPending}
+	if _, err := risk.allowRoute(view, "BTC", dec("0.005")); err == nil {
+		t.Error("allowed a route with the open order limit reached")
+	}
+}
+
+func TestRiskRelease(t *testing.T) {
+	view := newRiskView(t, riskConfig{MaxHourlyNotional: dec("80")})
+	reservation, err := risk.allowRoute(view, "BTC", dec("0.005"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := risk.allowRoute(view, "BTC", dec("0.005")); err == nil {
+		t.Fatal("allowed a second route past the hourly limit")
+	}
+	risk.release(reservation)
+	risk.release(nil)
+	if _, err := risk.allowRoute(view, "BTC", dec("0.005")); err != nil {
+		t.Errorf("released notional still counted: %v", err)
+	}
+}
+
+func TestRiskReleasedWhenNoOrderPlaced(t *testing.T) {
+	view := newRiskView(t, riskConfig{MaxHourlyNotional: dec("80")})
+	live = true
+	acctBalance.balances["BTC"] = dec("1")
+	exchange := &stubExchange{placeErr: errors.New("INSUFFICIENT_FUNDS")}
+	view.executeIndirectRoute("BTC", "ETH", "USDT", dec("0.0001"), exchange)
+	if len(risk.trades) != 0 {
+		t.Errorf("%v reservations kept for a route that placed no order", len(risk.trades))
+	}
+}
+
+func TestRiskMaxLossHalts(t *testing.T) {
+	view := newRiskView(t, riskConfig{MaxLoss: dec("5")})
+	// Losing 0.0004 BTC is about 4 USDT, short of the limit.
+	risk.recordOutcome(view, "BTC", dec("0.005"), routeOutcome{Result: dec("0.0046"), Stranded: map[string]decimal.Decimal{}})
+	if _, err := risk.allowRoute(view, "BTC", dec("0.005")); err != nil {
+		t.Fatalf("halted before the loss limit: %v", err)
+	}
+	risk.recordOutcome(view, "BTC", dec("0.005"), routeOutcome{Result: dec("0.0046"), Stranded: map[string]decimal.Decimal{}})
+	if _, err := risk.allowRoute(view, "BTC", dec("0.005")); err == nil {
+		t.Error("still trading past the loss limit")
+	}
+	// Gains don't lift the halt.
+	risk.recordOutcome(view, "BTC", dec("0.005"), routeOutcome{Result: dec("0.01"), Stranded: map[string]decimal.Decimal{}})
+	if _, err := risk.allowRoute(view, "BTC", dec("0.005")); err == nil {
+		t.Error("trading resumed after a gain")
+	}
+}
+
+func TestRiskKillFileHalts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaingang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	killFile := filepath.Join(dir, "kill")
+	view := newRiskView(t, riskConfig{KillFile: killFile})
+	if _, err := risk.allowRoute(view, "BTC", dec("0.005")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(killFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := risk.allowRoute(view, "BTC", dec("0.005")); err == nil {
+		t.Error("still trading with the kill file there")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// tradingGate lets routes start until shutdown closes it and keeps count of
+// the ones still in flight.
+type tradingGate struct {
+	lock     sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+// enter reports whether a route may start, call leave once it is done.
+func (g *tradingGate) enter() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		return false
+	}
+	g.inFlight.Add(1)
+	return true
+}
+
+func (g *tradingGate) leave() {
+	g.inFlight.Done()
+}
+
+func (g *tradingGate) isClosed() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.closed
+}
+
+// close stops new routes and waits up to grace for the ones in flight,
+// reporting whether they all finished.
+func (g *tradingGate) close(grace time.Duration) bool {
+	g.lock.Lock()
+	g.closed = true
+	g.lock.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		g.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
+
+// shutdown lets the legs in flight finish, each route stopping before its
+// next leg, and cancels whatever orders are still open once
+// shutdownGrace has passed.
+func shutdown(received os.Signal, exchange Exchange) {
+	logger.info("shutting down", field("signal", received.String()), field("grace", shutdownGrace))
+	if routeGate.close(shutdownGrace) {
+		logger.info("routes in flight finished")
+		return
+	}
+	logger.warn("routes still in flight, canceling open orders", field("grace", shutdownGrace))
+	risk.kill(exchange, "shutdown grace of "+shutdownGrace.String()+" passed")
+	// The routes see their orders canceled on the next poll and journal it.
+	if !routeGate.close(2 * orderPollInterval) {
+		logger.error("routes still in flight at exit, reconcile on the next start")
+	}
+}
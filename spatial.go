@@ -0,0 +1,556 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// venue is one exchange the spatial command trades on, with its own fee
+// schedule, market limits and balances.
+type venue struct {
+	name     string
+	exchange Exchange
+	fees     *feeModel
+	limits   *marketCatalog
+	balances *balances
+	// commission is what the venue charged so far, in each market base
+	commission map[string]decimal.Decimal
+	// withdrawals is the flat fee, per currency, for moving it off the venue
+	withdrawals map[string]decimal.Decimal
+}
+
+// venueQuotes is what a cycle fetched from one venue.
+type venueQuotes struct {
+	venue     *venue
+	summaries []bittrex.MarketSummary
+	markets   map[string]bittrex.MarketSummary
+	received  time.Time
+	err       error
+}
+
+// spatialOpportunity buys Quantity of the market currency at Ask on Buy and
+// sells it at Bid on Sell, both legs at once out of the inventory each venue
+// already holds. Cost and Proceeds are in the market base, after each
+// venue's taker fee. Gain also takes out what rebalancing would cost when
+// both venues list their withdrawal fees.
+type spatialOpportunity struct {
+	Market   string
+	Base     string
+	Currency string
+	Buy      *venue
+	Sell     *venue
+	Ask      decimal.Decimal
+	Bid      decimal.Decimal
+	Quantity decimal.Decimal
+	Cost     decimal.Decimal
+	Proceeds decimal.Decimal
+	Gain     decimal.Decimal
+}
+
+/* ******************************************************************
+ * Venues
+ * *****************************************************************/
+
+// venueEnvName is how an exchange is named in CHAINGANG_KEY_<NAME> and
+// CHAINGANG_SECRET_<NAME>: upper cased, anything but letters and digits
+// turned into underscores.
+func venueEnvName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+}
+
+// connectVenues builds a venue for every exchange in names. The configured
+// exchange reuses activeExchange, every other one needs its own credentials
+// unless trading on paper. On paper each venue gets its own paper exchange
+// holding paperStakeMultiple stakes of its origins, filled by walking the
+// order book with paperDepth.
+func connectVenues(cfg config, names []string, paper bool, paperDepth bool) ([]*venue, error) {
+	venues := make([]*venue, 0, len(names))
+	for _, name := range names {
+		spot := &venue{
+			name:        name,
+			exchange:    activeExchange,
+			fees:        fees,
+			limits:      marketLimits,
+			balances:    &balances{balances: make(map[string]decimal.Decimal)},
+			commission:  make(map[string]decimal.Decimal),
+			withdrawals: make(map[string]decimal.Decimal),
+		}
+		if name != exchangeName {
+			envName := venueEnvName(name)
+			key, secret := os.Getenv("CHAINGANG_KEY_"+envName), os.Getenv("CHAINGANG_SECRET_"+envName)
+			logger.redact(key)
+			logger.redact(secret)
+			logger.info("connecting", field("exchange", name), field("key", key))
+			if (key == "" || secret == "") && !paper {
+				return nil, fmt.Errorf("please provide %v key and secret in CHAINGANG_KEY_%v and CHAINGANG_SECRET_%v", name, envName, envName)
+			}
+			exchange, err := newExchange(cfg.backend(name), key, secret, nil)
+			if err != nil {
+				return nil, err
+			}
+			spot.exchange = exchange
+			spot.fees = newFeeModel(cfg.Exchanges[name].feeSchedule())
+			spot.limits = newMarketCatalog()
+			if err := loadMarketLimits(exchange, spot.limits); err != nil {
+				logger.warn("could not load market limits", field("exchange", name), field("err", err))
+			}
+		}
+		if err := spot.loadWithdrawalFees(); err != nil {
+			logger.warn("could not load withdrawal fees", field("exchange", name), field("err", err))
+		}
+		if paper {
+			paperVenue := newPaperExchange(spot.exchange, paperBalances(validOrigins[name]), paperDepth)
+			paperVenue.name = name
+			paperVenue.fees = spot.fees
+			spot.exchange = paperVenue
+		}
+		venues = append(venues, spot)
+	}
+	return venues, nil
+}
+
+type currencySource interface {
+	GetCurrencies() ([]bittrex.Currency, error)
+}
+
+// loadWithdrawalFees reads each currency's TxFee when the exchange lists them.
+func (spot *venue) loadWithdrawalFees() error {
+	source, isSource := spot.exchange.(currencySource)
+	if !isSource {
+		return nil
+	}
+	currencies, err := source.GetCurrencies()
+	if err != nil {
+		return fmt.Errorf("could not load withdrawal fees : %v", err)
+	}
+	for _, currency := range currencies {
+		spot.withdrawals[currency.Currency] = currency.TxFee
+	}
+	return nil
+}
+
+// fetchVenues reads the market summaries and balances of every venue at once.
+func fetchVenues(venues []*venue) []venueQuotes {
+	quotes := make([]venueQuotes, len(venues))
+	var fetching sync.WaitGroup
+	for index, spot := range venues {
+		fetching.Add(1)
+		go func(index int, spot *venue) {
+			defer fetching.Done()
+			quotes[index].venue = spot
+			summaries, err := spot.exchange.GetMarketSummaries()
+			if err != nil {
+				quotes[index].err = fmt.Errorf("could not get market summaries : %v", err)
+				return
+			}
+			quotes[index].received = time.Now().UTC()
+			if err := spot.balances.updateAccountBalances(spot.exchange); err != nil {
+				quotes[index].err = fmt.Errorf("could not get balances : %v", err)
+				return
+			}
+			quotes[index].summaries = summaries
+			quotes[index].markets = make(map[string]bittrex.MarketSummary, len(summaries))
+			for _, marketSummary := range summaries {
+				quotes[index].markets[marketSummary.MarketName] = marketSummary
+			}
+		}(index, spot)
+	}
+	fetching.Wait()
+	return quotes
+}
+
+/* ******************************************************************
+ * Opportunities
+ * *****************************************************************/
+
+// findSpatial prices every market listed on two venues whose base is an
+// origin on both, best return first.
+func findSpatial(quotes []venueQuotes) []spatialOpportunity {
+	opportunities := make([]spatialOpportunity, 0)
+	for _, buy := range quotes {
+		if buy.err != nil {
+			continue
+		}
+		for _, sell := range quotes {
+			if sell.err != nil || sell.venue == buy.venue {
+				continue
+			}
+			for market, buySummary := range buy.markets {
+				sellSummary, listed := sell.markets[market]
+				if !listed {
+					continue
+				}
+				if err := checkFreshness(map[string]Relationship{
+					buy.venue.name + " " + market:  {Timestamp: parseQuoteTime(buySummary.TimeStamp), Received: buy.received},
+					sell.venue.name + " " + market: {Timestamp: parseQuoteTime(sellSummary.TimeStamp), Received: sell.received},
+				}, time.Now()); err != nil {
+					logger.debug("stale spatial quotes", field("err", err))
+					continue
+				}
+				if opportunity, found := priceSpatial(market, buy.venue, sell.venue, buySummary.Ask, sellSummary.Bid); found {
+					opportunities = append(opportunities, opportunity)
+				}
+			}
+		}
+	}
+	sort.Slice(opportunities, func(aIndex, bIndex int) bool {
+		a, b := opportunities[aIndex], opportunities[bIndex]
+		return a.Gain.Div(a.Cost).GreaterThan(b.Gain.Div(b.Cost))
+	})
+	return opportunities
+}
+
+// priceSpatial sizes the trade to the smaller of the stakes and of what each
+// venue holds, then rounds it to both venues' market limits. The currency
+// is only held to a stake when it is an origin on the sell venue. It reports
+// false when the market does not pay after fees or the trade is too small.
+func priceSpatial(market string, buy *venue, sell *venue, ask decimal.Decimal, bid decimal.Decimal) (spatialOpportunity, bool) {
+	base, currency := splitMarketName(market)
+	for _, spot := range []*venue{buy, sell} {
+		if _, baseIsOrigin := validOrigins[spot.name][base]; !baseIsOrigin {
+			return spatialOpportunity{}, false
+		}
+	}
+	if !ask.GreaterThan(decimal.Zero) || !bid.GreaterThan(decimal.Zero) {
+		return spatialOpportunity{}, false
+	}
+	one := decimal.NewFromFloat(1)
+	buyFee, sellFee := buy.fees.taker(market), sell.fees.taker(market)
+	unitCost := ask.Mul(one.Add(buyFee))
+	if !bid.Mul(one.Sub(sellFee)).GreaterThan(unitCost) {
+		return spatialOpportunity{}, false
+	}
+
+	spend := validOrigins[buy.name][base]
+	if available, _ := buy.balances.get(base); available.LessThan(spend) {
+		spend = available
+	}
+	quantity := spend.Div(unitCost)
+	if stake, isOrigin := validOrigins[sell.name][currency]; isOrigin && stake.LessThan(quantity) {
+		quantity = stake
+	}
+	if available, _ := sell.balances.get(currency); available.LessThan(quantity) {
+		quantity = available
+	}
+	buyLimit, sellLimit := buy.limits.get(market), sell.limits.get(market)
+	quantity = sellLimit.roundQuantity(buyLimit.roundQuantity(quantity))
+	for _, limit := range []marketLimit{buyLimit, sellLimit} {
+		if err := limit.check(market, quantity); err != nil {
+			logger.debug("spatial market left out", field("market", market), field("buy", buy.name), field("sell", sell.name), field("err", err))
+			return spatialOpportunity{}, false
+		}
+	}
+
+	ask = buyLimit.roundRate(ask, "buy")
+	bid = sellLimit.roundRate(bid, "sell")
+	price := quantity.Mul(ask)
+	cost := price.Add(price.Mul(buyFee))
+	proceeds := quantity.Mul(bid)
+	proceeds = proceeds.Sub(proceeds.Mul(sellFee))
+	opportunity := spatialOpportunity{
+		Market:   market,
+		Base:     base,
+		Currency: currency,
+		Buy:      buy,
+		Sell:     sell,
+		Ask:      ask,
+		Bid:      bid,
+		Quantity: quantity,
+		Cost:     cost,
+		Proceeds: proceeds,
+		Gain:     proceeds.Sub(cost),
+	}
+	if rebalance, known := opportunity.rebalanceFee(); known {
+		opportunity.Gain = opportunity.Gain.Sub(rebalance)
+	}
+	return opportunity, cost.GreaterThan(decimal.Zero)
+}
+
+// rebalanceFee is what withdrawing the currency bought on Buy and the base
+// received on Sell would cost, in the base, were the inventory moved back.
+func (o spatialOpportunity) rebalanceFee() (decimal.Decimal, bool) {
+	currencyFee, currencyKnown := o.Buy.withdrawals[o.Currency]
+	baseFee, baseKnown := o.Sell.withdrawals[o.Base]
+	return currencyFee.Mul(o.Bid).Add(baseFee), currencyKnown && baseKnown
+}
+
+/* ******************************************************************
+ * Trading
+ * *****************************************************************/
+
+// executeSpatial places the buy and the sell together. A leg that fills
+// less than the other leaves the difference in Stranded, negative when more
+// currency was sold out of inventory than was bought.
+func executeSpatial(view *marketView, opportunity spatialOpportunity) {
+	if !routeGate.enter() {
+		return
+	}
+	defer routeGate.leave()
+	routeId := newRouteId()
+	path := []string{opportunity.Base, opportunity.Currency}
+	venues := []string{opportunity.Buy.name, opportunity.Sell.name}
+	routeLogger := logger.with(field("market", opportunity.Market), field("buy", opportunity.Buy.name), field("sell", opportunity.Sell.name), field("routeId", routeId))
+	err := exchangeHealthy(opportunity.Buy.exchange)
+	if err == nil {
+		err = exchangeHealthy(opportunity.Sell.exchange)
+	}
+	var reservation *riskTrade
+	if err == nil {
+		reservation, err = risk.allowRoute(view, opportunity.Base, opportunity.Cost)
+	}
+	if err != nil {
+		journal.venueDecision(routeId, path, venues, opportunity.Cost, opportunity.Gain, err)
+		routeLogger.warn("trade blocked", field("err", err))
+		return
+	}
+	routeLogger.info("executing spatial route", field("quantity", opportunity.Quantity), field("ask", opportunity.Ask), field("bid", opportunity.Bid), field("cost", opportunity.Cost), field("currency", opportunity.Base))
+	journal.venueDecision(routeId, path, venues, opportunity.Cost, opportunity.Gain, nil)
+
+	var bought, sold trackedOrder
+	var placing sync.WaitGroup
+	placing.Add(2)
+	go func() {
+		defer placing.Done()
+		bought = orderTracker.place(opportunity.Buy.exchange, routeId, opportunity.Market, "buy", opportunity.Quantity, opportunity.Ask)
+	}()
+	go func() {
+		defer placing.Done()
+		sold = orderTracker.place(opportunity.Sell.exchange, routeId, opportunity.Market, "sell", opportunity.Quantity, opportunity.Bid)
+	}()
+	placing.Wait()
+
+	buyFill := legFill{
+		Market:   opportunity.Market,
+		OrderId:  bought.OrderId,
+		Spent:    orderCost(bought.Order, "buy"),
+		Received: orderProceeds(bought.Order, "buy"),
+		Complete: bought.State == orderFilled,
+	}
+	sellFill := legFill{
+		Market:   opportunity.Market,
+		OrderId:  sold.OrderId,
+		Spent:    orderCost(sold.Order, "sell"),
+		Received: orderProceeds(sold.Order, "sell"),
+		Complete: sold.State == orderFilled,
+	}
+	opportunity.Buy.commission[opportunity.Base] = opportunity.Buy.commission[opportunity.Base].Add(bought.Order.CommissionPaid)
+	opportunity.Sell.commission[opportunity.Base] = opportunity.Sell.commission[opportunity.Base].Add(sold.Order.CommissionPaid)
+
+	outcome := routeOutcome{
+		Path:     path,
+		Legs:     []legFill{buyFill, sellFill},
+		Complete: buyFill.Complete && sellFill.Complete,
+		Result:   opportunity.Cost.Sub(buyFill.Spent).Add(sellFill.Received),
+		Stranded: make(map[string]decimal.Decimal),
+	}
+	if !outcome.placedOrder() {
+		risk.release(reservation)
+	}
+	if imbalance := buyFill.Received.Sub(sellFill.Spent); !imbalance.Equal(decimal.Zero) {
+		outcome.Stranded[opportunity.Currency] = imbalance
+		routeLogger.warn("legs filled unevenly", field("bought", buyFill.Received), field("sold", sellFill.Spent), field("currency", opportunity.Currency))
+	}
+	for _, tracked := range []trackedOrder{bought, sold} {
+		if tracked.State == orderFailed {
+			routeLogger.error("leg failed", field("orderId", tracked.OrderId), field("err", tracked.Err))
+		}
+	}
+	if outcome.Complete {
+		routesMetric.inc("complete")
+	} else {
+		routesMetric.inc("aborted")
+	}
+	routeLogger.info("spatial route done",
+		field("complete", outcome.Complete),
+		field("spent", buyFill.Spent), field("bought", buyFill.Received),
+		field("sold", sellFill.Spent), field("received", sellFill.Received),
+		field("gain", outcome.Result.Sub(opportunity.Cost)), field("currency", opportunity.Base))
+	journal.outcome(view, routeId, opportunity.Cost, outcome)
+	risk.recordOutcome(view, opportunity.Base, opportunity.Cost, outcome)
+	dashboard.recordRoute(path, opportunity.Cost, outcome)
+}
+
+/* ******************************************************************
+ * Loop
+ * *****************************************************************/
+
+// spatialCycle fetches every venue, reports the opportunities and, when
+// live, trades the best one that clears minimumGain.
+func spatialCycle(venues []*venue) {
+	quotes := fetchVenues(venues)
+	for _, quote := range quotes {
+		if quote.err != nil {
+			logger.error("could not fetch venue", field("exchange", quote.venue.name), field("err", quote.err))
+		}
+	}
+	opportunities := findSpatial(quotes)
+	cyclesMetric.inc()
+
+	logger.info("spatial opportunities", field("count", len(opportunities)))
+	for index, opportunity := range opportunities {
+		if index >= spatialShown {
+			break
+		}
+		fields := []logField{
+			field("market", opportunity.Market),
+			field("buy", opportunity.Buy.name), field("ask", opportunity.Ask),
+			field("sell", opportunity.Sell.name), field("bid", opportunity.Bid),
+			field("quantity", opportunity.Quantity),
+			field("gain", opportunity.Gain), field("currency", opportunity.Base),
+		}
+		if rebalance, known := opportunity.rebalanceFee(); known {
+			fields = append(fields, field("rebalanceFee", rebalance))
+		}
+		logger.info("spatial opportunity", fields...)
+	}
+
+	if live && len(opportunities) > 0 && opportunities[0].Gain.GreaterThan(minimumGain) {
+		best := opportunities[0]
+		for _, quote := range quotes {
+			if quote.venue == best.Buy {
+				executeSpatial(newMarketView(quote.summaries, quote.received), best)
+			}
+		}
+		for _, spot := range []*venue{best.Buy, best.Sell} {
+			if err := spot.balances.updateAccountBalances(spot.exchange); err != nil {
+				logger.error("could not update balances", field("exchange", spot.name), field("err", err))
+			}
+		}
+	}
+
+	for _, spot := range venues {
+		for _, balance := range spot.balances.list() {
+			logger.info("balance", field("exchange", spot.name), field("currency", balance.Currency), field("available", balance.Available))
+		}
+		for base, paid := range spot.commission {
+			logger.info("commission paid", field("exchange", spot.name), field("currency", base), field("paid", paid))
+		}
+	}
+}
+
+// runSpatialLoop runs a spatial cycle every pollInterval, one at a time,
+// until SIGINT or SIGTERM.
+func runSpatialLoop(venues []*venue, once bool) {
+	names := make([]string, 0, len(venues))
+	for _, spot := range venues {
+		names = append(names, spot.name)
+	}
+	logger.info("chaingang running spatial", field("exchanges", strings.Join(names, ",")), field("pollInterval", pollInterval), field("live", live), field("paper", paperTrading))
+	if once {
+		spatialCycle(venues)
+		return
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	done := make(chan bool, 1)
+	running := false
+	startCycle := func() {
+		running = true
+		go func() {
+			spatialCycle(venues)
+			done <- true
+		}()
+	}
+	startCycle()
+	for {
+		select {
+		case <-ticker.C:
+			if running {
+				logger.warn("previous cycle still running, skipping this one")
+				continue
+			}
+			startCycle()
+		case <-done:
+			running = false
+		case received := <-stop:
+			shutdown(received, activeExchange)
+			return
+		}
+	}
+}
+
+func runSpatial(args []string) int {
+	flags := newFlagSet("spatial", "[flags]")
+	connection := addConnectionFlags(flags)
+	addr := addListenFlag(flags)
+	exchanges := flags.String("exchanges", "", "comma separated exchanges to trade against each other, defaults to the configured spatial list")
+	paper := flags.Bool("paper", false, "trade on paper exchanges with virtual balances")
+	liveFlag := flags.Bool("live", false, "place real orders")
+	paperDepth := addPaperDepthFlag(flags)
+	minGain := flags.Float64("min-gain", 0, "only trade markets whose expected gain is above this, in the market base")
+	orderTimeout := flags.Duration("order-timeout", orderDeadline, "cancel orders still open this long after being placed")
+	journalPath := flags.String("journal", "", "append every route traded to this journal file, defaults to the configured one")
+	grace := flags.Duration("shutdown-grace", shutdownGrace, "on SIGINT or SIGTERM, wait this long for routes in flight before canceling their orders")
+	once := flags.Bool("once", false, "run a single cycle and exit")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if *paper && *liveFlag {
+		fmt.Fprintln(os.Stderr, "--paper and --live cannot be used together")
+		return exitUsage
+	}
+
+	cfg, err := connection.connect()
+	if err != nil {
+		return fail(err)
+	}
+	names := cfg.Spatial
+	if *exchanges != "" {
+		names = strings.Split(*exchanges, ",")
+	}
+	if len(names) < 2 {
+		return fail(errors.New("spatial needs at least two exchanges: pass --exchanges or set spatial in the config"))
+	}
+	for _, name := range names {
+		if _, exists := cfg.Exchanges[name]; !exists {
+			return fail(fmt.Errorf("exchange %q is not configured", name))
+		}
+	}
+
+	mode := tradingMode(cfg, *paper, *liveFlag)
+	minimumGain = decimal.NewFromFloat(*minGain)
+	orderDeadline = *orderTimeout
+	shutdownGrace = *grace
+	live = mode != modeDryRun
+	paperTrading = mode == modePaper
+	if mode == modeLive {
+		if err := connection.requireAuthenticated(); err != nil {
+			return fail(err)
+		}
+	}
+	venues, err := connectVenues(cfg, names, paperTrading, *paperDepth)
+	if err != nil {
+		return fail(err)
+	}
+	if *journalPath == "" {
+		*journalPath = cfg.Journal
+	}
+	if *journalPath != "" && live {
+		if journal, err = openJournal(*journalPath); err != nil {
+			return fail(err)
+		}
+		defer journal.Close()
+	}
+	risk.watch(activeExchange)
+	listen(*addr)
+	runSpatialLoop(venues, *once)
+	return exitOK
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// newSpatialVenue has no fees and no market limits, and holds holdings.
+func newSpatialVenue(name string, holdings map[string]string) *venue {
+	spot := &venue{
+		name:        name,
+		fees:        newFeeModel(feeConfig{}),
+		limits:      newMarketCatalog(),
+		balances:    &balances{balances: make(map[string]decimal.Decimal)},
+		commission:  make(map[string]decimal.Decimal),
+		withdrawals: make(map[string]decimal.Decimal),
+	}
+	for currency, amount := range holdings {
+		spot.balances.balances[currency] = dec(amount)
+	}
+	return spot
+}
+
+func TestPriceSpatialTakesOutRebalanceFee(t *testing.T) {
+	tests := []struct {
+		name     string
+		withdraw map[string]string
+		gain     string
+	}{
+		{name: "withdrawal fees unknown", gain: "0.0002"},
+		{name: "only one withdrawal fee known", withdraw: map[string]string{"ETH": "0.002"}, gain: "0.0002"},
+		// 0.002 ETH at 0.051 and 0.0001 BTC
+		{name: "both withdrawal fees known", withdraw: map[string]string{"ETH": "0.002", "BTC": "0.0001"}, gain: "-0.000002"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			stakes := map[string]decimal.Decimal{"BTC": dec("0.01"), "ETH": dec("1")}
+			validOrigins = map[string]map[string]decimal.Decimal{"A": stakes, "B": stakes}
+			buy := newSpatialVenue("A", map[string]string{"BTC": "1"})
+			sell := newSpatialVenue("B", map[string]string{"ETH": "10"})
+			if fee, withdrawn := test.withdraw["ETH"]; withdrawn {
+				buy.withdrawals["ETH"] = dec(fee)
+			}
+			if fee, withdrawn := test.withdraw["BTC"]; withdrawn {
+				sell.withdrawals["BTC"] = dec(fee)
+			}
+			opportunity, found := priceSpatial("BTC-ETH", buy, sell, dec("0.05"), dec("0.051"))
+			if !found {
+				t.Fatal("market not priced")
+			}
+			assertDecimal(t, "quantity", opportunity.Quantity, "0.2")
+			assertDecimal(t, "gain", opportunity.Gain, test.gain)
+		})
+	}
+}
+
+func TestPriceSpatialBaseMustBeOrigin(t *testing.T) {
+	setupTest(t)
+	stakes := map[string]decimal.Decimal{"BTC": dec("0.01")}
+	validOrigins = map[string]map[string]decimal.Decimal{"A": stakes, "B": stakes}
+	buy := newSpatialVenue("A", map[string]string{"BTC": "1", "ETH": "1"})
+	sell := newSpatialVenue("B", map[string]string{"LTC": "1", "ETH": "1"})
+
+	// 0.01 BTC buys 2.5 LTC, but B only holds 1 to sell.
+	opportunity, found := priceSpatial("BTC-LTC", buy, sell, dec("0.004"), dec("0.0041"))
+	if !found {
+		t.Fatal("market with an origin base not priced")
+	}
+	assertDecimal(t, "quantity", opportunity.Quantity, "1")
+	assertDecimal(t, "gain", opportunity.Gain, "0.0001")
+
+	if _, found := priceSpatial("ETH-LTC", buy, sell, dec("0.08"), dec("0.09")); found {
+		t.Error("priced a market whose base is not an origin")
+	}
+}
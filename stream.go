@@ -0,0 +1,345 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+// exchangeStreamer is implemented by exchanges that push order book deltas.
+type exchangeStreamer interface {
+	SubscribeExchangeUpdate(market string, dataCh chan<- bittrex.ExchangeState, stop <-chan bool) error
+}
+
+// OrderUpdate.Type values sent in exchange deltas
+const (
+	orderUpdateAdd    = 0
+	orderUpdateRemove = 1
+	orderUpdateChange = 2
+)
+
+/* ******************************************************************
+ * Local Order Book
+ * *****************************************************************/
+
+// localBook is an in-memory order book kept current from exchange deltas.
+// Deltas that arrive before the initial state are held until it shows up.
+type localBook struct {
+	market  string
+	nounce  int
+	synced  bool
+	bids    map[string]bittrex.Orderb
+	asks    map[string]bittrex.Orderb
+	pending []bittrex.ExchangeState
+}
+
+func newLocalBook(market string) *localBook {
+	return &localBook{
+		market: market,
+		bids:   make(map[string]bittrex.Orderb),
+		asks:   make(map[string]bittrex.Orderb),
+	}
+}
+
+// apply folds state into the book and returns false when a gap in Nounce
+// means deltas were lost and the book has to be rebuilt.
+func (b *localBook) apply(state bittrex.ExchangeState) bool {
+	if state.Initial {
+		b.bids = make(map[string]bittrex.Orderb)
+		b.asks = make(map[string]bittrex.Orderb)
+		applyOrderUpdates(b.bids, state.Buys)
+		applyOrderUpdates(b.asks, state.Sells)
+		b.nounce = state.Nounce
+		b.synced = true
+
+		pending := b.pending
+		b.pending = nil
+		sort.Slice(pending, func(aIndex, bIndex int) bool {
+			return pending[aIndex].Nounce < pending[bIndex].Nounce
+		})
+		for _, delta := range pending {
+			if !b.apply(delta) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !b.synced {
+		b.pending = append(b.pending, state)
+		return true
+	}
+	if state.Nounce <= b.nounce {
+		// Already part of the initial state or a duplicate.
+		return true
+	}
+	if state.Nounce != b.nounce+1 {
+		return false
+	}
+	applyOrderUpdates(b.bids, state.Buys)
+	applyOrderUpdates(b.asks, state.Sells)
+	b.nounce = state.Nounce
+	return true
+}
+
+func applyOrderUpdates(levels map[string]bittrex.Orderb, updates []bittrex.OrderUpdate) {
+	for _, update := range updates {
+		key := update.Rate.String()
+		if update.Type == orderUpdateRemove || !update.Quantity.GreaterThan(decimal.Zero) {
+			delete(levels, key)
+		} else {
+			levels[key] = update.Orderb
+		}
+	}
+}
+
+// top returns the best bid and ask, or false while either side is empty.
+func (b *localBook) top() (decimal.Decimal, decimal.Decimal, bool) {
+	var bid, ask decimal.Decimal
+	hasBid, hasAsk := false, false
+	for _, level := range b.bids {
+		if !hasBid || level.Rate.GreaterThan(bid) {
+			bid = level.Rate
+			hasBid = true
+		}
+	}
+	for _, level := range b.asks {
+		if !hasAsk || level.Rate.LessThan(ask) {
+			ask = level.Rate
+			hasAsk = true
+		}
+	}
+	return bid, ask, hasBid && hasAsk
+}
+
+/* ******************************************************************
+ * Subscriptions
+ * *****************************************************************/
+
+// orderBookStream keeps one websocket subscription per market alive and calls
+// onUpdate with the new top of book after every applied delta. subscribed
+// holds the channel that unsubscribes each market when closed.
+type orderBookStream struct {
+	streamer   exchangeStreamer
+	onUpdate   func(market string, bid decimal.Decimal, ask decimal.Decimal)
+	lock       sync.Mutex
+	subscribed map[string]chan struct{}
+}
+
+func newOrderBookStream(streamer exchangeStreamer, onUpdate func(market string, bid decimal.Decimal, ask decimal.Decimal)) *orderBookStream {
+	return &orderBookStream{
+		streamer:   streamer,
+		onUpdate:   onUpdate,
+		subscribed: make(map[string]chan struct{}),
+	}
+}
+
+// track streams exactly markets: it subscribes to those not streamed yet and
+// unsubscribes from those no longer wanted.
+func (s *orderBookStream) track(markets map[string]bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for market, unsubscribe := range s.subscribed {
+		if !markets[market] {
+			close(unsubscribe)
+			delete(s.subscribed, market)
+			logger.debug("unsubscribed", field("market", market))
+		}
+	}
+	for market := range markets {
+		if _, subscribed := s.subscribed[market]; subscribed {
+			continue
+		}
+		unsubscribe := make(chan struct{})
+		s.subscribed[market] = unsubscribe
+		go s.run(market, unsubscribe)
+	}
+}
+
+// close unsubscribes from every market.
+func (s *orderBookStream) close() {
+	s.track(nil)
+}
+
+func (s *orderBookStream) markets() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	markets := make([]string, 0, len(s.subscribed))
+	for market := range s.subscribed {
+		markets = append(markets, market)
+	}
+	sort.Strings(markets)
+	return markets
+}
+
+// run rebuilds the book from a fresh subscription whenever the connection
+// drops or a Nounce gap is seen, until unsubscribe is closed.
+func (s *orderBookStream) run(market string, unsubscribe <-chan struct{}) {
+	for {
+		dataCh := make(chan bittrex.ExchangeState, streamBufferSize)
+		stop := make(chan bool)
+		done := make(chan error, 1)
+		go func() {
+			done <- s.streamer.SubscribeExchangeUpdate(market, dataCh, stop)
+		}()
+
+		book := newLocalBook(market)
+		resync := false
+		for !resync {
+			select {
+			case state := <-dataCh:
+				if !book.apply(state) {
+					logger.warn("nounce gap, resyncing", field("market", market), field("nounce", book.nounce), field("received", state.Nounce))
+					resync = true
+					continue
+				}
+				if book.synced {
+					bid, ask, hasTop := book.top()
+					if hasTop {
+						s.onUpdate(market, bid, ask)
+					}
+				}
+			case err := <-done:
+				logger.warn("stream ended", field("market", market), field("err", err))
+				resync = true
+			case <-unsubscribe:
+				close(stop)
+				return
+			}
+		}
+		close(stop)
+		select {
+		case <-unsubscribe:
+			return
+		case <-time.After(streamResyncDelay):
+		}
+	}
+}
+
+/* ******************************************************************
+ * Route Re-evaluation
+ * *****************************************************************/
+
+// streamQuote is a new top of book, sent from a market's stream to the loop.
+type streamQuote struct {
+	market string
+	bid    decimal.Decimal
+	ask    decimal.Decimal
+}
+
+// withQuote returns a copy of the view with the market's relationship moved
+// to the streamed top of book and every route that goes through it
+// re-scored, along with the best routes the quote made worth trading. The
+// view itself is left as it was.
+func (v *marketView) withQuote(market string, bid decimal.Decimal, ask decimal.Decimal) (*marketView, []summary) {
+	base, currency := splitMarketName(market)
+	if _, coinExists := v.coins[currency]; !coinExists || !bid.GreaterThan(decimal.Zero) || !ask.GreaterThan(decimal.Zero) {
+		return v, nil
+	}
+	next := &marketView{
+		coins:       make(map[string]*Coin, len(v.coins)),
+		marketNames: v.marketNames,
+		summaries:   make(map[string]map[string][]summary, len(v.summaries)),
+		rejections:  make(map[string]string, len(v.rejections)),
+		received:    v.received,
+		replayed:    v.replayed,
+	}
+	for coinName, coin := range v.coins {
+		next.coins[coinName] = coin
+	}
+	for originName := range v.summaries {
+		next.summaries[originName] = make(map[string][]summary, len(v.summaries[originName]))
+		for otherOriginName, routes := range v.summaries[originName] {
+			next.summaries[originName][otherOriginName] = append([]summary{}, routes...)
+		}
+	}
+	for routeName, reason := range v.rejections {
+		next.rejections[routeName] = reason
+	}
+
+	// Deltas carry no exchange time, the quote is as old as its arrival.
+	received := time.Now().UTC()
+	coin := next.copyCoin(currency)
+	relationship := coin.Relationships[base]
+	relationship.Ask = ask
+	relationship.Bid = bid
+	relationship.Timestamp = time.Time{}
+	relationship.Received = received
+	coin.Relationships[base] = relationship
+
+	vessels := []string{currency}
+	_, baseIsOrigin := validOrigins[exchangeName][base]
+	_, currencyIsOrigin := validOrigins[exchangeName][currency]
+	if baseIsOrigin && currencyIsOrigin {
+		// Keep the inverse populateCoins derived in step, every route uses it.
+		if _, baseExists := next.coins[base]; baseExists {
+			baseCoin := next.copyCoin(base)
+			inverse := baseCoin.Relationships[currency]
+			inverse.Ask = decimal.NewFromFloat(1).Div(ask)
+			inverse.Bid = decimal.NewFromFloat(1).Div(bid)
+			inverse.Timestamp = time.Time{}
+			inverse.Received = received
+			baseCoin.Relationships[currency] = inverse
+		}
+		vessels = make([]string, 0, len(next.coins))
+		for coinName := range next.coins {
+			vessels = append(vessels, coinName)
+		}
+	}
+
+	for originName := range next.summaries {
+		for otherOriginName, routes := range next.summaries[originName] {
+			if len(routes) == 0 {
+				continue
+			}
+			originStake := routes[0].Quantity
+			directAsk, _, _, _ := next.convert(originName, otherOriginName, originStake)
+			for _, vessel := range vessels {
+				for i := range routes {
+					if routes[i].Vessel == vessel {
+						routes = append(routes[:i], routes[i+1:]...)
+						break
+					}
+				}
+				routeValue, isRoute := next.evaluateRoute(originName, vessel, otherOriginName, originStake, directAsk)
+				if isRoute {
+					routes = append(routes, routeValue)
+				}
+			}
+			next.summaries[originName][otherOriginName] = routes
+		}
+	}
+	next.sortSummaries()
+
+	opportunities := make([]summary, 0)
+	for originName := range next.summaries {
+		for _, routes := range next.summaries[originName] {
+			if len(routes) == 0 {
+				continue
+			}
+			best := routes[len(routes)-1]
+			if contains(vessels, best.Vessel) && best.Gain.GreaterThan(minimumGain) {
+				opportunities = append(opportunities, best)
+			}
+		}
+	}
+	return next, opportunities
+}
+
+// copyCoin replaces coinName with a copy whose relationships can be changed
+// without touching the view it was copied from.
+func (v *marketView) copyCoin(coinName string) *Coin {
+	coin := v.coins[coinName]
+	copied := &Coin{
+		Name:          coin.Name,
+		Relationships: make(map[string]Relationship, len(coin.Relationships)),
+	}
+	for relationshipName, relationship := range coin.Relationships {
+		copied.Relationships[relationshipName] = relationship
+	}
+	v.coins[coinName] = copied
+	return copied
+}
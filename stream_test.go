@@ -0,0 +1,185 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/toorop/go-bittrex"
+)
+
+func orderUpdate(updateType int, quantity string, rate string) bittrex.OrderUpdate {
+	return bittrex.OrderUpdate{Type: updateType, Orderb: bittrex.Orderb{Quantity: dec(quantity), Rate: dec(rate)}}
+}
+
+func TestLocalBookApply(t *testing.T) {
+	initial := bittrex.ExchangeState{
+		Nounce:  10,
+		Initial: true,
+		Buys:    []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "1", "0.049")},
+		Sells:   []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "1", "0.051")},
+	}
+	tests := []struct {
+		name    string
+		states  []bittrex.ExchangeState
+		applied bool
+		nounce  int
+		bid     string
+		ask     string
+	}{
+		{
+			name:    "initial state",
+			states:  []bittrex.ExchangeState{initial},
+			applied: true, nounce: 10, bid: "0.049", ask: "0.051",
+		},
+		{
+			name: "next delta",
+			states: []bittrex.ExchangeState{initial, {
+				Nounce: 11,
+				Buys:   []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "2", "0.0495")},
+				Sells:  []bittrex.OrderUpdate{orderUpdate(orderUpdateRemove, "0", "0.051"), orderUpdate(orderUpdateAdd, "3", "0.052")},
+			}},
+			applied: true, nounce: 11, bid: "0.0495", ask: "0.052",
+		},
+		{
+			name: "gap",
+			states: []bittrex.ExchangeState{initial, {
+				Nounce: 13,
+				Buys:   []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "2", "0.0495")},
+			}},
+			applied: false, nounce: 10, bid: "0.049", ask: "0.051",
+		},
+		{
+			name: "stale delta",
+			states: []bittrex.ExchangeState{initial, {
+				Nounce: 9,
+				Buys:   []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "2", "0.0495")},
+			}},
+			applied: true, nounce: 10, bid: "0.049", ask: "0.051",
+		},
+		{
+			name: "deltas held until the initial state",
+			states: []bittrex.ExchangeState{
+				{Nounce: 12, Sells: []bittrex.OrderUpdate{orderUpdate(orderUpdateChange, "0", "0.051")}},
+				{Nounce: 11, Sells: []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "1", "0.053")}},
+				{Nounce: 10, Buys: []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "1", "0.048")}},
+				initial,
+			},
+			applied: true, nounce: 12, bid: "0.049", ask: "0.053",
+		},
+		{
+			name: "gap in held deltas",
+			states: []bittrex.ExchangeState{
+				{Nounce: 12, Sells: []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "1", "0.053")}},
+				initial,
+			},
+			applied: false, nounce: 10, bid: "0.049", ask: "0.051",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			book := newLocalBook("BTC-ETH")
+			applied := true
+			for _, state := range test.states {
+				applied = book.apply(state)
+			}
+			if applied != test.applied {
+				t.Errorf("applied = %v, want %v", applied, test.applied)
+			}
+			if book.nounce != test.nounce {
+				t.Errorf("nounce = %v, want %v", book.nounce, test.nounce)
+			}
+			bid, ask, hasTop := book.top()
+			if !hasTop {
+				t.Fatal("book has no top")
+			}
+			assertDecimal(t, "bid", bid, test.bid)
+			assertDecimal(t, "ask", ask, test.ask)
+		})
+	}
+}
+
+// countingStreamer sends each market an initial book and holds the
+// subscription open until it is stopped, counting those open per market.
+type countingStreamer struct {
+	lock sync.Mutex
+	open map[string]int
+}
+
+func (c *countingStreamer) SubscribeExchangeUpdate(market string, dataCh chan<- bittrex.ExchangeState, stop <-chan bool) error {
+	c.lock.Lock()
+	c.open[market]++
+	c.lock.Unlock()
+	dataCh <- bittrex.ExchangeState{
+		Initial: true,
+		Buys:    []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "1", "0.049")},
+		Sells:   []bittrex.OrderUpdate{orderUpdate(orderUpdateAdd, "1", "0.051")},
+	}
+	<-stop
+	c.lock.Lock()
+	c.open[market]--
+	c.lock.Unlock()
+	return nil
+}
+
+// waitOpen waits for exactly markets to have a subscription open.
+func (c *countingStreamer) waitOpen(t *testing.T, markets ...string) {
+	t.Helper()
+	want := make(map[string]int, len(markets))
+	for _, market := range markets {
+		want[market] = 1
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.lock.Lock()
+		open := make(map[string]int)
+		for market, count := range c.open {
+			if count != 0 {
+				open[market] = count
+			}
+		}
+		c.lock.Unlock()
+		if reflect.DeepEqual(open, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("open subscriptions = %v, want %v", open, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOrderBookStreamTracksCandidates(t *testing.T) {
+	setupTest(t)
+	streamer := &countingStreamer{open: make(map[string]int)}
+	var lock sync.Mutex
+	updated := make(map[string]bool)
+	stream := newOrderBookStream(streamer, func(market string, bid decimal.Decimal, ask decimal.Decimal) {
+		lock.Lock()
+		updated[market] = true
+		lock.Unlock()
+	})
+
+	stream.track(map[string]bool{"BTC-ETH": true, "USDT-ETH": true})
+	streamer.waitOpen(t, "BTC-ETH", "USDT-ETH")
+	stream.track(map[string]bool{"USDT-ETH": true, "USDT-BTC": true})
+	streamer.waitOpen(t, "USDT-ETH", "USDT-BTC")
+	if markets := stream.markets(); !reflect.DeepEqual(markets, []string{"USDT-BTC", "USDT-ETH"}) {
+		t.Errorf("streaming %v, want USDT-BTC and USDT-ETH", markets)
+	}
+	stream.close()
+	streamer.waitOpen(t)
+	if markets := stream.markets(); len(markets) != 0 {
+		t.Errorf("still streaming %v after close", markets)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, market := range []string{"BTC-ETH", "USDT-ETH", "USDT-BTC"} {
+		if !updated[market] {
+			t.Errorf("no quote from %v", market)
+		}
+	}
+}